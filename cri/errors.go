@@ -0,0 +1,78 @@
+// MIT License
+//
+// Copyright (c) 2020 Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package cri
+
+import (
+	"context"
+	"errors"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/Kingdo777/puffer/misc"
+)
+
+// toStatusErr Maps the misc error taxonomy to gRPC status codes, so that kubelet
+// retries and backs off according to the kind of failure
+func toStatusErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	var (
+		nonExistErr          misc.NonExistErr
+		alreadyExistsErr     misc.AlreadyExistsErr
+		capacityExhaustedErr misc.CapacityExhaustedErr
+		invalidArgumentErr   misc.InvalidArgumentErr
+		backendErr           *misc.BackendUnavailableErr
+		timeoutErr           *misc.TimeoutErr
+		transitionErr        *misc.InvalidTransitionErr
+	)
+
+	code := codes.Unknown
+	switch {
+	case errors.As(err, &nonExistErr):
+		code = codes.NotFound
+	case errors.As(err, &alreadyExistsErr):
+		code = codes.AlreadyExists
+	case errors.As(err, &capacityExhaustedErr):
+		code = codes.ResourceExhausted
+	case errors.As(err, &invalidArgumentErr):
+		code = codes.InvalidArgument
+	case errors.As(err, &backendErr):
+		code = codes.Unavailable
+	case errors.As(err, &timeoutErr), errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
+	case errors.As(err, &transitionErr):
+		code = codes.FailedPrecondition
+	default:
+		return err
+	}
+
+	return status.Error(code, err.Error())
+}
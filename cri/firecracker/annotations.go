@@ -0,0 +1,210 @@
+// MIT License
+//
+// Copyright (c) 2020 Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package firecracker
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	criapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+
+	"github.com/Kingdo777/puffer/misc"
+)
+
+const (
+	// rateLimitClassAnnotation selects a rate limit class, the explicit limits below override it
+	rateLimitClassAnnotation = "io.puffer.rate-limit-class"
+	// Network limits, in bytes per second and packets per second
+	netRxBandwidthAnnotation = "io.puffer.net.rx-bandwidth"
+	netTxBandwidthAnnotation = "io.puffer.net.tx-bandwidth"
+	netRxPPSAnnotation       = "io.puffer.net.rx-pps"
+	netTxPPSAnnotation       = "io.puffer.net.tx-pps"
+	// Root block device limits, in bytes per second and requests per second
+	blockBandwidthAnnotation = "io.puffer.block.bandwidth"
+	blockIOPSAnnotation      = "io.puffer.block.iops"
+
+	// restartPolicyAnnotation selects how the VM is recovered when its task fails
+	restartPolicyAnnotation = "io.puffer.restart-policy"
+
+	// Readiness probe of the guest, overriding the default probe of the service
+	readinessProbeAnnotation   = "io.puffer.readiness.probe"
+	readinessPathAnnotation    = "io.puffer.readiness.path"
+	readinessTimeoutAnnotation = "io.puffer.readiness.timeout"
+
+	// rateLimitRefillMs Limits are given per second, so buckets refill every second
+	rateLimitRefillMs = 1000
+)
+
+// RateLimitClasses Named sets of rate limit annotations, e.g.
+// {"small": {"io.puffer.net.rx-bandwidth": "1048576"}}
+type RateLimitClasses map[string]map[string]string
+
+// LoadRateLimitClasses Reads rate limit classes from a JSON file
+func LoadRateLimitClasses(path string) (RateLimitClasses, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	classes := make(RateLimitClasses)
+	if err := json.Unmarshal(data, &classes); err != nil {
+		return nil, fmt.Errorf("failed to parse rate limit classes %s: %w", path, err)
+	}
+
+	return classes, nil
+}
+
+// getAnnotations Merges the pod and container annotations, container annotations take precedence
+func getAnnotations(r *criapi.CreateContainerRequest) map[string]string {
+	annotations := make(map[string]string)
+	for k, v := range r.GetSandboxConfig().GetAnnotations() {
+		annotations[k] = v
+	}
+	for k, v := range r.GetConfig().GetAnnotations() {
+		annotations[k] = v
+	}
+
+	return annotations
+}
+
+// getVMLimits Builds the VM rate limits from the annotations and the rate limit classes,
+// returns nil if no limits are set
+func getVMLimits(annotations map[string]string, classes RateLimitClasses) (*misc.VMLimits, error) {
+	values := make(map[string]string)
+
+	if className, ok := annotations[rateLimitClassAnnotation]; ok {
+		class, ok := classes[className]
+		if !ok {
+			return nil, fmt.Errorf("unknown rate limit class %q", className)
+		}
+		for k, v := range class {
+			values[k] = v
+		}
+	}
+
+	for k, v := range annotations {
+		values[k] = v
+	}
+
+	var (
+		limits = new(misc.VMLimits)
+		err    error
+		isSet  bool
+	)
+
+	parse := func(bwKey, opsKey string) *misc.RateLimiter {
+		if err != nil {
+			return nil
+		}
+
+		rl := new(misc.RateLimiter)
+		if rl.Bandwidth, err = getTokenBucket(values, bwKey); err != nil {
+			return nil
+		}
+		if rl.Ops, err = getTokenBucket(values, opsKey); err != nil {
+			return nil
+		}
+		if rl.Bandwidth == nil && rl.Ops == nil {
+			return nil
+		}
+
+		isSet = true
+		return rl
+	}
+
+	limits.NetRx = parse(netRxBandwidthAnnotation, netRxPPSAnnotation)
+	limits.NetTx = parse(netTxBandwidthAnnotation, netTxPPSAnnotation)
+	limits.Block = parse(blockBandwidthAnnotation, blockIOPSAnnotation)
+
+	if err != nil || !isSet {
+		return nil, err
+	}
+
+	return limits, nil
+}
+
+// getVMOptions Returns the VM options selected by the annotations, besides the rate limits
+func getVMOptions(annotations map[string]string) ([]misc.VMOption, error) {
+	var opts []misc.VMOption
+
+	if name, ok := annotations[restartPolicyAnnotation]; ok {
+		policy, err := misc.ParseRestartPolicy(name)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, misc.WithRestartPolicy(policy))
+	}
+
+	return opts, nil
+}
+
+// getReadinessProbe Builds the readiness probe of the guest port from the default probe
+// and the annotations, returns nil if the guest is not probed
+func getReadinessProbe(annotations map[string]string, defaults misc.ReadinessProbe, guestPort string) (*misc.ReadinessProbe, error) {
+	probe := defaults
+	probe.Port = guestPort
+
+	if name, ok := annotations[readinessProbeAnnotation]; ok {
+		probeType, err := misc.ParseProbeType(name)
+		if err != nil {
+			return nil, err
+		}
+		probe.Type = probeType
+	}
+
+	if path, ok := annotations[readinessPathAnnotation]; ok {
+		probe.Path = path
+	}
+
+	if val, ok := annotations[readinessTimeoutAnnotation]; ok {
+		timeout, err := time.ParseDuration(val)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid value %q for %s", val, readinessTimeoutAnnotation)
+		}
+		probe.Timeout = timeout
+	}
+
+	if probe.Type == "" || probe.Type == misc.ProbeNone {
+		return nil, nil
+	}
+
+	return &probe, nil
+}
+
+// getTokenBucket Creates a token bucket refilling the per-second rate given by the key
+func getTokenBucket(values map[string]string, key string) (*misc.TokenBucket, error) {
+	val, ok := values[key]
+	if !ok {
+		return nil, nil
+	}
+
+	rate, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || rate <= 0 {
+		return nil, fmt.Errorf("invalid value %q for %s, expected a positive integer", val, key)
+	}
+
+	return &misc.TokenBucket{Size: rate, RefillTimeMs: rateLimitRefillMs}, nil
+}
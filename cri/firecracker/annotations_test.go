@@ -0,0 +1,203 @@
+// MIT License
+//
+// Copyright (c) 2020 Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package firecracker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Kingdo777/puffer/misc"
+)
+
+func bucket(rate int64) *misc.TokenBucket {
+	return &misc.TokenBucket{Size: rate, RefillTimeMs: rateLimitRefillMs}
+}
+
+func TestGetVMLimits(t *testing.T) {
+	classes := RateLimitClasses{
+		"small": {
+			netRxBandwidthAnnotation: "1024",
+			blockIOPSAnnotation:      "100",
+		},
+	}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		limits      *misc.VMLimits
+		wantErr     bool
+	}{
+		{name: "no annotations"},
+		{name: "unrelated annotations", annotations: map[string]string{"io.puffer.other": "1"}},
+		{
+			name: "network limits",
+			annotations: map[string]string{
+				netRxBandwidthAnnotation: "2048",
+				netTxPPSAnnotation:       "10",
+			},
+			limits: &misc.VMLimits{
+				NetRx: &misc.RateLimiter{Bandwidth: bucket(2048)},
+				NetTx: &misc.RateLimiter{Ops: bucket(10)},
+			},
+		},
+		{
+			name: "block limits",
+			annotations: map[string]string{
+				blockBandwidthAnnotation: "4096",
+				blockIOPSAnnotation:      "50",
+			},
+			limits: &misc.VMLimits{Block: &misc.RateLimiter{Bandwidth: bucket(4096), Ops: bucket(50)}},
+		},
+		{
+			name:        "class",
+			annotations: map[string]string{rateLimitClassAnnotation: "small"},
+			limits: &misc.VMLimits{
+				NetRx: &misc.RateLimiter{Bandwidth: bucket(1024)},
+				Block: &misc.RateLimiter{Ops: bucket(100)},
+			},
+		},
+		{
+			name: "annotation overrides class",
+			annotations: map[string]string{
+				rateLimitClassAnnotation: "small",
+				netRxBandwidthAnnotation: "512",
+			},
+			limits: &misc.VMLimits{
+				NetRx: &misc.RateLimiter{Bandwidth: bucket(512)},
+				Block: &misc.RateLimiter{Ops: bucket(100)},
+			},
+		},
+		{name: "unknown class", annotations: map[string]string{rateLimitClassAnnotation: "large"}, wantErr: true},
+		{name: "not a number", annotations: map[string]string{netRxBandwidthAnnotation: "fast"}, wantErr: true},
+		{name: "zero", annotations: map[string]string{netTxBandwidthAnnotation: "0"}, wantErr: true},
+		{name: "negative", annotations: map[string]string{blockIOPSAnnotation: "-1"}, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			limits, err := getVMLimits(tc.annotations, classes)
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.limits, limits)
+		})
+	}
+}
+
+func TestGetVMOptionsRestartPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   *string
+		policy  misc.RestartPolicy
+		wantErr bool
+	}{
+		{name: "missing"},
+		{name: "restart", value: strPtr("restart"), policy: misc.RestartInPlace},
+		{name: "replace", value: strPtr("replace"), policy: misc.RestartFromSnapshot},
+		{name: "fail", value: strPtr("fail"), policy: misc.RestartNever},
+		{name: "empty", value: strPtr(""), wantErr: true},
+		{name: "unknown", value: strPtr("always"), wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			annotations := make(map[string]string)
+			if tc.value != nil {
+				annotations[restartPolicyAnnotation] = *tc.value
+			}
+
+			opts, err := getVMOptions(annotations)
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			vm := misc.NewVM("1")
+			for _, opt := range opts {
+				opt(vm)
+			}
+			require.Equal(t, tc.policy, vm.RestartPolicy)
+		})
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func TestGetReadinessProbe(t *testing.T) {
+	defaults := misc.ReadinessProbe{Type: misc.ProbeTCP, Timeout: 10 * time.Second}
+
+	tests := []struct {
+		name        string
+		defaults    misc.ReadinessProbe
+		annotations map[string]string
+		probe       *misc.ReadinessProbe
+		wantErr     bool
+	}{
+		{
+			name:     "default probe",
+			defaults: defaults,
+			probe:    &misc.ReadinessProbe{Type: misc.ProbeTCP, Port: "8080", Timeout: 10 * time.Second},
+		},
+		{name: "no default probe"},
+		{name: "default none", defaults: misc.ReadinessProbe{Type: misc.ProbeNone}},
+		{
+			name:     "http probe",
+			defaults: defaults,
+			annotations: map[string]string{
+				readinessProbeAnnotation:   "http",
+				readinessPathAnnotation:    "/healthz",
+				readinessTimeoutAnnotation: "3s",
+			},
+			probe: &misc.ReadinessProbe{Type: misc.ProbeHTTP, Port: "8080", Path: "/healthz", Timeout: 3 * time.Second},
+		},
+		{
+			name:        "probe without default",
+			annotations: map[string]string{readinessProbeAnnotation: "grpc"},
+			probe:       &misc.ReadinessProbe{Type: misc.ProbeGRPC, Port: "8080"},
+		},
+		{name: "opt out", defaults: defaults, annotations: map[string]string{readinessProbeAnnotation: "none"}},
+		{name: "unknown probe", defaults: defaults, annotations: map[string]string{readinessProbeAnnotation: "exec"}, wantErr: true},
+		{name: "invalid timeout", defaults: defaults, annotations: map[string]string{readinessTimeoutAnnotation: "soon"}, wantErr: true},
+		{name: "zero timeout", defaults: defaults, annotations: map[string]string{readinessTimeoutAnnotation: "0s"}, wantErr: true},
+		{name: "negative timeout", defaults: defaults, annotations: map[string]string{readinessTimeoutAnnotation: "-1s"}, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			probe, err := getReadinessProbe(tc.annotations, tc.defaults, "8080")
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.probe, probe)
+		})
+	}
+}
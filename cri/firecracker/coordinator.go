@@ -24,13 +24,14 @@ package firecracker
 
 import (
 	"context"
-	"errors"
 	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/Kingdo777/puffer/ctriface"
+	"github.com/Kingdo777/puffer/misc"
+	"github.com/Kingdo777/puffer/taps"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -41,6 +42,10 @@ type coordinator struct {
 
 	activeInstances map[string]*funcInstance
 	idleInstances   map[string][]*funcInstance
+	// stoppedNetStats Traffic counters of the stopped instances of each image
+	stoppedNetStats map[string]taps.LinkStats
+	// stoppedStatuses Last VM status of each stopped container, kept until the container is removed
+	stoppedStatuses map[string]*ctriface.VMStatus
 }
 
 type coordinatorOption func(*coordinator)
@@ -49,6 +54,8 @@ func newFirecrackerCoordinator(orch *ctriface.Orchestrator, opts ...coordinatorO
 	c := &coordinator{
 		activeInstances: make(map[string]*funcInstance),
 		idleInstances:   make(map[string][]*funcInstance),
+		stoppedNetStats: make(map[string]taps.LinkStats),
+		stoppedStatuses: make(map[string]*ctriface.VMStatus),
 		orch:            orch,
 	}
 
@@ -56,9 +63,35 @@ func newFirecrackerCoordinator(orch *ctriface.Orchestrator, opts ...coordinatorO
 		opt(c)
 	}
 
+	if orch != nil {
+		orch.SetVMOwnerCheck(c.ownsVM)
+	}
+
 	return c
 }
 
+// ownsVM Returns whether an active or idle instance runs in the VM
+func (c *coordinator) ownsVM(vmID string) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, fi := range c.activeInstances {
+		if fi.VmID == vmID {
+			return true
+		}
+	}
+
+	for _, idles := range c.idleInstances {
+		for _, fi := range idles {
+			if fi.VmID == vmID {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
 func (c *coordinator) getIdleInstance(image string) *funcInstance {
 	c.Lock()
 	defer c.Unlock()
@@ -69,9 +102,16 @@ func (c *coordinator) getIdleInstance(image string) *funcInstance {
 		return nil
 	}
 
-	if len(idles) != 0 {
+	for len(idles) != 0 {
 		fi := idles[0]
-		c.idleInstances[image] = idles[1:]
+		idles = idles[1:]
+		c.idleInstances[image] = idles
+
+		// Skip instances evicted to make room for other VMs
+		if c.orch != nil && !c.orch.HasVM(fi.VmID) {
+			fi.Logger.Debug("idle instance was evicted")
+			continue
+		}
 		return fi
 	}
 
@@ -108,17 +148,32 @@ func (c *coordinator) startVM(ctx context.Context, image string) (*funcInstance,
 	return c.startVMWithEnvironment(ctx, image, []string{})
 }
 
-func (c *coordinator) startVMWithEnvironment(ctx context.Context, image string, environment []string) (*funcInstance, error) {
+// startVMWithEnvironment Loads an idle instance of the image or starts a fresh one,
+// note that a loaded instance keeps the VM options it was first started with
+func (c *coordinator) startVMWithEnvironment(ctx context.Context, image string, environment []string, opts ...misc.VMOption) (*funcInstance, error) {
 	if fi := c.getIdleInstance(image); c.orch != nil && c.orch.GetSnapshotsEnabled() && fi != nil {
 		c.listIdleInstance()
 		err := c.orchLoadInstance(ctx, fi)
 		return fi, err
 	}
 
-	return c.orchStartVM(ctx, image, environment)
+	return c.orchStartVM(ctx, image, environment, opts...)
 }
 
-func (c *coordinator) stopVM(ctx context.Context, containerID string) error {
+// startVMInPod Starts a fresh VM networked by CNI in the pod network namespace
+func (c *coordinator) startVMInPod(ctx context.Context, image string, environment []string, netNSPath string, opts ...misc.VMOption) (*funcInstance, error) {
+	opts = append(opts, misc.WithPodNetNS(netNSPath))
+
+	fi, err := c.orchStartVM(ctx, image, environment, opts...)
+	fi.PodNetNS = netNSPath
+
+	return fi, err
+}
+
+// stopVM Offloads or stops the VM of a container, a stopped VM's task has the grace period to exit.
+// Offloading snapshots the guest instead of signalling it, so it does not use the grace period.
+// The container keeps its instance if neither succeeds, so that the stop can be retried
+func (c *coordinator) stopVM(ctx context.Context, containerID string, grace time.Duration) error {
 	c.Lock()
 
 	fi, ok := c.activeInstances[containerID]
@@ -127,14 +182,56 @@ func (c *coordinator) stopVM(ctx context.Context, containerID string) error {
 	c.Unlock()
 
 	if !ok {
+		// The VM of an unknown container, if any, is left to the garbage collector
+		log.WithField("containerID", containerID).Debug("stopVM: no instance for the container")
 		return nil
 	}
 
-	if c.orch != nil && c.orch.GetSnapshotsEnabled() {
-		return c.orchOffloadInstance(ctx, fi)
+	var (
+		status *ctriface.VMStatus
+		err    error
+	)
+
+	// A VM in a pod network namespace cannot outlive the pod, a failed VM cannot be
+	// snapshotted and a VM left offloaded by a failed offload cannot be offloaded again,
+	// so none of them is kept idle
+	if c.orch != nil && c.orch.GetSnapshotsEnabled() && fi.PodNetNS == "" && c.canOffload(fi) {
+		status, err = c.orchOffloadInstance(ctx, fi)
+	} else {
+		status, err = c.orchStopVM(ctx, fi, grace)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if err != nil {
+		if _, present := c.activeInstances[containerID]; !present {
+			c.activeInstances[containerID] = fi
+		}
+		return err
+	}
+
+	if status != nil {
+		c.stoppedStatuses[containerID] = status
 	}
 
-	return c.orchStopVM(ctx, fi)
+	return nil
+}
+
+// getStopped Returns the last VM status of a stopped user container
+func (c *coordinator) getStopped(containerID string) *ctriface.VMStatus {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.stoppedStatuses[containerID]
+}
+
+// removeStopped Forgets the last VM status of a removed user container
+func (c *coordinator) removeStopped(containerID string) {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.stoppedStatuses, containerID)
 }
 
 func (c *coordinator) insertActive(containerID string, fi *funcInstance) error {
@@ -144,16 +241,20 @@ func (c *coordinator) insertActive(containerID string, fi *funcInstance) error {
 	logger := log.WithFields(log.Fields{"containerID": containerID, "vmID": fi.VmID})
 
 	if fi, present := c.activeInstances[containerID]; present {
-		logger.Errorf("entry for container already exists with vmID %s" + fi.VmID)
-		return errors.New("entry for container already exists")
+		logger.Errorf("entry for container already exists with vmID %s", fi.VmID)
+		return misc.AlreadyExistsErr("entry for container " + containerID)
 	}
 
 	c.activeInstances[containerID] = fi
 	return nil
 }
 
-func (c *coordinator) orchStartVM(ctx context.Context, image string, envVariables []string) (*funcInstance, error) {
+func (c *coordinator) orchStartVM(ctx context.Context, image string, envVariables []string, opts ...misc.VMOption) (*funcInstance, error) {
 	vmID := strconv.Itoa(int(atomic.AddUint64(&c.nextID, 1)))
+	// Skip the IDs of VMs adopted from a previous run or whose leftovers could not be removed
+	for c.orch != nil && c.orch.IsVMIDInUse(vmID) {
+		vmID = strconv.Itoa(int(atomic.AddUint64(&c.nextID, 1)))
+	}
 	logger := log.WithFields(
 		log.Fields{
 			"vmID":  vmID,
@@ -171,7 +272,7 @@ func (c *coordinator) orchStartVM(ctx context.Context, image string, envVariable
 	ctxTimeout, cancel := context.WithTimeout(ctx, time.Minute*5)
 	defer cancel()
 
-	resp, _, err = c.orch.StartVMWithEnvironment(ctxTimeout, vmID, image, envVariables)
+	resp, _, err = c.orch.StartVMWithEnvironment(ctxTimeout, vmID, image, envVariables, opts...)
 	if err != nil {
 		logger.WithError(err).Error("coordinator failed to start VM")
 	}
@@ -181,13 +282,29 @@ func (c *coordinator) orchStartVM(ctx context.Context, image string, envVariable
 	return fi, err
 }
 
-func (c *coordinator) orchStopVM(ctx context.Context, fi *funcInstance) error {
-	if err := c.orch.StopSingleVM(ctx, fi.VmID); err != nil {
+// orchStopVM Stops the VM of an instance and returns its final status, the traffic counters
+// of the instance are kept with its image once the stop succeeded, as a failed stop is retried
+func (c *coordinator) orchStopVM(ctx context.Context, fi *funcInstance, grace time.Duration) (*ctriface.VMStatus, error) {
+	// The counters are read while the VM and its tap still exist
+	stats, statsErr := c.orch.GetNetStats(fi.VmID)
+
+	status, err := c.orch.StopVMWithStatus(ctx, fi.VmID, grace)
+	if err != nil {
 		fi.Logger.WithError(err).Error("failed to stop VM for instance")
-		return err
+		return nil, err
 	}
 
-	return nil
+	if statsErr == nil {
+		c.Lock()
+		imageStats := c.stoppedNetStats[fi.Image]
+		imageStats.Add(stats)
+		c.stoppedNetStats[fi.Image] = imageStats
+		c.Unlock()
+	} else {
+		fi.Logger.WithError(statsErr).Warn("failed to read network statistics of instance")
+	}
+
+	return status, nil
 }
 
 func (c *coordinator) orchLoadInstance(ctx context.Context, fi *funcInstance) error {
@@ -196,11 +313,15 @@ func (c *coordinator) orchLoadInstance(ctx context.Context, fi *funcInstance) er
 	ctxTimeout, cancel := context.WithTimeout(ctx, time.Minute*2)
 	defer cancel()
 
-	if _, _, err := c.orch.StartVMFromSnapshot(ctxTimeout, fi.VmID); err != nil {
+	resp, _, err := c.orch.StartVMFromSnapshot(ctxTimeout, fi.VmID)
+	if err != nil {
 		fi.Logger.WithError(err).Error("failed to load VM")
 		return err
 	}
 
+	// The guest address changes when the snapshot is restored with identity remapping
+	fi.StartVMResponse = resp
+
 	fi.Logger.Debug("successfully loaded idle instance")
 	return nil
 }
@@ -232,11 +353,13 @@ func (c *coordinator) orchCreateSnapshot(ctx context.Context, fi *funcInstance)
 	return err
 }
 
-func (c *coordinator) orchOffloadInstance(ctx context.Context, fi *funcInstance) error {
+// orchOffloadInstance Offloads the VM of an instance and keeps the instance idle, the returned
+// status describes the stop of the container, as the VM itself lives on
+func (c *coordinator) orchOffloadInstance(ctx context.Context, fi *funcInstance) (*ctriface.VMStatus, error) {
 	fi.Logger.Debug("offloading instance")
 
 	if err := c.orchCreateSnapshot(ctx, fi); err != nil {
-		return err
+		return nil, err
 	}
 
 	ctxTimeout, cancel := context.WithTimeout(ctx, time.Minute*3)
@@ -244,10 +367,88 @@ func (c *coordinator) orchOffloadInstance(ctx context.Context, fi *funcInstance)
 
 	if err := c.orch.Offload(ctxTimeout, fi.VmID); err != nil {
 		fi.Logger.WithError(err).Error("failed to offload instance")
+		return nil, err
+	}
+
+	status, err := c.orch.GetVMStatus(fi.VmID)
+	if err != nil {
+		fi.Logger.WithError(err).Warn("failed to get status of offloaded instance")
+		status = nil
+	} else {
+		// The exit of an earlier, recovered task does not describe this stop
+		status.State = misc.VMStopped
+		status.LastExit = nil
+		if status.StoppedAt.IsZero() {
+			status.StoppedAt = time.Now()
+		}
 	}
 
 	c.setIdleInstance(fi)
 	c.listIdleInstance()
 
+	return status, nil
+}
+
+// getActive Returns the active instance serving a user container
+func (c *coordinator) getActive(containerID string) *funcInstance {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.activeInstances[containerID]
+}
+
+// canOffload Returns whether the VM of an instance runs a task that can be snapshotted,
+// it cannot if its task failed and was not recovered or if it is already offloaded
+func (c *coordinator) canOffload(fi *funcInstance) bool {
+	status, err := c.orch.GetVMStatus(fi.VmID)
+	return err != nil || (status.State != misc.VMFailed && status.State != misc.VMOffloaded)
+}
+
+// getActiveByPod Returns the active instance serving the user container of a pod
+func (c *coordinator) getActiveByPod(podID string) *funcInstance {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, fi := range c.activeInstances {
+		if fi.PodID == podID {
+			return fi
+		}
+	}
+
 	return nil
 }
+
+// getImageNetStats Returns the traffic counters of each image, summed over its
+// stopped, active and idle instances
+func (c *coordinator) getImageNetStats() map[string]taps.LinkStats {
+	c.Lock()
+
+	imageStats := make(map[string]taps.LinkStats, len(c.stoppedNetStats))
+	for image, stats := range c.stoppedNetStats {
+		imageStats[image] = stats
+	}
+
+	instances := make([]*funcInstance, 0, len(c.activeInstances))
+	for _, fi := range c.activeInstances {
+		instances = append(instances, fi)
+	}
+	for _, idles := range c.idleInstances {
+		instances = append(instances, idles...)
+	}
+
+	c.Unlock()
+
+	for _, fi := range instances {
+		stats, err := c.orch.GetNetStats(fi.VmID)
+		if err != nil {
+			fi.Logger.WithError(err).Debug("failed to read network statistics of instance")
+			continue
+		}
+
+		sum := imageStats[fi.Image]
+		sum.Add(stats)
+		imageStats[fi.Image] = sum
+	}
+
+	return imageStats
+}
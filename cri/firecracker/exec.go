@@ -0,0 +1,204 @@
+// MIT License
+//
+// Copyright (c) 2020 Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package firecracker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/containerd/containerd/pkg/cri/streaming"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/tools/remotecommand"
+	criapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+	utilexec "k8s.io/utils/exec"
+
+	"github.com/Kingdo777/puffer/ctriface"
+	"github.com/Kingdo777/puffer/misc"
+)
+
+// ExecSync runs a command synchronously, the command of a guest container runs in its VM
+func (fs *FirecrackerService) ExecSync(ctx context.Context, r *criapi.ExecSyncRequest) (*criapi.ExecSyncResponse, error) {
+	log.Tracef("ExecSync for %q with command %+v and timeout %d (s)", r.GetContainerId(), r.GetCmd(), r.GetTimeout())
+
+	fi := fs.coordinator.getActive(r.GetContainerId())
+	if fi == nil {
+		return fs.stockRuntimeClient.ExecSync(ctx, r)
+	}
+
+	if r.GetTimeout() > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(r.GetTimeout())*time.Second)
+		defer cancel()
+	}
+
+	var stdout, stderr bytes.Buffer
+	code, err := fs.coordinator.orch.ExecInVM(ctx, fi.VmID, r.GetCmd(), ctriface.ExecOptions{
+		Stdout: &stdout,
+		Stderr: &stderr,
+	})
+	if err != nil {
+		fi.Logger.WithError(err).Debug("failed to exec in VM")
+		return nil, err
+	}
+
+	return &criapi.ExecSyncResponse{
+		Stdout:   stdout.Bytes(),
+		Stderr:   stderr.Bytes(),
+		ExitCode: int32(code),
+	}, nil
+}
+
+// Exec prepares a streaming endpoint to execute a command, the endpoint of a guest container
+// is served by the stream server of the service and runs the command in its VM
+func (fs *FirecrackerService) Exec(ctx context.Context, r *criapi.ExecRequest) (*criapi.ExecResponse, error) {
+	log.Tracef("Exec for %v", r)
+
+	if fs.coordinator.getActive(r.GetContainerId()) == nil {
+		return fs.stockRuntimeClient.Exec(ctx, r)
+	}
+	if fs.streamServer == nil {
+		return nil, streaming.NewErrorStreamingDisabled("exec")
+	}
+
+	return fs.streamServer.GetExec(r)
+}
+
+// startStreamServer Starts serving the streams of the commands executed in guests on the address
+func (fs *FirecrackerService) startStreamServer(addr string) error {
+	config := streaming.DefaultConfig
+	config.Addr = addr
+
+	server, err := streaming.NewServer(config, &streamRuntime{fs: fs})
+	if err != nil {
+		return err
+	}
+	fs.streamServer = server
+
+	go func() {
+		if err := server.Start(true); err != nil {
+			log.WithError(err).Error("stream server stopped")
+		}
+	}()
+
+	return nil
+}
+
+// streamRuntime Runs the commands requested through the stream server in guests
+type streamRuntime struct {
+	fs *FirecrackerService
+}
+
+// Exec Runs a command in the VM of a guest container until it exits, a non-zero
+// exit code is reported to the client as the exit status of the command
+func (sr *streamRuntime) Exec(containerID string, cmd []string, in io.Reader, out, errOut io.WriteCloser,
+	tty bool, resize <-chan remotecommand.TerminalSize) error {
+	fi := sr.fs.coordinator.getActive(containerID)
+	if fi == nil {
+		return misc.NonExistErr("guest container " + containerID)
+	}
+
+	// The command is killed once the client is gone, as the stream server does not say so
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Streams the client did not request are nil and left detached
+	opts := ctriface.ExecOptions{TTY: tty}
+	if in != nil {
+		// Without a terminal, the end of the input is passed on to the command
+		opts.Stdin = &streamReader{Reader: in, cancel: cancel, cancelOnEOF: tty}
+	}
+	if out != nil {
+		opts.Stdout = &streamWriter{Writer: out, cancel: cancel}
+	}
+	if errOut != nil {
+		opts.Stderr = &streamWriter{Writer: errOut, cancel: cancel}
+	}
+	if tty && resize != nil {
+		sizes := make(chan ctriface.TerminalSize)
+		go func() {
+			defer close(sizes)
+			for size := range resize {
+				sizes <- ctriface.TerminalSize{Width: size.Width, Height: size.Height}
+			}
+		}()
+		opts.Resize = sizes
+	}
+
+	code, err := sr.fs.coordinator.orch.ExecInVM(ctx, fi.VmID, cmd, opts)
+	if err != nil {
+		fi.Logger.WithError(err).Debug("failed to exec in VM")
+		return err
+	}
+	if code != 0 {
+		return &utilexec.CodeExitError{
+			Err:  fmt.Errorf("command terminated with exit code %d", code),
+			Code: int(code),
+		}
+	}
+
+	return nil
+}
+
+// streamReader Input of a command that cancels it once the client stream fails, or ends
+// if cancelOnEOF is set
+type streamReader struct {
+	io.Reader
+	cancel      context.CancelFunc
+	cancelOnEOF bool
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && (err != io.EOF || r.cancelOnEOF) {
+		r.cancel()
+	}
+	return n, err
+}
+
+// streamWriter Output of a command that cancels it once the client stream can not be written
+type streamWriter struct {
+	io.Writer
+	cancel context.CancelFunc
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if err != nil {
+		w.cancel()
+	}
+	return n, err
+}
+
+// Attach Attaching to a guest is not supported, its output is in the VM logs
+func (sr *streamRuntime) Attach(containerID string, _ io.Reader, _, _ io.WriteCloser, _ bool,
+	_ <-chan remotecommand.TerminalSize) error {
+	return fmt.Errorf("attach to guest container %s is not supported", containerID)
+}
+
+// PortForward Port forwarding is served by the stock runtime for the pod sandbox
+func (sr *streamRuntime) PortForward(podSandboxID string, _ int32, _ io.ReadWriteCloser) error {
+	return fmt.Errorf("port forward to pod %s is not served by the guest stream server", podSandboxID)
+}
@@ -0,0 +1,110 @@
+// MIT License
+//
+// Copyright (c) 2020 Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package firecracker
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// closedWriter Client stream that is gone
+type closedWriter struct{}
+
+func (closedWriter) Write(_ []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// failingReader Client stream that broke off
+type failingReader struct{}
+
+func (failingReader) Read(_ []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestStreamsCancelExec(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream func(cancel context.CancelFunc) error
+		cancel bool
+	}{
+		{
+			name: "input ends without terminal",
+			stream: func(cancel context.CancelFunc) error {
+				_, err := io.ReadAll(&streamReader{Reader: strings.NewReader("input"), cancel: cancel})
+				return err
+			},
+		},
+		{
+			name: "input ends with terminal",
+			stream: func(cancel context.CancelFunc) error {
+				_, err := io.ReadAll(&streamReader{Reader: strings.NewReader("input"), cancel: cancel, cancelOnEOF: true})
+				return err
+			},
+			cancel: true,
+		},
+		{
+			name: "input fails",
+			stream: func(cancel context.CancelFunc) error {
+				_, err := io.ReadAll(&streamReader{Reader: failingReader{}, cancel: cancel})
+				require.Error(t, err)
+				return nil
+			},
+			cancel: true,
+		},
+		{
+			name: "output is written",
+			stream: func(cancel context.CancelFunc) error {
+				_, err := (&streamWriter{Writer: io.Discard, cancel: cancel}).Write([]byte("output"))
+				return err
+			},
+		},
+		{
+			name: "output is gone",
+			stream: func(cancel context.CancelFunc) error {
+				_, err := (&streamWriter{Writer: closedWriter{}, cancel: cancel}).Write([]byte("output"))
+				require.ErrorIs(t, err, io.ErrClosedPipe)
+				return nil
+			},
+			cancel: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			require.NoError(t, tc.stream(cancel))
+			if tc.cancel {
+				require.ErrorIs(t, ctx.Err(), context.Canceled)
+			} else {
+				require.NoError(t, ctx.Err())
+			}
+		})
+	}
+}
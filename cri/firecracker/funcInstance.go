@@ -35,6 +35,10 @@ type funcInstance struct {
 	Logger                 *log.Entry
 	OnceCreateSnapInstance *sync.Once
 	StartVMResponse        *ctriface.StartVMResponse
+	// PodNetNS Pod network namespace the VM is networked in, such VMs are never offloaded
+	PodNetNS string
+	// PodID Pod sandbox whose user container the instance currently serves
+	PodID string
 }
 
 func newFuncInstance(vmID, image string, startVMResponse *ctriface.StartVMResponse) *funcInstance {
@@ -24,11 +24,16 @@ package firecracker
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"sync"
+	"time"
 
 	"github.com/Kingdo777/puffer/cri"
 	"github.com/Kingdo777/puffer/ctriface"
+	"github.com/Kingdo777/puffer/misc"
+	"github.com/containerd/containerd/pkg/cri/streaming"
 	log "github.com/sirupsen/logrus"
 	criapi "k8s.io/cri-api/pkg/apis/runtime/v1"
 )
@@ -49,6 +54,62 @@ type FirecrackerService struct {
 	coordinator *coordinator
 
 	vmConfigs map[string]*VMConfig
+
+	rateLimitClasses RateLimitClasses
+
+	readinessProbe misc.ReadinessProbe
+
+	// runtimeHandlers Runtime handlers of pods that get microVMs
+	runtimeHandlers map[string]bool
+	// knativeNames Whether the Knative user container and queue proxy get a microVM without opting in
+	knativeNames bool
+
+	// streamAddr Address of the stream server of the commands executed in guests, empty disables it
+	streamAddr   string
+	streamServer streaming.Server
+}
+
+// ServiceOption Options to pass to FirecrackerService
+type ServiceOption func(*FirecrackerService)
+
+// WithRateLimitClasses Sets the rate limit classes that pods can select by annotation
+func WithRateLimitClasses(classes RateLimitClasses) ServiceOption {
+	return func(fs *FirecrackerService) {
+		fs.rateLimitClasses = classes
+	}
+}
+
+// WithReadinessProbe Sets the default readiness probe of the guests, pods can override it by annotation
+func WithReadinessProbe(probeType misc.ProbeType, path string, timeout time.Duration) ServiceOption {
+	return func(fs *FirecrackerService) {
+		fs.readinessProbe = misc.ReadinessProbe{Type: probeType, Path: path, Timeout: timeout}
+	}
+}
+
+// WithRuntimeHandlers Gives a microVM to the pods with one of the runtime handlers,
+// which the stock runtime has to be configured with as well
+func WithRuntimeHandlers(handlers ...string) ServiceOption {
+	return func(fs *FirecrackerService) {
+		for _, handler := range handlers {
+			fs.runtimeHandlers[handler] = true
+		}
+	}
+}
+
+// WithKnativeNames Sets whether the containers named like the Knative user container
+// and queue proxy get a microVM in pods that do not select it otherwise
+func WithKnativeNames(enabled bool) ServiceOption {
+	return func(fs *FirecrackerService) {
+		fs.knativeNames = enabled
+	}
+}
+
+// WithStreamServer Serves the streams of the commands executed in guests on the address,
+// a zero port selects a free one
+func WithStreamServer(addr string) ServiceOption {
+	return func(fs *FirecrackerService) {
+		fs.streamAddr = addr
+	}
 }
 
 // VMConfig wraps the IP and port of the guest VM
@@ -57,8 +118,14 @@ type VMConfig struct {
 	guestPort string
 }
 
-func NewFirecrackerService(orch *ctriface.Orchestrator) (*FirecrackerService, error) {
+func NewFirecrackerService(orch *ctriface.Orchestrator, opts ...ServiceOption) (*FirecrackerService, error) {
 	fs := new(FirecrackerService)
+	fs.runtimeHandlers = make(map[string]bool)
+	fs.knativeNames = true
+	for _, opt := range opts {
+		opt(fs)
+	}
+
 	stockRuntimeClient, err := cri.NewStockRuntimeServiceClient()
 	if err != nil {
 		log.WithError(err).Error("failed to create new stock runtime service client")
@@ -67,31 +134,80 @@ func NewFirecrackerService(orch *ctriface.Orchestrator) (*FirecrackerService, er
 	fs.stockRuntimeClient = stockRuntimeClient
 	fs.coordinator = newFirecrackerCoordinator(orch)
 	fs.vmConfigs = make(map[string]*VMConfig)
+
+	if fs.streamAddr != "" {
+		if err := fs.startStreamServer(fs.streamAddr); err != nil {
+			log.WithError(err).Error("failed to create the stream server")
+			return nil, err
+		}
+	}
+
 	return fs, nil
 }
 
-// CreateContainer starts a container or a VM, depending on the name
-// if the name matches "user-container", the cri plugin starts a VM, assigning it an IP,
-// otherwise starts a regular container
+// CreateContainer starts a container or a VM, depending on the role of the container in its pod,
+// the guest container of a pod gets a VM, its sidecar is given the address of the VM,
+// and other containers are started by the stock runtime
 func (fs *FirecrackerService) CreateContainer(ctx context.Context, r *criapi.CreateContainerRequest) (*criapi.CreateContainerResponse, error) {
 	log.Debugf("CreateContainer within sandbox %q for container %+v",
 		r.GetPodSandboxId(), r.GetConfig().GetMetadata())
 
-	config := r.GetConfig()
-	containerName := config.GetMetadata().GetName()
-
-	if containerName == userContainerName {
-		return fs.createUserContainer(ctx, r)
+	role, sidecar, err := fs.getContainerRole(ctx, r)
+	if err != nil {
+		log.WithError(err).Error("failed to select how to run the container")
+		return nil, err
 	}
-	if containerName == queueProxyName {
-		return fs.createQueueProxy(ctx, r)
+
+	switch role {
+	case roleGuest:
+		return fs.createGuestContainer(ctx, r, sidecar)
+	case roleSidecar:
+		return fs.createSidecar(ctx, r)
 	}
 
 	// Containers relevant for control plane
 	return fs.stockRuntimeClient.CreateContainer(ctx, r)
 }
 
-func (fs *FirecrackerService) createUserContainer(ctx context.Context, r *criapi.CreateContainerRequest) (*criapi.CreateContainerResponse, error) {
+// createGuestContainer Starts the VM of the guest container next to its placeholder in the stock runtime,
+// keeping the address of the VM for the sidecar of the pod if it has one
+func (fs *FirecrackerService) createGuestContainer(ctx context.Context, r *criapi.CreateContainerRequest, sidecar bool) (*criapi.CreateContainerResponse, error) {
+	config := r.GetConfig()
+	annotations := getAnnotations(r)
+
+	guestImage, err := getGuestImage(annotations, config)
+	if err != nil {
+		log.WithError(err).Error("invalid guest image")
+		return nil, err
+	}
+
+	guestPort, err := getGuestPort(annotations, config)
+	if err != nil {
+		log.WithError(err).Error("invalid guest port")
+		return nil, err
+	}
+
+	limits, err := getVMLimits(annotations, fs.rateLimitClasses)
+	if err != nil {
+		log.WithError(err).Error("invalid rate limits")
+		return nil, misc.InvalidArgumentErr(err.Error())
+	}
+
+	vmOpts, err := getVMOptions(annotations)
+	if err != nil {
+		log.WithError(err).Error("invalid VM options")
+		return nil, misc.InvalidArgumentErr(err.Error())
+	}
+	vmOpts = append(vmOpts, misc.WithLimits(limits))
+
+	probe, err := getReadinessProbe(annotations, fs.readinessProbe, guestPort)
+	if err != nil {
+		log.WithError(err).Error("invalid readiness probe")
+		return nil, misc.InvalidArgumentErr(err.Error())
+	}
+	vmOpts = append(vmOpts, misc.WithReadinessProbe(probe))
+
+	// The placeholder is only created for a valid request, as it is not removed on failure
 	var (
 		stockResp *criapi.CreateContainerResponse
 		stockErr  error
@@ -103,28 +219,37 @@ func (fs *FirecrackerService) createUserContainer(ctx context.Context, r *criapi
 		stockResp, stockErr = fs.stockRuntimeClient.CreateContainer(ctx, r)
 	}()
 
-	config := r.GetConfig()
-	guestImage, err := getEnvVal(guestImageEnv, config)
-	if err != nil {
-		log.WithError(err).Error()
-		return nil, err
-	}
+	environment := cri.ToStringArray(getGuestEnvs(config))
 
-	environment := cri.ToStringArray(config.GetEnvs())
-	funcInst, err := fs.coordinator.startVMWithEnvironment(context.Background(), guestImage, environment)
+	var (
+		funcInst  *funcInstance
+		netNSPath string
+	)
+	if fs.coordinator.orch.GetCNIEnabled() {
+		netNSPath, err = fs.getPodNetNS(ctx, r.GetPodSandboxId())
+		if err != nil {
+			log.WithError(err).Error("failed to get pod network namespace")
+			return nil, err
+		}
+		funcInst, err = fs.coordinator.startVMInPod(context.Background(), guestImage, environment, netNSPath, vmOpts...)
+	} else {
+		funcInst, err = fs.coordinator.startVMWithEnvironment(context.Background(), guestImage, environment, vmOpts...)
+	}
 	if err != nil {
 		log.WithError(err).Error("failed to start VM")
 		return nil, err
 	}
 
-	guestPort, err := getEnvVal(guestPortEnv, config)
-	if err != nil {
-		log.WithError(err).Error()
+	// A loaded idle instance served another pod before, so the labels are set on every start
+	if err := fs.coordinator.orch.SetVMLabels(funcInst.VmID, getVMLabels(r, guestImage)); err != nil {
+		log.WithError(err).Error("failed to label VM")
 		return nil, err
 	}
 
-	vmConfig := &VMConfig{guestIP: funcInst.StartVMResponse.GuestIP, guestPort: guestPort}
-	fs.insertVMConfig(r.GetPodSandboxId(), vmConfig)
+	if sidecar {
+		vmConfig := &VMConfig{guestIP: funcInst.StartVMResponse.GuestIP, guestPort: guestPort}
+		fs.insertVMConfig(r.GetPodSandboxId(), vmConfig)
+	}
 
 	// Wait for placeholder UC to be created
 	<-stockDone
@@ -136,6 +261,7 @@ func (fs *FirecrackerService) createUserContainer(ctx context.Context, r *criapi
 	}
 
 	containerdID := stockResp.ContainerId
+	funcInst.PodID = r.GetPodSandboxId()
 	err = fs.coordinator.insertActive(containerdID, funcInst)
 	if err != nil {
 		log.WithError(err).Error("failed to insert active VM")
@@ -145,7 +271,8 @@ func (fs *FirecrackerService) createUserContainer(ctx context.Context, r *criapi
 	return stockResp, stockErr
 }
 
-func (fs *FirecrackerService) createQueueProxy(ctx context.Context, r *criapi.CreateContainerRequest) (*criapi.CreateContainerResponse, error) {
+// createSidecar Starts the sidecar of the guest container with the address of the guest
+func (fs *FirecrackerService) createSidecar(ctx context.Context, r *criapi.CreateContainerRequest) (*criapi.CreateContainerResponse, error) {
 	vmConfig, err := fs.getVMConfig(r.GetPodSandboxId())
 	if err != nil {
 		log.WithError(err).Error()
@@ -167,15 +294,52 @@ func (fs *FirecrackerService) createQueueProxy(ctx context.Context, r *criapi.Cr
 	return resp, nil
 }
 
+// StopContainer stops the VM of a user container, giving the guest the timeout of the
+// request to exit, then the stock runtime stops the container itself. A VM that is
+// offloaded is snapshotted rather than signalled, and does not wait for the timeout
+func (fs *FirecrackerService) StopContainer(ctx context.Context, r *criapi.StopContainerRequest) (*criapi.StopContainerResponse, error) {
+	log.Debugf("StopContainer for %q with timeout %d (s)", r.GetContainerId(), r.GetTimeout())
+	grace := time.Duration(r.GetTimeout()) * time.Second
+
+	if err := fs.coordinator.stopVM(context.Background(), r.GetContainerId(), grace); err != nil {
+		log.WithError(err).Error("failed to stop microVM")
+	}
+
+	return fs.stockRuntimeClient.StopContainer(ctx, r)
+}
+
 func (fs *FirecrackerService) RemoveContainer(ctx context.Context, r *criapi.RemoveContainerRequest) (*criapi.RemoveContainerResponse, error) {
 	log.Debugf("RemoveContainer for %q", r.GetContainerId())
 	containerID := r.GetContainerId()
 
-	if err := fs.coordinator.stopVM(context.Background(), containerID); err != nil {
+	// The VM is normally stopped by StopContainer already, a remaining one is killed
+	if err := fs.coordinator.stopVM(context.Background(), containerID, 0); err != nil {
 		log.WithError(err).Error("failed to stop microVM")
 	}
 
-	return fs.stockRuntimeClient.RemoveContainer(ctx, r)
+	resp, err := fs.stockRuntimeClient.RemoveContainer(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.coordinator.removeStopped(containerID)
+
+	return resp, nil
+}
+
+// RemovePodSandbox removes the pod in the stock runtime and drops the guest address kept for
+// its sidecar, which is left over if the sidecar was never created
+func (fs *FirecrackerService) RemovePodSandbox(ctx context.Context, r *criapi.RemovePodSandboxRequest) (*criapi.RemovePodSandboxResponse, error) {
+	log.Debugf("RemovePodSandbox for %q", r.GetPodSandboxId())
+
+	resp, err := fs.stockRuntimeClient.RemovePodSandbox(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.removeVMConfig(r.GetPodSandboxId())
+
+	return resp, nil
 }
 
 func (fs *FirecrackerService) insertVMConfig(podID string, vmConfig *VMConfig) {
@@ -205,14 +369,66 @@ func (fs *FirecrackerService) getVMConfig(podID string) (*VMConfig, error) {
 	return vmConfig, nil
 }
 
-func getEnvVal(key string, config *criapi.ContainerConfig) (string, error) {
-	envs := config.GetEnvs()
-	for _, kv := range envs {
-		if kv.GetKey() == key {
-			return kv.GetValue(), nil
+// getPodNetNS Returns the network namespace path of a pod sandbox from its verbose status
+func (fs *FirecrackerService) getPodNetNS(ctx context.Context, podID string) (string, error) {
+	resp, err := fs.stockRuntimeClient.PodSandboxStatus(ctx, &criapi.PodSandboxStatusRequest{
+		PodSandboxId: podID,
+		Verbose:      true,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var info struct {
+		RuntimeSpec struct {
+			Linux struct {
+				Namespaces []struct {
+					Type string `json:"type"`
+					Path string `json:"path"`
+				} `json:"namespaces"`
+			} `json:"linux"`
+		} `json:"runtimeSpec"`
+	}
+
+	if err := json.Unmarshal([]byte(resp.GetInfo()["info"]), &info); err != nil {
+		return "", fmt.Errorf("failed to parse status of pod %s: %w", podID, err)
+	}
+
+	for _, ns := range info.RuntimeSpec.Linux.Namespaces {
+		if ns.Type == "network" && ns.Path != "" {
+			return ns.Path, nil
 		}
+	}
+
+	return "", fmt.Errorf("pod %s has no network namespace", podID)
+}
+
+// getVMLabels Returns the labels of the VM serving the user container, taken from
+// the sandbox and container metadata
+func getVMLabels(r *criapi.CreateContainerRequest, guestImage string) map[string]string {
+	labels := make(map[string]string)
+	for k, v := range r.GetSandboxConfig().GetLabels() {
+		labels[k] = v
+	}
+
+	metadata := r.GetSandboxConfig().GetMetadata()
+	labels[misc.LabelPodName] = metadata.GetName()
+	labels[misc.LabelPodNamespace] = metadata.GetNamespace()
+	labels[misc.LabelPodUID] = metadata.GetUid()
+	labels[misc.LabelPodSandboxID] = r.GetPodSandboxId()
+	labels[misc.LabelContainerName] = r.GetConfig().GetMetadata().GetName()
+	labels[misc.LabelImage] = guestImage
+
+	return labels
+}
 
+// lookupEnv Returns the value of an environment variable of a container
+func lookupEnv(key string, config *criapi.ContainerConfig) (string, bool) {
+	for _, kv := range config.GetEnvs() {
+		if kv.GetKey() == key {
+			return kv.GetValue(), true
+		}
 	}
 
-	return "", errors.New("failed to provide non empty guest image in user container config")
+	return "", false
 }
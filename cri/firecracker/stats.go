@@ -0,0 +1,143 @@
+// MIT License
+//
+// Copyright (c) 2020 Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package firecracker
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/Kingdo777/puffer/taps"
+	log "github.com/sirupsen/logrus"
+	criapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+const (
+	// guestIfaceName Name of the network interface in the guest
+	guestIfaceName = "eth0"
+	// netStatsInfoKey Key of the per-image traffic counters in the verbose runtime status
+	netStatsInfoKey = "netStatsByImage"
+	// driftInfoKey Key of the report of the last reconciliation in the verbose runtime status
+	driftInfoKey = "reconcileDrift"
+)
+
+// PodSandboxStats returns the stats of the pod, with the network usage of the
+// VM serving its user container. CRI container stats have no network fields,
+// so the pod stats carry the traffic of the user container
+func (fs *FirecrackerService) PodSandboxStats(ctx context.Context, r *criapi.PodSandboxStatsRequest) (*criapi.PodSandboxStatsResponse, error) {
+	resp, err := fs.stockRuntimeClient.PodSandboxStats(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.setVMNetworkUsage(resp.GetStats())
+
+	return resp, nil
+}
+
+// ListPodSandboxStats returns the stats of the pods, with the network usage of
+// the VMs serving their user containers
+func (fs *FirecrackerService) ListPodSandboxStats(ctx context.Context, r *criapi.ListPodSandboxStatsRequest) (*criapi.ListPodSandboxStatsResponse, error) {
+	resp, err := fs.stockRuntimeClient.ListPodSandboxStats(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, stats := range resp.GetStats() {
+		fs.setVMNetworkUsage(stats)
+	}
+
+	return resp, nil
+}
+
+// Status returns the status of the runtime, the verbose status includes the
+// traffic counters of each image summed over all its instances and the drift
+// found by the last reconciliation
+func (fs *FirecrackerService) Status(ctx context.Context, r *criapi.StatusRequest) (*criapi.StatusResponse, error) {
+	resp, err := fs.stockRuntimeClient.Status(ctx, r)
+	if err != nil || !r.GetVerbose() {
+		return resp, err
+	}
+
+	data, err := json.Marshal(fs.coordinator.getImageNetStats())
+	if err != nil {
+		log.WithError(err).Error("failed to marshal network statistics")
+		return resp, nil
+	}
+
+	if resp.Info == nil {
+		resp.Info = make(map[string]string)
+	}
+	resp.Info[netStatsInfoKey] = string(data)
+
+	if drift := fs.coordinator.orch.GetDriftReport(); drift != nil {
+		if data, err := json.Marshal(drift); err == nil {
+			resp.Info[driftInfoKey] = string(data)
+		}
+	}
+
+	return resp, nil
+}
+
+// setVMNetworkUsage Makes the guest interface of the VM serving the pod the default
+// interface of the pod network usage, the interface reported by containerd is kept
+func (fs *FirecrackerService) setVMNetworkUsage(stats *criapi.PodSandboxStats) {
+	if stats == nil {
+		return
+	}
+
+	fi := fs.coordinator.getActiveByPod(stats.GetAttributes().GetId())
+	if fi == nil {
+		return
+	}
+
+	vmStats, err := fs.coordinator.orch.GetNetStats(fi.VmID)
+	if err != nil {
+		fi.Logger.WithError(err).Warn("failed to read network statistics of instance")
+		return
+	}
+
+	if stats.Linux == nil {
+		stats.Linux = &criapi.LinuxPodSandboxStats{}
+	}
+	if stats.Linux.Network == nil {
+		stats.Linux.Network = &criapi.NetworkUsage{}
+	}
+
+	network := stats.Linux.Network
+	if network.DefaultInterface != nil {
+		network.Interfaces = append(network.Interfaces, network.DefaultInterface)
+	}
+	network.Timestamp = time.Now().UnixNano()
+	network.DefaultInterface = getNetworkInterfaceUsage(vmStats)
+}
+
+func getNetworkInterfaceUsage(stats taps.LinkStats) *criapi.NetworkInterfaceUsage {
+	return &criapi.NetworkInterfaceUsage{
+		Name:     guestIfaceName,
+		RxBytes:  &criapi.UInt64Value{Value: stats.RxBytes},
+		RxErrors: &criapi.UInt64Value{Value: stats.RxErrors},
+		TxBytes:  &criapi.UInt64Value{Value: stats.TxBytes},
+		TxErrors: &criapi.UInt64Value{Value: stats.TxErrors},
+	}
+}
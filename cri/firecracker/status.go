@@ -0,0 +1,189 @@
+// MIT License
+//
+// Copyright (c) 2020 Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package firecracker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	criapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+
+	"github.com/Kingdo777/puffer/ctriface"
+	"github.com/Kingdo777/puffer/misc"
+)
+
+// vmInfo VM facts added to the verbose status of a guest container
+type vmInfo struct {
+	VMID      string     `json:"vmID"`
+	State     string     `json:"state"`
+	GuestIP   string     `json:"guestIP,omitempty"`
+	StartedAt time.Time  `json:"startedAt"`
+	Restored  bool       `json:"restored"`
+	Restarts  int        `json:"restarts"`
+	ExitCode  *uint32    `json:"exitCode,omitempty"`
+	StoppedAt *time.Time `json:"stoppedAt,omitempty"`
+}
+
+// ContainerStatus returns the status of a container, the status of a guest container
+// describes its VM rather than its placeholder in the stock runtime
+func (fs *FirecrackerService) ContainerStatus(ctx context.Context, r *criapi.ContainerStatusRequest) (*criapi.ContainerStatusResponse, error) {
+	log.Tracef("ContainerStatus for %q", r.GetContainerId())
+
+	resp, err := fs.stockRuntimeClient.ContainerStatus(ctx, r)
+	if err != nil || resp.GetStatus() == nil {
+		return resp, err
+	}
+
+	vmStatus := fs.getGuestVMStatus(r.GetContainerId())
+	if vmStatus == nil {
+		return resp, nil
+	}
+
+	setVMStatus(resp.Status, vmStatus)
+
+	if r.GetVerbose() {
+		info := vmInfo{
+			VMID:      vmStatus.VMID,
+			State:     string(vmStatus.State),
+			GuestIP:   vmStatus.GuestIP,
+			StartedAt: vmStatus.StartedAt,
+			Restored:  vmStatus.Restored,
+			Restarts:  vmStatus.Restarts,
+		}
+		if vmStatus.LastExit != nil {
+			info.ExitCode = &vmStatus.LastExit.Code
+		}
+		if !vmStatus.StoppedAt.IsZero() {
+			info.StoppedAt = &vmStatus.StoppedAt
+		}
+
+		data, err := json.Marshal(info)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Info == nil {
+			resp.Info = make(map[string]string)
+		}
+		resp.Info["vm"] = string(data)
+	}
+
+	return resp, nil
+}
+
+// ListContainers lists the containers, the state of a guest container is the state of its VM
+func (fs *FirecrackerService) ListContainers(ctx context.Context, r *criapi.ListContainersRequest) (*criapi.ListContainersResponse, error) {
+	log.Tracef("ListContainers with filter %+v", r.GetFilter())
+
+	// The state filter applies to the state of the VM, not of the placeholder
+	var stateFilter *criapi.ContainerStateValue
+	if filter := r.GetFilter(); filter.GetState() != nil {
+		stateFilter = filter.GetState()
+		unfiltered := *filter
+		unfiltered.State = nil
+		r = &criapi.ListContainersRequest{Filter: &unfiltered}
+	}
+
+	resp, err := fs.stockRuntimeClient.ListContainers(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	containers := resp.Containers[:0]
+	for _, c := range resp.GetContainers() {
+		if vmStatus := fs.getGuestVMStatus(c.GetId()); vmStatus != nil && guestExited(vmStatus) {
+			c.State = criapi.ContainerState_CONTAINER_EXITED
+		}
+
+		if stateFilter == nil || c.GetState() == stateFilter.GetState() {
+			containers = append(containers, c)
+		}
+	}
+	resp.Containers = containers
+
+	return resp, nil
+}
+
+// getGuestVMStatus Returns the status of the VM of a guest container, the last status of its VM
+// if the container was stopped, nil for other containers
+func (fs *FirecrackerService) getGuestVMStatus(containerID string) *ctriface.VMStatus {
+	fi := fs.coordinator.getActive(containerID)
+	if fi == nil {
+		return fs.coordinator.getStopped(containerID)
+	}
+
+	vmStatus, err := fs.coordinator.orch.GetVMStatus(fi.VmID)
+	if err != nil {
+		log.WithError(err).Warnf("failed to get status of VM %s", fi.VmID)
+		return nil
+	}
+
+	return vmStatus
+}
+
+// guestExited Returns whether no guest serves the container of a VM anymore, because its
+// task failed, because the VM was left offloaded after a failed replacement or because
+// the container was stopped
+func guestExited(vmStatus *ctriface.VMStatus) bool {
+	return vmStatus.State == misc.VMFailed || vmStatus.State == misc.VMOffloaded || vmStatus.State == misc.VMStopped
+}
+
+// setVMStatus Overlays the facts of the VM of a guest container on the status of its placeholder
+func setVMStatus(status *criapi.ContainerStatus, vmStatus *ctriface.VMStatus) {
+	if status.State != criapi.ContainerState_CONTAINER_CREATED && !vmStatus.StartedAt.IsZero() {
+		status.StartedAt = vmStatus.StartedAt.UnixNano()
+	}
+
+	if !guestExited(vmStatus) {
+		if vmStatus.Restored {
+			status.Message = fmt.Sprintf("guest runs in VM %s at %s, restored from a snapshot", vmStatus.VMID, vmStatus.GuestIP)
+		} else {
+			status.Message = fmt.Sprintf("guest runs in VM %s at %s", vmStatus.VMID, vmStatus.GuestIP)
+		}
+		return
+	}
+
+	status.State = criapi.ContainerState_CONTAINER_EXITED
+	status.Reason = "Error"
+	status.Message = fmt.Sprintf("guest of VM %s is not running", vmStatus.VMID)
+
+	if vmStatus.State == misc.VMStopped {
+		status.Reason = "Completed"
+		status.ExitCode = 0
+		status.FinishedAt = vmStatus.StoppedAt.UnixNano()
+		status.Message = fmt.Sprintf("VM %s was stopped", vmStatus.VMID)
+	}
+
+	// The exit of a task recovered before the stop does not describe the stop
+	if exit := vmStatus.LastExit; exit != nil && (vmStatus.State != misc.VMStopped || !exit.ExitedAt.Before(vmStatus.StartedAt)) {
+		status.ExitCode = int32(exit.Code)
+		status.FinishedAt = exit.ExitedAt.UnixNano()
+		status.Reason = "Error"
+		if exit.Code == 0 {
+			status.Reason = "Completed"
+		}
+		status.Message = fmt.Sprintf("guest task of VM %s exited with code %d after %d restarts", vmStatus.VMID, exit.Code, vmStatus.Restarts)
+	}
+}
@@ -0,0 +1,121 @@
+// MIT License
+//
+// Copyright (c) 2020 Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package firecracker
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	criapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+
+	"github.com/Kingdo777/puffer/ctriface"
+	"github.com/Kingdo777/puffer/misc"
+)
+
+// placeholderRuntime Stock runtime whose containers are all running placeholders
+type placeholderRuntime struct {
+	criapi.RuntimeServiceClient
+}
+
+func (placeholderRuntime) ContainerStatus(_ context.Context, r *criapi.ContainerStatusRequest, _ ...grpc.CallOption) (*criapi.ContainerStatusResponse, error) {
+	return &criapi.ContainerStatusResponse{
+		Status: &criapi.ContainerStatus{
+			Id:    r.GetContainerId(),
+			State: criapi.ContainerState_CONTAINER_RUNNING,
+		},
+	}, nil
+}
+
+func (placeholderRuntime) ListContainers(_ context.Context, _ *criapi.ListContainersRequest, _ ...grpc.CallOption) (*criapi.ListContainersResponse, error) {
+	return &criapi.ListContainersResponse{
+		Containers: []*criapi.Container{{Id: "c1", State: criapi.ContainerState_CONTAINER_RUNNING}},
+	}, nil
+}
+
+func TestStatusOfStoppedGuestContainer(t *testing.T) {
+	fs := &FirecrackerService{
+		stockRuntimeClient: placeholderRuntime{},
+		coordinator:        newFirecrackerCoordinator(nil),
+	}
+
+	startedAt := time.Now().Add(-time.Minute)
+	exitedAt := startedAt.Add(30 * time.Second)
+	fs.coordinator.stoppedStatuses["c1"] = &ctriface.VMStatus{
+		VMID:      "7",
+		State:     misc.VMStopped,
+		StartedAt: startedAt,
+		LastExit:  &misc.TaskExit{Code: 137, ExitedAt: exitedAt},
+		StoppedAt: exitedAt.Add(time.Second),
+	}
+
+	resp, err := fs.ContainerStatus(context.Background(), &criapi.ContainerStatusRequest{ContainerId: "c1", Verbose: true})
+	require.NoError(t, err)
+	status := resp.GetStatus()
+	require.Equal(t, criapi.ContainerState_CONTAINER_EXITED, status.GetState())
+	require.Equal(t, int32(137), status.GetExitCode())
+	require.Equal(t, "Error", status.GetReason())
+	require.Equal(t, exitedAt.UnixNano(), status.GetFinishedAt())
+	require.Equal(t, startedAt.UnixNano(), status.GetStartedAt())
+
+	var info vmInfo
+	require.NoError(t, json.Unmarshal([]byte(resp.GetInfo()["vm"]), &info))
+	require.Equal(t, "7", info.VMID)
+	require.Equal(t, string(misc.VMStopped), info.State)
+	require.NotNil(t, info.ExitCode)
+	require.Equal(t, uint32(137), *info.ExitCode)
+	require.NotNil(t, info.StoppedAt)
+	require.True(t, info.StoppedAt.Equal(exitedAt.Add(time.Second)))
+
+	list, err := fs.ListContainers(context.Background(), &criapi.ListContainersRequest{
+		Filter: &criapi.ContainerFilter{State: &criapi.ContainerStateValue{State: criapi.ContainerState_CONTAINER_EXITED}},
+	})
+	require.NoError(t, err)
+	require.Len(t, list.GetContainers(), 1)
+	require.Equal(t, criapi.ContainerState_CONTAINER_EXITED, list.GetContainers()[0].GetState())
+
+	// Without an exit of its task, a stopped VM completed at the time it was stopped
+	fs.coordinator.stoppedStatuses["c1"].LastExit = nil
+	resp, err = fs.ContainerStatus(context.Background(), &criapi.ContainerStatusRequest{ContainerId: "c1"})
+	require.NoError(t, err)
+	require.Equal(t, criapi.ContainerState_CONTAINER_EXITED, resp.GetStatus().GetState())
+	require.Equal(t, int32(0), resp.GetStatus().GetExitCode())
+	require.Equal(t, "Completed", resp.GetStatus().GetReason())
+	require.Equal(t, exitedAt.Add(time.Second).UnixNano(), resp.GetStatus().GetFinishedAt())
+
+	// The placeholder speaks for the container once it is removed
+	fs.coordinator.removeStopped("c1")
+	resp, err = fs.ContainerStatus(context.Background(), &criapi.ContainerStatusRequest{ContainerId: "c1"})
+	require.NoError(t, err)
+	require.Equal(t, criapi.ContainerState_CONTAINER_RUNNING, resp.GetStatus().GetState())
+	require.Empty(t, resp.GetStatus().GetReason())
+}
+
+func TestVMInfoOfRunningVMHasNoStopTime(t *testing.T) {
+	data, err := json.Marshal(vmInfo{VMID: "7", State: string(misc.VMRunning), StartedAt: time.Now()})
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "stoppedAt")
+}
@@ -0,0 +1,194 @@
+// MIT License
+//
+// Copyright (c) 2020 Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package firecracker
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/containerd/containerd/reference/docker"
+	criapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+
+	"github.com/Kingdo777/puffer/misc"
+)
+
+const (
+	// microVMAnnotation opts a pod in or out of microVM isolation, regardless of its runtime handler
+	microVMAnnotation = "io.puffer.microvm"
+	// guestContainerAnnotation names the container of the pod that runs in the microVM,
+	// user-container by default
+	guestContainerAnnotation = "io.puffer.guest-container"
+	// sidecarContainerAnnotation names the container of the pod that is given the guest
+	// address, none if empty. By default, pods run for their Knative names have the
+	// queue-proxy, and other pods have none
+	sidecarContainerAnnotation = "io.puffer.sidecar-container"
+	// Image the microVM runs and port the function in it listens on
+	guestImageAnnotation = "io.puffer.guest-image"
+	guestPortAnnotation  = "io.puffer.guest-port"
+)
+
+// containerRole How a container of a pod is run
+type containerRole int
+
+const (
+	// roleStock The stock runtime runs the container
+	roleStock containerRole = iota
+	// roleGuest A microVM runs the container, the stock runtime only runs a placeholder
+	roleGuest
+	// roleSidecar The stock runtime runs the container with the address of the guest
+	roleSidecar
+)
+
+// getContainerRole Returns how a container is run and whether the guest of its pod has a
+// sidecar. A pod gets a microVM if it opts in by annotation, if its runtime handler is one
+// of puffer's, or, with Knative names, if the container has the name of the Knative user
+// container or its queue proxy
+func (fs *FirecrackerService) getContainerRole(ctx context.Context, r *criapi.CreateContainerRequest) (containerRole, bool, error) {
+	podAnnotations := r.GetSandboxConfig().GetAnnotations()
+	name := r.GetConfig().GetMetadata().GetName()
+
+	selected, err := fs.isMicroVMPod(ctx, r.GetPodSandboxId(), podAnnotations)
+	if err != nil {
+		return roleStock, false, err
+	}
+
+	if !selected {
+		_, optedOut := podAnnotations[microVMAnnotation]
+		if optedOut || !fs.knativeNames {
+			return roleStock, false, nil
+		}
+	}
+	sidecar := hasSidecar(podAnnotations, selected)
+
+	guestName, ok := podAnnotations[guestContainerAnnotation]
+	if !ok {
+		guestName = userContainerName
+	}
+	sidecarName, ok := podAnnotations[sidecarContainerAnnotation]
+	if !ok {
+		sidecarName = queueProxyName
+	}
+
+	switch {
+	case name == guestName:
+		return roleGuest, sidecar, nil
+	case name == sidecarName && sidecar:
+		return roleSidecar, sidecar, nil
+	}
+
+	return roleStock, sidecar, nil
+}
+
+// hasSidecar Returns whether the guest container of a pod has a sidecar to be given its address.
+// Without the annotation, only pods run for their Knative names have one, the queue proxy,
+// as the address given to a sidecar that never comes would be kept until the pod is removed
+func hasSidecar(podAnnotations map[string]string, selected bool) bool {
+	if name, ok := podAnnotations[sidecarContainerAnnotation]; ok {
+		return name != ""
+	}
+	return !selected
+}
+
+// isMicroVMPod Returns whether a pod selects microVM isolation by annotation or runtime handler
+func (fs *FirecrackerService) isMicroVMPod(ctx context.Context, podID string, podAnnotations map[string]string) (bool, error) {
+	if val, ok := podAnnotations[microVMAnnotation]; ok {
+		selected, err := strconv.ParseBool(val)
+		if err != nil {
+			return false, fmt.Errorf("invalid value %q for %s", val, microVMAnnotation)
+		}
+		return selected, nil
+	}
+
+	if len(fs.runtimeHandlers) == 0 {
+		return false, nil
+	}
+
+	// The stock runtime has to know the handlers too, so it keeps them in the pod status
+	resp, err := fs.stockRuntimeClient.PodSandboxStatus(ctx, &criapi.PodSandboxStatusRequest{PodSandboxId: podID})
+	if err != nil {
+		return false, err
+	}
+
+	return fs.runtimeHandlers[resp.GetStatus().GetRuntimeHandler()], nil
+}
+
+// getGuestSetting Returns a guest setting from its annotation, or from the environment of
+// the guest container as set by Knative, and where it was found
+func getGuestSetting(annotations map[string]string, annotation, envKey string, config *criapi.ContainerConfig) (string, string, error) {
+	if val, ok := annotations[annotation]; ok {
+		return val, "annotation " + annotation, nil
+	}
+
+	if val, ok := lookupEnv(envKey, config); ok {
+		return val, "environment variable " + envKey, nil
+	}
+
+	return "", "", misc.InvalidArgumentErr(fmt.Sprintf("missing %s annotation or %s environment variable", annotation, envKey))
+}
+
+// getGuestImage Returns the image the guest runs, which has to be a valid image reference
+func getGuestImage(annotations map[string]string, config *criapi.ContainerConfig) (string, error) {
+	image, source, err := getGuestSetting(annotations, guestImageAnnotation, guestImageEnv, config)
+	if err != nil {
+		return "", err
+	}
+
+	if image == "" {
+		return "", misc.InvalidArgumentErr("empty guest image in " + source)
+	}
+	if _, err := docker.ParseDockerRef(image); err != nil {
+		return "", misc.InvalidArgumentErr(fmt.Sprintf("guest image %q in %s: %v", image, source, err))
+	}
+
+	return image, nil
+}
+
+// getGuestPort Returns the port the function in the guest listens on, which has to be a TCP port
+func getGuestPort(annotations map[string]string, config *criapi.ContainerConfig) (string, error) {
+	port, source, err := getGuestSetting(annotations, guestPortAnnotation, guestPortEnv, config)
+	if err != nil {
+		return "", err
+	}
+
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+		return "", misc.InvalidArgumentErr(fmt.Sprintf("guest port %q in %s is not a port number", port, source))
+	}
+
+	return port, nil
+}
+
+// getGuestEnvs Returns the environment of the guest container without the variables
+// puffer uses to configure the guest, which the function has no use for
+func getGuestEnvs(config *criapi.ContainerConfig) []*criapi.KeyValue {
+	var envs []*criapi.KeyValue
+	for _, kv := range config.GetEnvs() {
+		switch kv.GetKey() {
+		case guestImageEnv, guestPortEnv, guestIPEnv:
+			continue
+		}
+		envs = append(envs, kv)
+	}
+
+	return envs
+}
@@ -0,0 +1,245 @@
+// MIT License
+//
+// Copyright (c) 2020 Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package firecracker
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	criapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// handlerRuntime Stock runtime whose pods all run with the same runtime handler
+type handlerRuntime struct {
+	criapi.RuntimeServiceClient
+	handler string
+}
+
+func (h handlerRuntime) PodSandboxStatus(_ context.Context, r *criapi.PodSandboxStatusRequest, _ ...grpc.CallOption) (*criapi.PodSandboxStatusResponse, error) {
+	return &criapi.PodSandboxStatusResponse{
+		Status: &criapi.PodSandboxStatus{Id: r.GetPodSandboxId(), RuntimeHandler: h.handler},
+	}, nil
+}
+
+func (handlerRuntime) RemovePodSandbox(_ context.Context, _ *criapi.RemovePodSandboxRequest, _ ...grpc.CallOption) (*criapi.RemovePodSandboxResponse, error) {
+	return &criapi.RemovePodSandboxResponse{}, nil
+}
+
+func newContainerRequest(name string, podAnnotations map[string]string) *criapi.CreateContainerRequest {
+	return &criapi.CreateContainerRequest{
+		PodSandboxId:  "pod",
+		Config:        &criapi.ContainerConfig{Metadata: &criapi.ContainerMetadata{Name: name}},
+		SandboxConfig: &criapi.PodSandboxConfig{Annotations: podAnnotations},
+	}
+}
+
+func TestGetContainerRole(t *testing.T) {
+	tests := []struct {
+		name           string
+		handler        string
+		knativeNames   bool
+		container      string
+		podAnnotations map[string]string
+		role           containerRole
+		sidecar        bool
+		wantErr        bool
+	}{
+		{name: "stock pod", container: userContainerName, role: roleStock},
+		{name: "knative user container", knativeNames: true, container: userContainerName, role: roleGuest, sidecar: true},
+		{name: "knative queue proxy", knativeNames: true, container: queueProxyName, role: roleSidecar, sidecar: true},
+		{name: "knative other container", knativeNames: true, container: "other", role: roleStock, sidecar: true},
+		{
+			name: "knative opt out", knativeNames: true, container: userContainerName,
+			podAnnotations: map[string]string{microVMAnnotation: "false"}, role: roleStock,
+		},
+		{
+			name: "knative without sidecar", knativeNames: true, container: queueProxyName,
+			podAnnotations: map[string]string{sidecarContainerAnnotation: ""}, role: roleStock,
+		},
+		{
+			name: "annotated guest", container: userContainerName,
+			podAnnotations: map[string]string{microVMAnnotation: "true"}, role: roleGuest,
+		},
+		{
+			name: "annotated pod has no default sidecar", container: queueProxyName,
+			podAnnotations: map[string]string{microVMAnnotation: "true"}, role: roleStock,
+		},
+		{
+			name: "annotated guest and sidecar", container: "proxy",
+			podAnnotations: map[string]string{
+				microVMAnnotation:          "true",
+				guestContainerAnnotation:   "fn",
+				sidecarContainerAnnotation: "proxy",
+			},
+			role: roleSidecar, sidecar: true,
+		},
+		{
+			name: "runtime handler", handler: "puffer", container: userContainerName,
+			role: roleGuest,
+		},
+		{
+			name: "runtime handler has no default sidecar", handler: "puffer", knativeNames: true,
+			container: queueProxyName, role: roleStock,
+		},
+		{name: "other runtime handler", handler: "runc", container: userContainerName, role: roleStock},
+		{
+			name: "invalid opt in", container: userContainerName,
+			podAnnotations: map[string]string{microVMAnnotation: "maybe"}, wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := &FirecrackerService{
+				stockRuntimeClient: handlerRuntime{handler: tc.handler},
+				runtimeHandlers:    map[string]bool{"puffer": true},
+				knativeNames:       tc.knativeNames,
+			}
+
+			role, sidecar, err := fs.getContainerRole(context.Background(), newContainerRequest(tc.container, tc.podAnnotations))
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.role, role)
+			require.Equal(t, tc.sidecar, sidecar)
+		})
+	}
+}
+
+func TestRemovePodSandboxDropsVMConfig(t *testing.T) {
+	fs := &FirecrackerService{
+		stockRuntimeClient: handlerRuntime{},
+		vmConfigs:          make(map[string]*VMConfig),
+	}
+	fs.insertVMConfig("pod", &VMConfig{guestIP: "10.0.0.2", guestPort: "8080"})
+
+	_, err := fs.RemovePodSandbox(context.Background(), &criapi.RemovePodSandboxRequest{PodSandboxId: "pod"})
+	require.NoError(t, err)
+
+	_, err = fs.getVMConfig("pod")
+	require.Error(t, err)
+}
+
+func newGuestConfig(envs map[string]string) *criapi.ContainerConfig {
+	config := &criapi.ContainerConfig{}
+	for k, v := range envs {
+		config.Envs = append(config.Envs, &criapi.KeyValue{Key: k, Value: v})
+	}
+	return config
+}
+
+func TestGetGuestImage(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		envs        map[string]string
+		image       string
+		wantErr     bool
+	}{
+		{
+			name:        "annotation",
+			annotations: map[string]string{guestImageAnnotation: "docker.io/library/fn:v1"},
+			image:       "docker.io/library/fn:v1",
+		},
+		{name: "env fallback", envs: map[string]string{guestImageEnv: "docker.io/library/fn:v2"}, image: "docker.io/library/fn:v2"},
+		{
+			name:        "annotation over env",
+			annotations: map[string]string{guestImageAnnotation: "docker.io/library/fn:v1"},
+			envs:        map[string]string{guestImageEnv: "docker.io/library/fn:v2"},
+			image:       "docker.io/library/fn:v1",
+		},
+		{name: "missing", wantErr: true},
+		{name: "empty annotation", annotations: map[string]string{guestImageAnnotation: ""}, wantErr: true},
+		{name: "empty env", envs: map[string]string{guestImageEnv: ""}, wantErr: true},
+		{name: "invalid reference", annotations: map[string]string{guestImageAnnotation: "Not An Image"}, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			image, err := getGuestImage(tc.annotations, newGuestConfig(tc.envs))
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.image, image)
+		})
+	}
+}
+
+func TestGetGuestPort(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		envs        map[string]string
+		port        string
+		wantErr     bool
+	}{
+		{name: "annotation", annotations: map[string]string{guestPortAnnotation: "8080"}, port: "8080"},
+		{name: "env fallback", envs: map[string]string{guestPortEnv: "50051"}, port: "50051"},
+		{
+			name:        "annotation over env",
+			annotations: map[string]string{guestPortAnnotation: "8080"},
+			envs:        map[string]string{guestPortEnv: "50051"},
+			port:        "8080",
+		},
+		{name: "missing", wantErr: true},
+		{name: "empty", annotations: map[string]string{guestPortAnnotation: ""}, wantErr: true},
+		{name: "not a number", envs: map[string]string{guestPortEnv: "http"}, wantErr: true},
+		{name: "zero", annotations: map[string]string{guestPortAnnotation: "0"}, wantErr: true},
+		{name: "out of range", annotations: map[string]string{guestPortAnnotation: "65536"}, wantErr: true},
+		{name: "negative", annotations: map[string]string{guestPortAnnotation: "-80"}, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			port, err := getGuestPort(tc.annotations, newGuestConfig(tc.envs))
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.port, port)
+		})
+	}
+}
+
+func TestGetGuestEnvs(t *testing.T) {
+	config := &criapi.ContainerConfig{Envs: []*criapi.KeyValue{
+		{Key: "FOO", Value: "foo"},
+		{Key: guestImageEnv, Value: "docker.io/library/fn:v1"},
+		{Key: guestPortEnv, Value: "8080"},
+		{Key: guestIPEnv, Value: "10.0.0.2"},
+		{Key: "BAR", Value: "bar"},
+	}}
+
+	require.Equal(t, []*criapi.KeyValue{
+		{Key: "FOO", Value: "foo"},
+		{Key: "BAR", Value: "bar"},
+	}, getGuestEnvs(config))
+	require.Empty(t, getGuestEnvs(&criapi.ContainerConfig{}))
+}
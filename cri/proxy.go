@@ -55,14 +55,6 @@ func (s *Service) StopPodSandbox(ctx context.Context, r *criapi.StopPodSandboxRe
 	return s.stockRuntimeClient.StopPodSandbox(ctx, r)
 }
 
-// RemovePodSandbox removes the sandbox. If there are any running containers
-// in the sandbox, they must be forcibly terminated and removed.
-func (s *Service) RemovePodSandbox(ctx context.Context, r *criapi.RemovePodSandboxRequest) (*criapi.RemovePodSandboxResponse, error) {
-	log.Debugf("RemovePodSandbox for %q", r.GetPodSandboxId())
-	return s.stockRuntimeClient.RemovePodSandbox(ctx, r)
-
-}
-
 // PortForward prepares a streaming endpoint to forward ports from a PodSandbox.
 func (s *Service) PortForward(ctx context.Context, r *criapi.PortForwardRequest) (*criapi.PortForwardResponse, error) {
 	log.Debugf("Portforward for %q port %v", r.GetPodSandboxId(), r.GetPort())
@@ -76,37 +68,6 @@ func (s *Service) StartContainer(ctx context.Context, r *criapi.StartContainerRe
 
 }
 
-// ListContainers lists all containers by filters.
-func (s *Service) ListContainers(ctx context.Context, r *criapi.ListContainersRequest) (*criapi.ListContainersResponse, error) {
-	log.Tracef("ListContainers with filter %+v", r.GetFilter())
-	return s.stockRuntimeClient.ListContainers(ctx, r)
-}
-
-// ContainerStatus returns status of the container. If the container is not
-// present, returns an error.
-func (s *Service) ContainerStatus(ctx context.Context, r *criapi.ContainerStatusRequest) (*criapi.ContainerStatusResponse, error) {
-	log.Tracef("ContainerStatus for %q", r.GetContainerId())
-	return s.stockRuntimeClient.ContainerStatus(ctx, r)
-}
-
-// StopContainer stops a running container with a grace period (i.e., timeout).
-func (s *Service) StopContainer(ctx context.Context, r *criapi.StopContainerRequest) (*criapi.StopContainerResponse, error) {
-	log.Debugf("StopContainer for %q with timeout %d (s)", r.GetContainerId(), r.GetTimeout())
-	return s.stockRuntimeClient.StopContainer(ctx, r)
-}
-
-// ExecSync runs a command in a container synchronously.
-func (s *Service) ExecSync(ctx context.Context, r *criapi.ExecSyncRequest) (*criapi.ExecSyncResponse, error) {
-	log.Tracef("ExecSync for %q with command %+v and timeout %d (s)", r.GetContainerId(), r.GetCmd(), r.GetTimeout())
-	return s.stockRuntimeClient.ExecSync(ctx, r)
-}
-
-// Exec prepares a streaming endpoint to execute a command in the container.
-func (s *Service) Exec(ctx context.Context, r *criapi.ExecRequest) (*criapi.ExecResponse, error) {
-	log.Tracef("Exec for %v", r)
-	return s.stockRuntimeClient.Exec(ctx, r)
-}
-
 // Attach prepares a streaming endpoint to attach to a running container.
 func (s *Service) Attach(ctx context.Context, r *criapi.AttachRequest) (*criapi.AttachResponse, error) {
 	log.Tracef("Attach for %q with tty %v and stdin %v", r.GetContainerId(), r.GetTty(), r.GetStdin())
@@ -164,12 +125,6 @@ func (s *Service) ListContainerStats(ctx context.Context, r *criapi.ListContaine
 	return s.stockRuntimeClient.ListContainerStats(ctx, r)
 }
 
-// Status returns the status of the runtime.
-func (s *Service) Status(ctx context.Context, r *criapi.StatusRequest) (*criapi.StatusResponse, error) {
-	log.Tracef("Status")
-	return s.stockRuntimeClient.Status(ctx, r)
-}
-
 // Version returns the runtime name, runtime version, and runtime API version.
 func (s *Service) Version(ctx context.Context, r *criapi.VersionRequest) (*criapi.VersionResponse, error) {
 	log.Tracef("Version with client side version %q", r.GetVersion())
@@ -76,11 +76,66 @@ func NewService(serv ServiceInterface) (*Service, error) {
 }
 
 func (s *Service) CreateContainer(ctx context.Context, r *criapi.CreateContainerRequest) (*criapi.CreateContainerResponse, error) {
-	return s.serv.CreateContainer(ctx, r)
+	resp, err := s.serv.CreateContainer(ctx, r)
+	return resp, toStatusErr(err)
+}
+
+// ListContainers lists all containers by filters.
+func (s *Service) ListContainers(ctx context.Context, r *criapi.ListContainersRequest) (*criapi.ListContainersResponse, error) {
+	resp, err := s.serv.ListContainers(ctx, r)
+	return resp, toStatusErr(err)
+}
+
+// ExecSync runs a command in a container synchronously.
+func (s *Service) ExecSync(ctx context.Context, r *criapi.ExecSyncRequest) (*criapi.ExecSyncResponse, error) {
+	resp, err := s.serv.ExecSync(ctx, r)
+	return resp, toStatusErr(err)
+}
+
+// Exec prepares a streaming endpoint to execute a command in the container.
+func (s *Service) Exec(ctx context.Context, r *criapi.ExecRequest) (*criapi.ExecResponse, error) {
+	resp, err := s.serv.Exec(ctx, r)
+	return resp, toStatusErr(err)
+}
+
+// ContainerStatus returns status of the container. If the container is not
+// present, returns an error.
+func (s *Service) ContainerStatus(ctx context.Context, r *criapi.ContainerStatusRequest) (*criapi.ContainerStatusResponse, error) {
+	resp, err := s.serv.ContainerStatus(ctx, r)
+	return resp, toStatusErr(err)
+}
+
+// StopContainer stops a running container with a grace period (i.e., timeout).
+func (s *Service) StopContainer(ctx context.Context, r *criapi.StopContainerRequest) (*criapi.StopContainerResponse, error) {
+	resp, err := s.serv.StopContainer(ctx, r)
+	return resp, toStatusErr(err)
 }
 
 func (s *Service) RemoveContainer(ctx context.Context, r *criapi.RemoveContainerRequest) (*criapi.RemoveContainerResponse, error) {
-	return s.serv.RemoveContainer(ctx, r)
+	resp, err := s.serv.RemoveContainer(ctx, r)
+	return resp, toStatusErr(err)
+}
+
+// RemovePodSandbox removes the sandbox. If there are any running containers
+// in the sandbox, they must be forcibly terminated and removed.
+func (s *Service) RemovePodSandbox(ctx context.Context, r *criapi.RemovePodSandboxRequest) (*criapi.RemovePodSandboxResponse, error) {
+	resp, err := s.serv.RemovePodSandbox(ctx, r)
+	return resp, toStatusErr(err)
+}
+
+func (s *Service) PodSandboxStats(ctx context.Context, r *criapi.PodSandboxStatsRequest) (*criapi.PodSandboxStatsResponse, error) {
+	resp, err := s.serv.PodSandboxStats(ctx, r)
+	return resp, toStatusErr(err)
+}
+
+func (s *Service) ListPodSandboxStats(ctx context.Context, r *criapi.ListPodSandboxStatsRequest) (*criapi.ListPodSandboxStatsResponse, error) {
+	resp, err := s.serv.ListPodSandboxStats(ctx, r)
+	return resp, toStatusErr(err)
+}
+
+func (s *Service) Status(ctx context.Context, r *criapi.StatusRequest) (*criapi.StatusResponse, error) {
+	resp, err := s.serv.Status(ctx, r)
+	return resp, toStatusErr(err)
 }
 
 // Register registers the criapi servers.
@@ -8,7 +8,7 @@ import (
 
 // (Key, Value) pair is mapped to a 'Key=Value' entry.
 func ToStringArray(envVariables []*criapi.KeyValue) []string {
-	result := make([]string, len(envVariables))
+	result := make([]string, 0, len(envVariables))
 
 	for _, kv := range envVariables {
 		env := fmt.Sprintf("%s=%s", kv.GetKey(), kv.GetValue())
@@ -0,0 +1,59 @@
+// MIT License
+//
+// Copyright (c) 2020 Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ctriface
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/pkg/errors"
+
+	"github.com/Kingdo777/puffer/misc"
+)
+
+const (
+	containerdBackend = "containerd"
+	fcBackend         = "firecracker-containerd"
+)
+
+// wrapBackendErr Classifies an error returned by containerd or firecracker-containerd
+// as a timeout or an unavailable backend, other errors are returned unchanged
+func wrapBackendErr(backend string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	switch converted := errdefs.FromGRPC(err); {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(converted, context.DeadlineExceeded):
+		return &misc.TimeoutErr{Op: backend, Err: err}
+	case errdefs.IsUnavailable(converted):
+		return &misc.BackendUnavailableErr{Backend: backend, Err: err}
+	}
+
+	return err
+}
+
+// isNotFound Returns whether containerd or firecracker-containerd reported a missing object
+func isNotFound(err error) bool {
+	return errdefs.IsNotFound(err) || errdefs.IsNotFound(errdefs.FromGRPC(err))
+}
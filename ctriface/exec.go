@@ -0,0 +1,147 @@
+// MIT License
+//
+// Copyright (c) 2020 Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ctriface
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Kingdo777/puffer/misc"
+)
+
+// TerminalSize Size of the terminal of a process executed in a VM
+type TerminalSize struct {
+	Width  uint16
+	Height uint16
+}
+
+// ExecOptions Streams and terminal of a process executed in a VM, nil streams are not attached
+type ExecOptions struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	TTY    bool
+	// Resize Sizes the terminal of a TTY process is resized to, until the channel is closed
+	Resize <-chan TerminalSize
+}
+
+// ExecInVM Runs a command next to the function in the guest of a running VM, with the
+// process spec of the function, and returns its exit code. The process is killed if
+// the context ends before it exits
+func (o *Orchestrator) ExecInVM(ctx context.Context, vmID string, cmd []string, opts ExecOptions) (uint32, error) {
+	logger := log.WithFields(log.Fields{"vmID": vmID, "cmd": cmd})
+	logger.Debug("Orchestrator received Exec")
+
+	vm, err := o.vmPool.GetVM(vmID)
+	if err != nil {
+		return 0, err
+	}
+	if state := vm.GetState(); state != misc.VMRunning {
+		return 0, errors.Errorf("VM %s is %s, not running", vmID, state)
+	}
+
+	ctx = namespaces.WithNamespace(ctx, namespaceName)
+	// The process outlives a cancelled request until it is killed and deleted
+	bgCtx := namespaces.WithNamespace(context.Background(), namespaceName)
+
+	spec, err := (*vm.Container).Spec(ctx)
+	if err != nil {
+		return 0, errors.Wrap(wrapBackendErr(containerdBackend, err), "failed to get the spec of the container")
+	}
+	pspec := *spec.Process
+	pspec.Args = cmd
+	pspec.Terminal = opts.TTY
+
+	cioOpts := []cio.Opt{cio.WithStreams(opts.Stdin, opts.Stdout, opts.Stderr)}
+	if opts.TTY {
+		cioOpts = append(cioOpts, cio.WithTerminal)
+	}
+
+	execID := fmt.Sprintf("exec-%d", atomic.AddUint64(&o.nextExecID, 1))
+	process, err := (*vm.Task).Exec(ctx, execID, &pspec, cio.NewCreator(cioOpts...))
+	if err != nil {
+		return 0, errors.Wrap(wrapBackendErr(containerdBackend, err), "failed to create the exec process")
+	}
+	defer func() {
+		if _, err := process.Delete(bgCtx, containerd.WithProcessKill); err != nil && !isNotFound(err) {
+			logger.WithError(err).Warn("failed to delete the exec process")
+		}
+	}()
+
+	statusC, err := process.Wait(bgCtx)
+	if err != nil {
+		return 0, errors.Wrap(wrapBackendErr(containerdBackend, err), "failed to wait for the exec process")
+	}
+
+	if err := process.Start(ctx); err != nil {
+		return 0, errors.Wrap(wrapBackendErr(containerdBackend, err), "failed to start the exec process")
+	}
+
+	if opts.TTY && opts.Resize != nil {
+		done := make(chan struct{})
+		defer close(done)
+
+		go func() {
+			for {
+				select {
+				case size, ok := <-opts.Resize:
+					if !ok {
+						return
+					}
+					if err := process.Resize(bgCtx, uint32(size.Width), uint32(size.Height)); err != nil {
+						logger.WithError(err).Debug("failed to resize the terminal of the exec process")
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	select {
+	case status := <-statusC:
+		// The output is copied until the streams of the process are drained
+		process.IO().Wait()
+
+		code, _, err := status.Result()
+		if err != nil {
+			return 0, wrapBackendErr(containerdBackend, err)
+		}
+		return code, nil
+	case <-ctx.Done():
+		if err := process.Kill(bgCtx, syscall.SIGKILL); err != nil && !isNotFound(err) {
+			logger.WithError(err).Warn("failed to kill the exec process")
+		}
+		<-statusC
+		return 0, wrapBackendErr(containerdBackend, ctx.Err())
+	}
+}
@@ -0,0 +1,204 @@
+// MIT License
+//
+// Copyright (c) 2020 Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ctriface
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Kingdo777/puffer/misc"
+)
+
+const (
+	defaultMaxRestarts = 3
+	// restartBackoff Delay before the first restart of a VM, doubled on every further restart
+	restartBackoff = time.Second
+	restartTimeout = 2 * time.Minute
+)
+
+// VMStatus Lifecycle facts of a VM
+type VMStatus struct {
+	VMID  string
+	State misc.VMState
+	// GuestIP Address of the guest, empty while the VM is offloaded
+	GuestIP string
+	// StartedAt When the VM last entered the running state, zero if it never did
+	StartedAt time.Time
+	// Restored Whether the VM was restored from its snapshot at least once
+	Restored bool
+	// Restarts Number of times the VM was recovered after its task failed
+	Restarts int
+	// LastExit Last exit of a task of the VM, nil if none has exited
+	LastExit *misc.TaskExit
+	// StoppedAt When the VM was stopped or offloaded, zero while it is neither
+	StoppedAt time.Time
+}
+
+// GetVMStatus Returns the lifecycle facts of a VM
+func (o *Orchestrator) GetVMStatus(vmID string) (*VMStatus, error) {
+	vm, err := o.vmPool.GetVM(vmID)
+	if err != nil {
+		return nil, err
+	}
+
+	return getVMStatus(vm), nil
+}
+
+// getVMStatus Returns the lifecycle facts of a VM, which may not be in the pool anymore
+func getVMStatus(vm *misc.VM) *VMStatus {
+	times := vm.GetStateTimes()
+	_, restored := times[misc.VMRestoring]
+
+	status := &VMStatus{
+		VMID:      vm.ID,
+		State:     vm.GetState(),
+		StartedAt: times[misc.VMRunning],
+		Restored:  restored,
+		Restarts:  vm.GetRestarts(),
+		LastExit:  vm.GetLastExit(),
+	}
+	if vm.Ni != nil && status.State != misc.VMOffloaded && status.State != misc.VMStopped {
+		status.GuestIP = vm.Ni.GetExternalAddress()
+	}
+	if status.State == misc.VMOffloaded || status.State == misc.VMStopped {
+		status.StoppedAt = times[status.State]
+	}
+
+	return status
+}
+
+// watchTask Waits for the exit of the task of a VM in the background, for as long as the task lives
+func (o *Orchestrator) watchTask(vm *misc.VM) error {
+	ch, err := (*vm.Task).Wait(namespaces.WithNamespace(context.Background(), namespaceName))
+	if err != nil {
+		return wrapBackendErr(containerdBackend, err)
+	}
+
+	vm.WatchTask(ch, o.handleTaskExit)
+
+	return nil
+}
+
+// handleTaskExit Marks a VM whose task exited while it was running as failed and
+// applies its restart policy. Exits of VMs being stopped or offloaded are expected
+func (o *Orchestrator) handleTaskExit(vm *misc.VM, exit misc.TaskExit) {
+	logger := log.WithFields(log.Fields{"vmID": vm.ID, "exitCode": exit.Code})
+
+	if _, err := vm.Transition(misc.VMFailed); err != nil {
+		return
+	}
+	logger.Warn("Task of the VM exited unexpectedly")
+
+	policy := vm.RestartPolicy
+	if policy == "" {
+		policy = o.restartPolicy
+	}
+	if policy == misc.RestartNever {
+		return
+	}
+
+	restarts := vm.GetRestarts()
+	if restarts >= o.maxRestarts {
+		logger.Errorf("VM was restarted %d times, leaving it failed", restarts)
+		return
+	}
+
+	time.Sleep(restartBackoff << restarts)
+	vm.AddRestart()
+
+	ctx, cancel := context.WithTimeout(context.Background(), restartTimeout)
+	defer cancel()
+
+	var err error
+	// A restored VM gets a new address with identity remapping, which its container does not know
+	if policy == misc.RestartFromSnapshot && vm.HasSnapshot() && !o.vmPool.GetIdentityRemapping() {
+		err = o.replaceFromSnapshot(ctx, vm.ID)
+	} else {
+		err = o.restartTask(ctx, vm)
+	}
+	if err != nil {
+		logger.WithError(err).Error("Failed to recover VM, leaving it failed")
+		return
+	}
+
+	logger.Infof("Recovered VM with the %s policy", policy)
+}
+
+// restartTask Replaces the exited task of a failed VM with a new one in the same VM
+func (o *Orchestrator) restartTask(ctx context.Context, vm *misc.VM) error {
+	ctx = namespaces.WithNamespace(ctx, namespaceName)
+
+	if _, err := (*vm.Task).Delete(ctx); err != nil && !isNotFound(err) {
+		return errors.Wrap(wrapBackendErr(containerdBackend, err), "failed to delete the exited task")
+	}
+
+	iologger := NewWorkloadIoWriter(vm.ID)
+	o.workloadIo.Store(vm.ID, &iologger)
+	task, err := (*vm.Container).NewTask(ctx, cio.NewCreator(cio.WithStreams(os.Stdin, iologger, iologger)))
+	if err != nil {
+		return errors.Wrap(wrapBackendErr(containerdBackend, err), "failed to create a task")
+	}
+	vm.Task = &task
+
+	if err := o.watchTask(vm); err != nil {
+		if _, err := task.Delete(ctx); err != nil {
+			log.WithField("vmID", vm.ID).WithError(err).Error("failed to delete task after failure")
+		}
+		return errors.Wrap(err, "failed to wait for the task")
+	}
+
+	// The VM may have been stopped while its task was being replaced
+	if _, err := vm.Transition(misc.VMRunning); err != nil {
+		if _, err := task.Delete(ctx, containerd.WithProcessKill); err != nil {
+			log.WithField("vmID", vm.ID).WithError(err).Error("failed to delete task after failure")
+		}
+		return err
+	}
+
+	if err := task.Start(ctx); err != nil {
+		_, _ = vm.Transition(misc.VMFailed)
+		return errors.Wrap(wrapBackendErr(containerdBackend, err), "failed to start the task")
+	}
+
+	return nil
+}
+
+// replaceFromSnapshot Replaces a failed VM with one restored from its snapshot
+func (o *Orchestrator) replaceFromSnapshot(ctx context.Context, vmID string) error {
+	if err := o.Offload(ctx, vmID); err != nil {
+		return errors.Wrap(err, "failed to offload the failed VM")
+	}
+
+	if _, _, err := o.StartVMFromSnapshot(ctx, vmID); err != nil {
+		return errors.Wrap(err, "failed to restore the VM")
+	}
+
+	return nil
+}
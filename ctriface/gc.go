@@ -0,0 +1,281 @@
+// MIT License
+//
+// Copyright (c) 2020 Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ctriface
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Kingdo777/puffer/misc"
+)
+
+// Kinds of resources removed by the garbage collector
+const (
+	GCKindVM       = "vm"
+	GCKindTap      = "tap"
+	GCKindSnapshot = "snapshot"
+)
+
+// AuditEntry Record of a resource removed by the garbage collector
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"`
+	// ID VM ID, or tap name for taps without a VM
+	ID          string    `json:"id"`
+	Reason      string    `json:"reason"`
+	OrphanSince time.Time `json:"orphanSince"`
+	// Error Why the removal failed, the resource is retried after another grace period
+	Error string `json:"error,omitempty"`
+}
+
+// orphan Resource without an owner found by a collection
+type orphan struct {
+	kind   string
+	id     string
+	reason string
+	// untracked Whether the orphan is a tap the tap manager has no record of, named by id
+	untracked bool
+}
+
+func (o orphan) key() string {
+	if o.untracked {
+		return o.kind + "/untracked/" + o.id
+	}
+	return o.kind + "/" + o.id
+}
+
+// collector State of the garbage collector
+type collector struct {
+	sync.Mutex
+	interval  time.Duration
+	grace     time.Duration
+	auditPath string
+	// owner Returns whether a VM is owned by a CRI container, VMs are not collected if unset
+	owner    func(vmID string) bool
+	since    map[string]time.Time
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// SetVMOwnerCheck Sets how the garbage collector finds out whether a CRI container owns a VM
+func (o *Orchestrator) SetVMOwnerCheck(owner func(vmID string) bool) {
+	o.gc.Lock()
+	defer o.gc.Unlock()
+
+	o.gc.owner = owner
+}
+
+// findOrphans Returns the VMs without a CRI container, the taps without a VM and the
+// snapshot directories without a VM. VMs with an operation in flight are skipped
+func (o *Orchestrator) findOrphans() []orphan {
+	var orphans []orphan
+
+	o.gc.Lock()
+	owner := o.gc.owner
+	o.gc.Unlock()
+
+	if owner != nil {
+		for vmID, vm := range o.vmPool.GetVMMap() {
+			switch vm.GetState() {
+			case misc.VMRunning, misc.VMPaused, misc.VMSnapshotted, misc.VMFailed, misc.VMOffloaded:
+			default:
+				continue
+			}
+			if !o.journal.busy(vmID) && !owner(vmID) {
+				orphans = append(orphans, orphan{kind: GCKindVM, id: vmID, reason: "no CRI container owns the VM"})
+			}
+		}
+	}
+
+	for _, vmID := range o.vmPool.ListTapVMs() {
+		if !o.journal.busy(vmID) && !o.vmPool.HasVM(vmID) {
+			orphans = append(orphans, orphan{kind: GCKindTap, id: vmID, reason: "the VM of the tap is not in the pool"})
+		}
+	}
+
+	if unknown, err := o.vmPool.ListUnknownTaps(); err == nil {
+		for _, tapName := range unknown {
+			orphans = append(orphans, orphan{kind: GCKindTap, id: tapName, reason: "the tap has no record", untracked: true})
+		}
+	} else {
+		log.WithError(err).Warn("GC: failed to list taps")
+	}
+
+	if entries, err := os.ReadDir(o.snapshotsDir); err == nil {
+		for _, entry := range entries {
+			vmID := entry.Name()
+			if entry.IsDir() && !o.journal.busy(vmID) && !o.vmPool.HasVM(vmID) {
+				orphans = append(orphans, orphan{kind: GCKindSnapshot, id: vmID, reason: "the snapshot directory has no VM"})
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		log.WithError(err).Warn("GC: failed to list snapshot directories")
+	}
+
+	return orphans
+}
+
+// CollectGarbage Removes the resources that have had no owner for the grace period
+// and returns the audit entries of the removals
+func (o *Orchestrator) CollectGarbage(ctx context.Context) []AuditEntry {
+	now := time.Now()
+	orphans := o.findOrphans()
+
+	// Resources are removed once every collection over the grace period found them orphaned
+	var due []orphan
+	o.gc.Lock()
+	found := make(map[string]time.Time, len(orphans))
+	for _, orph := range orphans {
+		since, ok := o.gc.since[orph.key()]
+		if !ok {
+			since = now
+		}
+		found[orph.key()] = since
+
+		if now.Sub(since) >= o.gc.grace {
+			due = append(due, orph)
+		}
+	}
+	o.gc.since = found
+	o.gc.Unlock()
+
+	sort.Slice(due, func(i, j int) bool { return due[i].key() < due[j].key() })
+
+	var entries []AuditEntry
+	for _, orph := range due {
+		entry := AuditEntry{Time: time.Now(), Kind: orph.kind, ID: orph.id, Reason: orph.reason, OrphanSince: found[orph.key()]}
+
+		if err := o.removeOrphan(ctx, orph); err != nil {
+			entry.Error = err.Error()
+		}
+
+		o.gc.Lock()
+		delete(o.gc.since, orph.key())
+		o.gc.Unlock()
+
+		entries = append(entries, entry)
+	}
+
+	o.writeAudit(entries)
+
+	return entries
+}
+
+// removeOrphan Removes a resource after checking that it is still orphaned
+func (o *Orchestrator) removeOrphan(ctx context.Context, orph orphan) error {
+	switch orph.kind {
+	case GCKindVM:
+		o.gc.Lock()
+		owner := o.gc.owner
+		o.gc.Unlock()
+
+		if o.journal.busy(orph.id) || owner(orph.id) {
+			return nil
+		}
+		return o.StopSingleVM(ctx, orph.id)
+	case GCKindTap:
+		if orph.untracked {
+			return o.vmPool.RemoveUnknownTap(orph.id)
+		}
+		if o.journal.busy(orph.id) || o.vmPool.HasVM(orph.id) {
+			return nil
+		}
+		return o.vmPool.RemoveStaleNetwork(orph.id, "")
+	case GCKindSnapshot:
+		if o.journal.busy(orph.id) || o.vmPool.HasVM(orph.id) {
+			return nil
+		}
+		return os.RemoveAll(o.getVMBaseDir(orph.id))
+	}
+
+	return nil
+}
+
+// writeAudit Logs the audit entries and appends them to the audit log
+func (o *Orchestrator) writeAudit(entries []AuditEntry) {
+	if len(entries) == 0 {
+		return
+	}
+
+	for _, entry := range entries {
+		logger := log.WithFields(log.Fields{"kind": entry.Kind, "id": entry.ID, "orphanSince": entry.OrphanSince})
+		if entry.Error != "" {
+			logger.Errorf("GC: failed to remove orphan, %s: %s", entry.Reason, entry.Error)
+		} else {
+			logger.Infof("GC: removed orphan, %s", entry.Reason)
+		}
+	}
+
+	if o.gc.auditPath == "" {
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(o.gc.auditPath), 0755); err != nil {
+		log.WithError(err).Error("GC: failed to create audit log directory")
+		return
+	}
+
+	f, err := os.OpenFile(o.gc.auditPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log.WithError(err).Error("GC: failed to open audit log")
+		return
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	for _, entry := range entries {
+		if err := enc.Encode(entry); err != nil {
+			log.WithError(err).Error("GC: failed to write audit log")
+			return
+		}
+	}
+}
+
+// runGC Collects garbage periodically until Cleanup
+func (o *Orchestrator) runGC() {
+	ticker := time.NewTicker(o.gc.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-o.gc.stop:
+			return
+		case <-ticker.C:
+			o.CollectGarbage(context.Background())
+		}
+	}
+}
+
+// stopGC Stops the periodic garbage collection
+func (o *Orchestrator) stopGC() {
+	o.gc.stopOnce.Do(func() {
+		close(o.gc.stop)
+	})
+}
@@ -0,0 +1,92 @@
+// MIT License
+//
+// # Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ctriface
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Kingdo777/puffer/misc"
+	"github.com/Kingdo777/puffer/taps"
+)
+
+func TestCollectGarbageAfterGracePeriod(t *testing.T) {
+	dir := t.TempDir()
+	auditPath := filepath.Join(dir, "gc-audit.log")
+
+	o := &Orchestrator{
+		snapshotsDir: filepath.Join(dir, "snapshots"),
+		journal:      &journal{vms: make(map[string]int)},
+		vmPool: misc.NewVMPool(
+			misc.WithTapManagerOptions(taps.WithBackend(taps.NewSimBackend()), taps.WithTapNamesFile("")),
+		),
+	}
+	o.gc.grace = 100 * time.Millisecond
+	o.gc.auditPath = auditPath
+
+	_, err := o.vmPool.Allocate("live", "")
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(o.getVMBaseDir("live"), 0777))
+	require.NoError(t, os.MkdirAll(o.getVMBaseDir("stale"), 0777))
+	require.NoError(t, os.MkdirAll(o.getVMBaseDir("transient"), 0777))
+
+	require.Empty(t, o.CollectGarbage(context.Background()), "Orphans are removed before the grace period")
+
+	// An orphan that is gone from a collection starts a new grace period if it comes back
+	require.NoError(t, os.RemoveAll(o.getVMBaseDir("transient")))
+	time.Sleep(o.gc.grace)
+
+	entries := o.CollectGarbage(context.Background())
+	require.Len(t, entries, 1)
+	require.Equal(t, GCKindSnapshot, entries[0].Kind)
+	require.Equal(t, "stale", entries[0].ID)
+	require.Empty(t, entries[0].Error)
+
+	require.NoDirExists(t, o.getVMBaseDir("stale"))
+	require.DirExists(t, o.getVMBaseDir("live"))
+
+	require.NoError(t, os.MkdirAll(o.getVMBaseDir("transient"), 0777))
+	require.Empty(t, o.CollectGarbage(context.Background()))
+	require.DirExists(t, o.getVMBaseDir("transient"))
+
+	f, err := os.Open(auditPath)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var audited []AuditEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry AuditEntry
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		audited = append(audited, entry)
+	}
+	require.Len(t, audited, 1)
+	require.Equal(t, "stale", audited[0].ID)
+}
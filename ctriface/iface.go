@@ -49,6 +49,7 @@ import (
 
 	"github.com/Kingdo777/puffer/metrics"
 	"github.com/Kingdo777/puffer/misc"
+	"github.com/Kingdo777/puffer/taps"
 )
 
 // StartVMResponse is the response returned by StartVM
@@ -56,9 +57,14 @@ import (
 type StartVMResponse struct {
 	// GuestIP is the IP of the guest MicroVM
 	GuestIP string
+	// GuestIPv6 is the IPv6 address of the guest MicroVM, empty unless dual-stack
+	GuestIPv6 string
 }
 
 const (
+	// guestIface Name of the network interface inside the guest
+	guestIface = "eth0"
+
 	testImageName = "docker.io/library/nginx:1.17-alpine"
 	//testImageName = "registry.cn-hangzhou.aliyuncs.com/kingdo_puffer/function-helloworld-python:latest"
 )
@@ -68,7 +74,8 @@ func (o *Orchestrator) StartVM(ctx context.Context, vmID, imageName string) (_ *
 	return o.StartVMWithEnvironment(ctx, vmID, imageName, []string{})
 }
 
-func (o *Orchestrator) StartVMWithEnvironment(ctx context.Context, vmID, imageName string, environmentVariables []string) (_ *StartVMResponse, _ *metrics.Metric, retErr error) {
+// StartVMWithEnvironment Boots a VM with the given environment, opts configure the VM before it is allocated
+func (o *Orchestrator) StartVMWithEnvironment(ctx context.Context, vmID, imageName string, environmentVariables []string, opts ...misc.VMOption) (_ *StartVMResponse, _ *metrics.Metric, retErr error) {
 	var (
 		startVMMetric *metrics.Metric = metrics.NewMetric()
 		tStart        time.Time
@@ -77,11 +84,27 @@ func (o *Orchestrator) StartVMWithEnvironment(ctx context.Context, vmID, imageNa
 	logger := log.WithFields(log.Fields{"vmID": vmID, "image": imageName})
 	logger.Debug("StartVM: Received StartVM")
 
-	vm, err := o.vmPool.Allocate(vmID, o.hostIface)
+	jop, err := o.journal.begin(journalStart, vmID, "")
+	if err != nil {
+		logger.WithError(err).Error("failed to journal the start of the VM")
+		return nil, nil, err
+	}
+	defer jop.end()
+
+	tStart = time.Now()
+	vm, err := o.vmPool.Allocate(vmID, o.hostIface, opts...)
 	if err != nil {
 		logger.Error("failed to allocate VM in VM pool")
 		return nil, nil, err
 	}
+	jop.network(vm.PodNetNSPath)
+	startVMMetric.MetricMap[metrics.AllocateTap] = metrics.ToUS(time.Since(tStart))
+	if o.tapPoolEnabled && vm.PodNetNSPath == "" {
+		startVMMetric.Counters[metrics.TapPoolHit] = 0
+		if vm.TapPoolHit {
+			startVMMetric.Counters[metrics.TapPoolHit] = 1
+		}
+	}
 
 	defer func() {
 		// Free the VM from the pool if function returns error
@@ -101,11 +124,12 @@ func (o *Orchestrator) StartVMWithEnvironment(ctx context.Context, vmID, imageNa
 
 	tStart = time.Now()
 	createVMRequest := o.getVMCreateRequest(vm)
+	jop.step(stepVM)
 	_, err = o.fcClient.CreateVM(ctx, createVMRequest)
 
 	startVMMetric.MetricMap[metrics.FcCreateVM] = metrics.ToUS(time.Since(tStart))
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to create the microVM in firecracker-containerd")
+		return nil, nil, errors.Wrap(wrapBackendErr(fcBackend, err), "failed to create the microVM in firecracker-containerd")
 	}
 
 	defer func() {
@@ -118,6 +142,7 @@ func (o *Orchestrator) StartVMWithEnvironment(ctx context.Context, vmID, imageNa
 
 	logger.Debug("StartVM: Creating a new container")
 	tStart = time.Now()
+	jop.step(stepContainer)
 	container, err := o.client.NewContainer(
 		ctx,
 		vmID,
@@ -128,13 +153,15 @@ func (o *Orchestrator) StartVMWithEnvironment(ctx context.Context, vmID, imageNa
 			firecrackeroci.WithVMID(vmID),
 			firecrackeroci.WithVMNetwork,
 			oci.WithEnv(environmentVariables),
+			withGuestIPv6(vm.Ni),
 		),
 		containerd.WithRuntime("aws.firecracker", nil),
+		containerd.WithContainerLabels(resourceLabels(vm)),
 	)
 	startVMMetric.MetricMap[metrics.NewContainer] = metrics.ToUS(time.Since(tStart))
 	vm.Container = &container
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to create a container")
+		return nil, nil, errors.Wrap(wrapBackendErr(containerdBackend, err), "failed to create a container")
 	}
 
 	defer func() {
@@ -149,11 +176,12 @@ func (o *Orchestrator) StartVMWithEnvironment(ctx context.Context, vmID, imageNa
 	o.workloadIo.Store(vmID, &iologger)
 	logger.Debug("StartVM: Creating a new task")
 	tStart = time.Now()
+	jop.step(stepTask)
 	task, err := container.NewTask(ctx, cio.NewCreator(cio.WithStreams(os.Stdin, iologger, iologger)))
 	startVMMetric.MetricMap[metrics.NewTask] = metrics.ToUS(time.Since(tStart))
 	vm.Task = &task
 	if err != nil {
-		return nil, nil, errors.Wrapf(err, "failed to create a task")
+		return nil, nil, errors.Wrap(wrapBackendErr(containerdBackend, err), "failed to create a task")
 	}
 
 	defer func() {
@@ -166,9 +194,8 @@ func (o *Orchestrator) StartVMWithEnvironment(ctx context.Context, vmID, imageNa
 
 	logger.Debug("StartVM: Waiting for the task to get ready")
 	tStart = time.Now()
-	ch, err := task.Wait(ctx)
+	err = o.watchTask(vm)
 	startVMMetric.MetricMap[metrics.TaskWait] = metrics.ToUS(time.Since(tStart))
-	vm.TaskCh = ch
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "failed to wait for a task")
 	}
@@ -201,65 +228,195 @@ func (o *Orchestrator) StartVMWithEnvironment(ctx context.Context, vmID, imageNa
 		return nil, nil, err
 	}
 
+	tStart = time.Now()
+	err = o.waitGuestReady(ctx, vm)
+	startVMMetric.MetricMap[metrics.GuestReady] = metrics.ToUS(time.Since(tStart))
+	if err != nil {
+		logger.WithError(err).Error("Guest did not get ready")
+		return nil, nil, err
+	}
+
+	if _, err := vm.Transition(misc.VMRunning); err != nil {
+		return nil, nil, err
+	}
+
 	logger.Debug("Successfully started a VM")
 
-	return &StartVMResponse{GuestIP: vm.Ni.PrimaryAddress}, startVMMetric, nil
+	return &StartVMResponse{GuestIP: vm.Ni.GetExternalAddress(), GuestIPv6: vm.Ni.PrimaryAddressV6}, startVMMetric, nil
 }
 
-// StopSingleVM Shuts down a VM
-// Note: VMs are not quisced before being stopped
+// StopSingleVM Shuts down a VM, giving its task the default grace period to exit
 func (o *Orchestrator) StopSingleVM(ctx context.Context, vmID string) error {
+	return o.StopSingleVMWithGrace(ctx, vmID, o.stopGracePeriod)
+}
+
+// StopSingleVMWithGrace Shuts down a VM, sending SIGTERM to its task and SIGKILL once the
+// grace period runs out. A zero grace period kills the task right away
+func (o *Orchestrator) StopSingleVMWithGrace(ctx context.Context, vmID string, grace time.Duration) error {
+	_, err := o.StopVMWithStatus(ctx, vmID, grace)
+	return err
+}
+
+// StopVMWithStatus Shuts down a VM like StopSingleVMWithGrace and returns its final status,
+// including the exit of its task, as the VM is gone from the pool afterwards
+func (o *Orchestrator) StopVMWithStatus(ctx context.Context, vmID string, grace time.Duration) (*VMStatus, error) {
 	logger := log.WithFields(log.Fields{"vmID": vmID})
 	logger.Debug("Orchestrator received StopVM")
 
 	ctx = namespaces.WithNamespace(ctx, namespaceName)
 	vm, err := o.vmPool.GetVM(vmID)
 	if err != nil {
-		if _, ok := err.(*misc.NonExistErr); ok {
-			logger.Panic("StopVM: VM does not exist")
-		}
-		logger.Panic("StopVM: GetVM() failed for an unknown reason")
+		logger.WithError(err).Error("StopVM: failed to get VM")
+		return nil, err
+	}
 
+	jop, err := o.journal.begin(journalStop, vmID, vm.PodNetNSPath)
+	if err != nil {
+		logger.WithError(err).Error("StopVM: failed to journal the stop of the VM")
+		return nil, err
 	}
+	defer jop.end()
 
-	logger = log.WithFields(log.Fields{"vmID": vmID})
+	prevState, err := vm.Transition(misc.VMStopping)
+	if err != nil {
+		logger.WithError(err).Error("StopVM: VM cannot be stopped")
+		return nil, err
+	}
 
-	task := *vm.Task
-	if err := task.Kill(ctx, syscall.SIGKILL); err != nil {
-		logger.WithError(err).Error("Failed to kill the task")
+	// failStop Leaves a VM whose stop failed in a state it can be stopped from again, a VM
+	// whose task is gone cannot go back to running and is failed instead
+	failStop := func(err error, taskGone bool) error {
+		if taskGone && prevState != misc.VMOffloaded {
+			vm.Rollback(misc.VMFailed)
+		} else {
+			vm.Rollback(prevState)
+		}
 		return err
 	}
 
-	<-vm.TaskCh
-	//FIXME: Seems like some tasks need some extra time to die Issue#15, lr_training
-	time.Sleep(500 * time.Millisecond)
+	// An offloaded VM has no task or firecracker VM left, only its container
+	if prevState != misc.VMOffloaded {
+		// A paused guest cannot handle SIGTERM
+		if prevState != misc.VMRunning {
+			grace = 0
+		}
 
-	if _, err := task.Delete(ctx); err != nil {
-		logger.WithError(err).Error("failed to delete task")
-		return err
+		task := *vm.Task
+		if prevState == misc.VMFailed {
+			err = waitTaskExit(ctx, task, nil)
+		} else {
+			err = o.killTask(ctx, vm, grace)
+		}
+		if err != nil {
+			logger.WithError(err).Error("Failed to kill the task")
+			return nil, failStop(err, prevState == misc.VMFailed)
+		}
+
+		// A failed stop is retried on a task that may already be deleted
+		if _, err := task.Delete(ctx); err != nil && !isNotFound(err) {
+			logger.WithError(err).Error("failed to delete task")
+			return nil, failStop(wrapBackendErr(containerdBackend, err), true)
+		}
 	}
 
 	container := *vm.Container
-	if err := container.Delete(ctx, containerd.WithSnapshotCleanup); err != nil {
+	if err := container.Delete(ctx, containerd.WithSnapshotCleanup); err != nil && !isNotFound(err) {
 		logger.WithError(err).Error("failed to delete container")
-		return err
+		return nil, failStop(wrapBackendErr(containerdBackend, err), true)
 	}
 
-	if _, err := o.fcClient.StopVM(ctx, &proto.StopVMRequest{VMID: vmID}); err != nil {
-		logger.WithError(err).Error("failed to stop firecracker-containerd VM")
-		return err
+	if prevState != misc.VMOffloaded {
+		if _, err := o.fcClient.StopVM(ctx, &proto.StopVMRequest{VMID: vmID}); err != nil && !isNotFound(err) {
+			logger.WithError(err).Error("failed to stop firecracker-containerd VM")
+			return nil, failStop(wrapBackendErr(fcBackend, err), true)
+		}
+	}
+
+	if _, err := vm.Transition(misc.VMStopped); err != nil {
+		return nil, err
+	}
+	status := getVMStatus(vm)
+
+	// The directory is created at start whether or not the VM is snapshotted
+	if err := os.RemoveAll(o.getVMBaseDir(vmID)); err != nil {
+		logger.WithError(err).Warn("failed to delete the snapshot directory of the VM")
 	}
 
 	if err := o.vmPool.Free(vmID); err != nil {
 		logger.Error("failed to free VM from VM pool")
-		return err
+		return nil, err
 	}
 
 	o.workloadIo.Delete(vmID)
 
 	logger.Debug("Stopped VM successfully")
 
-	return nil
+	return status, nil
+}
+
+// killTask Sends SIGTERM to the task of a VM and SIGKILL if it has not exited within
+// the grace period, then waits until containerd reports the task stopped
+func (o *Orchestrator) killTask(ctx context.Context, vm *misc.VM, grace time.Duration) error {
+	logger := log.WithFields(log.Fields{"vmID": vm.ID})
+	task := *vm.Task
+	done := vm.TaskDone()
+
+	if grace > 0 {
+		if err := task.Kill(ctx, syscall.SIGTERM); err != nil {
+			return wrapBackendErr(containerdBackend, err)
+		}
+
+		graceCtx, cancel := context.WithTimeout(ctx, grace)
+		err := waitTaskExit(graceCtx, task, done)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		logger.Warnf("Task did not exit within the grace period of %s, killing it", grace)
+	}
+
+	if err := task.Kill(ctx, syscall.SIGKILL); err != nil {
+		return wrapBackendErr(containerdBackend, err)
+	}
+
+	return waitTaskExit(ctx, task, done)
+}
+
+// waitTaskExit Waits for the exit channel of a task, if any, then polls the status of the
+// task until it is stopped, as the exit is reported before containerd lets it be deleted
+func waitTaskExit(ctx context.Context, task containerd.Task, done <-chan struct{}) error {
+	if done != nil {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return wrapBackendErr(containerdBackend, ctx.Err())
+		}
+	}
+
+	ticker := time.NewTicker(taskStatusPollInterval)
+	defer ticker.Stop()
+
+	for {
+		status, err := task.Status(ctx)
+		if err != nil {
+			if isNotFound(err) {
+				return nil
+			}
+			return wrapBackendErr(containerdBackend, err)
+		}
+		if status.Status == containerd.Stopped {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return wrapBackendErr(containerdBackend, ctx.Err())
+		}
+	}
 }
 
 // Checks whether a URL has a .local domain
@@ -351,15 +508,19 @@ func getK8sDNS() []string {
 }
 
 func (o *Orchestrator) getVMCreateRequest(vm *misc.VM) *proto.CreateVMRequest {
-	kernelArgs := "ro noapic reboot=k panic=1 pci=off nomodules systemd.log_color=false systemd.unit=firecracker.target init=/sbin/overlay-init tsc=reliable quiet 8250.nr_uarts=0 ipv6.disable=1"
+	kernelArgs := "ro noapic reboot=k panic=1 pci=off nomodules systemd.log_color=false systemd.unit=firecracker.target init=/sbin/overlay-init tsc=reliable quiet 8250.nr_uarts=0"
+	// Dual-stack guests get their IPv6 address when the task is created, see withGuestIPv6
+	if vm.Ni.PrimaryAddressV6 == "" {
+		kernelArgs += " ipv6.disable=1"
+	}
 
-	return &proto.CreateVMRequest{
+	req := &proto.CreateVMRequest{
 		VMID:           vm.ID,
 		TimeoutSeconds: 100,
 		KernelArgs:     kernelArgs,
 		MachineCfg: &proto.FirecrackerMachineConfiguration{
-			VcpuCount:  1,
-			MemSizeMib: 256,
+			VcpuCount:  vm.VCPUs,
+			MemSizeMib: vm.MemSizeMib,
 		},
 		NetworkInterfaces: []*proto.FirecrackerNetworkInterface{{
 			StaticConfig: &proto.StaticNetworkConfiguration{
@@ -373,6 +534,55 @@ func (o *Orchestrator) getVMCreateRequest(vm *misc.VM) *proto.CreateVMRequest {
 			},
 		}},
 	}
+
+	if vm.Ni.NetNSPath != "" {
+		req.JailerConfig = &proto.JailerConfig{
+			NetNS: vm.Ni.NetNSPath,
+			UID:   o.jailerUID,
+			GID:   o.jailerGID,
+		}
+	}
+
+	if vm.Limits != nil {
+		netIface := req.NetworkInterfaces[0]
+		netIface.InRateLimiter = getFcRateLimiter(vm.Limits.NetRx)
+		netIface.OutRateLimiter = getFcRateLimiter(vm.Limits.NetTx)
+
+		if vm.Limits.Block != nil {
+			// The root drive has to be given explicitly to attach a rate limiter to it
+			req.RootDrive = &proto.FirecrackerRootDrive{
+				HostPath:    o.rootDrivePath,
+				IsWritable:  false,
+				RateLimiter: getFcRateLimiter(vm.Limits.Block),
+			}
+		}
+	}
+
+	return req
+}
+
+// getFcRateLimiter Converts a rate limiter to its firecracker-containerd representation
+func getFcRateLimiter(rl *misc.RateLimiter) *proto.FirecrackerRateLimiter {
+	if rl == nil {
+		return nil
+	}
+
+	return &proto.FirecrackerRateLimiter{
+		Bandwidth: getFcTokenBucket(rl.Bandwidth),
+		Ops:       getFcTokenBucket(rl.Ops),
+	}
+}
+
+func getFcTokenBucket(tb *misc.TokenBucket) *proto.FirecrackerTokenBucket {
+	if tb == nil {
+		return nil
+	}
+
+	return &proto.FirecrackerTokenBucket{
+		Capacity:     tb.Size,
+		OneTimeBurst: tb.OneTimeBurst,
+		RefillTime:   tb.RefillTimeMs,
+	}
 }
 
 // StopActiveVMs Shuts down all active VMs
@@ -409,9 +619,21 @@ func (o *Orchestrator) PauseVM(ctx context.Context, vmID string) error {
 
 	ctx = namespaces.WithNamespace(ctx, namespaceName)
 
+	vm, err := o.vmPool.GetVM(vmID)
+	if err != nil {
+		return err
+	}
+
+	prevState, err := vm.Transition(misc.VMPaused)
+	if err != nil {
+		logger.WithError(err).Error("VM cannot be paused")
+		return err
+	}
+
 	if _, err := o.fcClient.PauseVM(ctx, &proto.PauseVMRequest{VMID: vmID}); err != nil {
 		logger.WithError(err).Error("failed to pause the VM")
-		return err
+		vm.Rollback(prevState)
+		return wrapBackendErr(fcBackend, err)
 	}
 
 	return nil
@@ -429,10 +651,22 @@ func (o *Orchestrator) ResumeVM(ctx context.Context, vmID string) (*metrics.Metr
 
 	ctx = namespaces.WithNamespace(ctx, namespaceName)
 
+	vm, err := o.vmPool.GetVM(vmID)
+	if err != nil {
+		return nil, err
+	}
+
+	prevState, err := vm.Transition(misc.VMRunning)
+	if err != nil {
+		logger.WithError(err).Error("VM cannot be resumed")
+		return nil, err
+	}
+
 	tStart = time.Now()
 	if _, err := o.fcClient.ResumeVM(ctx, &proto.ResumeVMRequest{VMID: vmID}); err != nil {
 		logger.WithError(err).Error("failed to resume the VM")
-		return nil, err
+		vm.Rollback(prevState)
+		return nil, wrapBackendErr(fcBackend, err)
 	}
 	resumeVMMetric.MetricMap[metrics.FcResume] = metrics.ToUS(time.Since(tStart))
 
@@ -446,6 +680,24 @@ func (o *Orchestrator) CreateSnapshot(ctx context.Context, vmID string) error {
 
 	ctx = namespaces.WithNamespace(ctx, namespaceName)
 
+	vm, err := o.vmPool.GetVM(vmID)
+	if err != nil {
+		return err
+	}
+
+	prevState, err := vm.Transition(misc.VMSnapshotted)
+	if err != nil {
+		logger.WithError(err).Error("VM has to be paused to create a snapshot")
+		return err
+	}
+
+	// The memory file dominates the size of a snapshot
+	if err := o.vmPool.AdmitSnapshot(vmID, uint64(vm.MemSizeMib)<<20); err != nil {
+		logger.WithError(err).Error("no disk capacity for the snapshot of the VM")
+		vm.Rollback(prevState)
+		return err
+	}
+
 	req := &proto.CreateSnapshotRequest{
 		VMID:             vmID,
 		MemFilePath:      o.getMemoryFile(vmID),
@@ -454,6 +706,12 @@ func (o *Orchestrator) CreateSnapshot(ctx context.Context, vmID string) error {
 
 	if _, err := o.fcClient.CreateSnapshot(ctx, req); err != nil {
 		logger.WithError(err).Error("failed to create snapshot of the VM")
+		_ = o.vmPool.SetSnapshotSize(vmID, 0)
+		vm.Rollback(prevState)
+		return wrapBackendErr(fcBackend, err)
+	}
+
+	if err := o.vmPool.SetSnapshotSize(vmID, o.getSnapshotSize(vmID)); err != nil {
 		return err
 	}
 
@@ -468,25 +726,65 @@ func (o *Orchestrator) Offload(ctx context.Context, vmID string) error {
 
 	vm, err := o.vmPool.GetVM(vmID)
 	if err != nil {
-		var nonExistErr *misc.NonExistErr
-		if errors.As(err, &nonExistErr) {
-			logger.Panic("Offload: VM does not exist")
-		}
-		logger.Panic("Offload: GetVM() failed for an unknown reason")
+		logger.WithError(err).Error("Offload: failed to get VM")
+		return err
+	}
+
+	if !vm.HasSnapshot() {
+		err := &misc.InvalidTransitionErr{VMID: vmID, From: vm.GetState(), To: misc.VMOffloading}
+		logger.WithError(err).Error("VM without a snapshot cannot be offloaded")
+		return err
+	}
+
+	jop, err := o.journal.begin(journalOffload, vmID, vm.PodNetNSPath)
+	if err != nil {
+		logger.WithError(err).Error("failed to journal the offload of the VM")
+		return err
+	}
+	defer jop.end()
+
+	prevState, err := vm.Transition(misc.VMOffloading)
+	if err != nil {
+		logger.WithError(err).Error("VM cannot be offloaded")
+		return err
+	}
 
+	if err := o.vmPool.RemovePortMappings(vmID); err != nil {
+		logger.WithError(err).Error("failed to remove published ports")
+		vm.Rollback(prevState)
+		return err
 	}
 
 	if _, err := o.fcClient.StopVM(ctx, &proto.StopVMRequest{VMID: vm.ID}); err != nil {
 		logger.WithError(err).Error("failed to stop the VM")
+		vm.Rollback(prevState)
+		return wrapBackendErr(fcBackend, err)
+	}
+
+	// The firecracker VM is gone, so a VM whose resources cannot be released is left
+	// offloaded rather than offloading, from where it can still be stopped and freed
+	if err := o.vmPool.ReleaseCompute(vmID); err != nil {
+		vm.Rollback(misc.VMOffloaded)
 		return err
 	}
 
-	if err := o.vmPool.RecreateTap(vmID, o.hostIface); err != nil {
+	// With identity remapping the snapshot is restored onto a fresh address,
+	// so the address of the VM is freed while it is offloaded
+	if o.vmPool.GetIdentityRemapping() {
+		if err := o.vmPool.ReleaseNetwork(vmID); err != nil {
+			logger.Error("Failed to release network upon offloading")
+			vm.Rollback(misc.VMOffloaded)
+			return err
+		}
+	} else if err := o.vmPool.RecreateTap(vmID, o.hostIface); err != nil {
 		logger.Error("Failed to recreate tap upon offloading")
+		vm.Rollback(misc.VMOffloaded)
 		return err
 	}
 
-	return nil
+	_, err = vm.Transition(misc.VMOffloaded)
+
+	return err
 }
 
 func (o *Orchestrator) StartVMFromSnapshot(ctx context.Context, vmID string) (_ *StartVMResponse, _ *metrics.Metric, retErr error) {
@@ -509,15 +807,57 @@ func (o *Orchestrator) StartVMFromSnapshot(ctx context.Context, vmID string) (_
 
 	vm, err := o.vmPool.GetVM(vmID)
 	if err != nil {
-		if _, ok := err.(*misc.NonExistErr); ok {
-			logger.Panic("StartVM: VM does not exist")
-		}
-		logger.Panic("StartVM: GetVM() failed for an unknown reason")
+		logger.WithError(err).Error("StartVM: failed to get VM")
+		return nil, nil, err
+	}
 
+	jop, err := o.journal.begin(journalRestore, vmID, vm.PodNetNSPath)
+	if err != nil {
+		logger.WithError(err).Error("failed to journal the restore of the VM")
+		return nil, nil, err
 	}
+	defer jop.end()
+
+	if _, err := vm.Transition(misc.VMRestoring); err != nil {
+		logger.WithError(err).Error("VM cannot be restored")
+		return nil, nil, err
+	}
+
+	defer func() {
+		if retErr != nil {
+			vm.Rollback(misc.VMOffloaded)
+		}
+	}()
 
 	ctx = namespaces.WithNamespace(ctx, namespaceName)
 
+	if err := o.vmPool.AdmitRestore(vmID); err != nil {
+		logger.WithError(err).Error("no capacity to restore the VM")
+		return nil, nil, err
+	}
+
+	defer func() {
+		if retErr != nil {
+			if err := o.vmPool.ReleaseCompute(vmID); err != nil {
+				logger.WithError(err).Errorf("failed to release VM resources after failure")
+			}
+		}
+	}()
+
+	if o.vmPool.GetIdentityRemapping() {
+		if err := o.vmPool.RestoreNetwork(vmID, o.hostIface); err != nil {
+			return nil, nil, errors.Wrap(err, "failed to restore the network of the VM")
+		}
+
+		defer func() {
+			if retErr != nil {
+				if err := o.vmPool.ReleaseNetwork(vmID); err != nil {
+					logger.WithError(err).Errorf("failed to release network after failure")
+				}
+			}
+		}()
+	}
+
 	createVMRequest := o.getVMCreateRequest(vm)
 	createVMRequest.SnapshotCfg = &proto.FirecrackerSnapshotConfiguration{
 		MemFilePath:         memoryFile,
@@ -530,7 +870,7 @@ func (o *Orchestrator) StartVMFromSnapshot(ctx context.Context, vmID string) (_
 	_, err = o.fcClient.CreateVM(ctx, createVMRequest)
 	startVMMetric.MetricMap[metrics.FcCreateVM] = metrics.ToUS(time.Since(tStart))
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to create the microVM in firecracker-containerd")
+		return nil, nil, errors.Wrap(wrapBackendErr(fcBackend, err), "failed to create the microVM in firecracker-containerd")
 	}
 
 	defer func() {
@@ -541,7 +881,80 @@ func (o *Orchestrator) StartVMFromSnapshot(ctx context.Context, vmID string) (_
 		}
 	}()
 
+	// A VM kept offloaded by the recovery of a previous run has no task object yet
+	if vm.Task == nil {
+		task, err := (*vm.Container).Task(ctx, nil)
+		if err != nil {
+			return nil, nil, errors.Wrap(wrapBackendErr(containerdBackend, err), "failed to load the task of the restored VM")
+		}
+		vm.Task = &task
+	}
+
+	// The exit of the task before the offload was recorded when its VM was stopped
+	if err := o.watchTask(vm); err != nil {
+		logger.WithError(err).Warn("failed to watch the task of the restored VM")
+	}
+
+	tStart = time.Now()
+	err = o.waitGuestReady(ctx, vm)
+	startVMMetric.MetricMap[metrics.GuestReady] = metrics.ToUS(time.Since(tStart))
+	if err != nil {
+		logger.WithError(err).Error("Restored guest did not get ready")
+		return nil, nil, err
+	}
+
+	if _, err := vm.Transition(misc.VMRunning); err != nil {
+		return nil, nil, err
+	}
+
 	logger.Debug("Successfully started a VM from snapshot")
 
-	return &StartVMResponse{GuestIP: vm.Ni.PrimaryAddress}, startVMMetric, nil
+	return &StartVMResponse{GuestIP: vm.Ni.GetExternalAddress(), GuestIPv6: vm.Ni.PrimaryAddressV6}, startVMMetric, nil
+}
+
+// PublishPort Publishes a guest port of a running VM on a host port,
+// the mapping is removed when the VM is stopped or offloaded
+func (o *Orchestrator) PublishPort(vmID string, m taps.PortMapping) error {
+	logger := log.WithFields(log.Fields{"vmID": vmID, "hostPort": m.HostPort, "guestPort": m.GuestPort})
+	logger.Debug("Orchestrator received PublishPort")
+
+	if err := o.vmPool.AddPortMapping(vmID, m); err != nil {
+		logger.WithError(err).Error("failed to publish port")
+		return err
+	}
+
+	return nil
+}
+
+// UnpublishPorts Removes all published ports of a VM
+func (o *Orchestrator) UnpublishPorts(vmID string) error {
+	logger := log.WithFields(log.Fields{"vmID": vmID})
+	logger.Debug("Orchestrator received UnpublishPorts")
+
+	if err := o.vmPool.RemovePortMappings(vmID); err != nil {
+		logger.WithError(err).Error("failed to remove published ports")
+		return err
+	}
+
+	return nil
+}
+
+// GetPublishedPorts Returns the published ports of a VM
+func (o *Orchestrator) GetPublishedPorts(vmID string) ([]taps.PortMapping, error) {
+	return o.vmPool.GetPortMappings(vmID)
+}
+
+// GetNetStats Returns the traffic counters of the VM, accumulated across offloads
+func (o *Orchestrator) GetNetStats(vmID string) (taps.LinkStats, error) {
+	return o.vmPool.GetNetStats(vmID)
+}
+
+// SetVMLabels Replaces the labels of a VM, e.g. when an idle VM is loaded for another pod
+func (o *Orchestrator) SetVMLabels(vmID string, labels map[string]string) error {
+	return o.vmPool.SetLabels(vmID, labels)
+}
+
+// QueryVMs Returns the VMs matching the query
+func (o *Orchestrator) QueryVMs(q misc.VMQuery) []*misc.VM {
+	return o.vmPool.Query(q)
 }
@@ -0,0 +1,67 @@
+// MIT License
+//
+// Copyright (c) 2020 Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ctriface
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/oci"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+
+	"github.com/Kingdo777/puffer/taps"
+)
+
+// guestIPPath Path of the ip tool in the root filesystem of the VM, not of the function image
+const guestIPPath = "/sbin/ip"
+
+// withGuestIPv6 Assigns the IPv6 address and default route of a dual-stack guest, as the
+// IPConfiguration of firecracker-containerd only carries IPv4. The commands are createRuntime
+// hooks, which runc runs in the VM with the tools of its root filesystem before the function
+// starts, in the network namespace the function shares with the VM. A failed command fails
+// the creation of the task, so a dual-stack VM does not start without its IPv6 address
+func withGuestIPv6(ni *taps.NetworkInterface) oci.SpecOpts {
+	return func(_ context.Context, _ oci.Client, _ *containers.Container, s *oci.Spec) error {
+		if ni.PrimaryAddressV6 == "" {
+			return nil
+		}
+
+		if s.Hooks == nil {
+			s.Hooks = &specs.Hooks{}
+		}
+		for _, args := range getGuestIPv6Cmds(ni) {
+			s.Hooks.CreateRuntime = append(s.Hooks.CreateRuntime, specs.Hook{Path: guestIPPath, Args: args})
+		}
+
+		return nil
+	}
+}
+
+// getGuestIPv6Cmds Returns the commands configuring the IPv6 address and default route of
+// the guest. Both replace what is there, as they run again whenever the task is recreated
+func getGuestIPv6Cmds(ni *taps.NetworkInterface) [][]string {
+	return [][]string{
+		{"ip", "-6", "addr", "replace", ni.PrimaryAddressV6 + ni.SubnetV6, "dev", guestIface, "nodad"},
+		{"ip", "-6", "route", "replace", "default", "via", ni.GatewayAddressV6, "dev", guestIface},
+	}
+}
@@ -0,0 +1,75 @@
+// MIT License
+//
+// # Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ctriface
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/oci"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Kingdo777/puffer/misc"
+	"github.com/Kingdo777/puffer/taps"
+)
+
+func TestDualStackCreateVMRequest(t *testing.T) {
+	o := &Orchestrator{}
+
+	vm := misc.NewVM("1")
+	vm.Ni = &taps.NetworkInterface{
+		MacAddress:       "02:FC:00:00:00:00",
+		HostDevName:      "pfrt0",
+		PrimaryAddress:   "190.128.0.2",
+		Subnet:           taps.Subnet,
+		GatewayAddress:   "190.128.0.1",
+		PrimaryAddressV6: "fd00:fc:0:0::2",
+		SubnetV6:         taps.SubnetV6,
+		GatewayAddressV6: "fd00:fc:0:0::1",
+	}
+
+	req := o.getVMCreateRequest(vm)
+	require.NotContains(t, req.KernelArgs, "ipv6.disable=1", "IPv6 must stay enabled in dual-stack guests")
+
+	ipConfig := req.NetworkInterfaces[0].StaticConfig.IPConfig
+	require.Equal(t, "190.128.0.2"+taps.Subnet, ipConfig.PrimaryAddr)
+	require.Equal(t, "190.128.0.1", ipConfig.GatewayAddr)
+
+	// The VM rather than the function image configures the IPv6 address, before the function starts
+	spec := &oci.Spec{}
+	require.NoError(t, withGuestIPv6(vm.Ni)(context.Background(), nil, nil, spec))
+	require.Equal(t, []specs.Hook{
+		{Path: guestIPPath, Args: []string{"ip", "-6", "addr", "replace", "fd00:fc:0:0::2/64", "dev", guestIface, "nodad"}},
+		{Path: guestIPPath, Args: []string{"ip", "-6", "route", "replace", "default", "via", "fd00:fc:0:0::1", "dev", guestIface}},
+	}, spec.Hooks.CreateRuntime)
+
+	vm.Ni.PrimaryAddressV6 = ""
+	req = o.getVMCreateRequest(vm)
+	require.True(t, strings.HasSuffix(req.KernelArgs, " ipv6.disable=1"), "IPv6 must be disabled in IPv4-only guests")
+
+	spec = &oci.Spec{}
+	require.NoError(t, withGuestIPv6(vm.Ni)(context.Background(), nil, nil, spec))
+	require.Nil(t, spec.Hooks, "IPv4-only guests must not get IPv6 hooks")
+}
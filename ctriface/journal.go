@@ -0,0 +1,475 @@
+// MIT License
+//
+// Copyright (c) 2020 Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ctriface
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Kingdo777/puffer/misc"
+)
+
+// defaultJournalPath File of the lifecycle operation journal
+const defaultJournalPath = "/var/lib/puffer/journal"
+
+// journalOp Lifecycle operation recorded in the journal
+type journalOp string
+
+const (
+	journalStart   journalOp = "start"
+	journalStop    journalOp = "stop"
+	journalOffload journalOp = "offload"
+	journalRestore journalOp = "restore"
+)
+
+// journalStep Progress of an operation, a step is recorded before it is taken
+type journalStep string
+
+const (
+	stepBegin     journalStep = "begin"
+	stepNetwork   journalStep = "network"
+	stepVM        journalStep = "vm"
+	stepContainer journalStep = "container"
+	stepTask      journalStep = "task"
+	stepEnd       journalStep = "end"
+)
+
+// journalRecord Line of the journal
+type journalRecord struct {
+	ID       uint64      `json:"id"`
+	Op       journalOp   `json:"op,omitempty"`
+	VMID     string      `json:"vmID,omitempty"`
+	Step     journalStep `json:"step"`
+	PodNetNS string      `json:"podNetNS,omitempty"`
+	Time     time.Time   `json:"time"`
+}
+
+// journal Write-ahead log of in-flight lifecycle operations. Every record is synced
+// before the step it announces is taken, so that operations interrupted by a crash
+// can be found and completed on startup. The file is truncated whenever no operation
+// is in flight. Without a file, only the VMs with operations in flight are tracked
+type journal struct {
+	sync.Mutex
+	file     *os.File
+	nextID   uint64
+	inFlight int
+	// vms Number of operations in flight by VM
+	vms map[string]int
+}
+
+// journalEntry Operation in flight, a nil entry records nothing
+type journalEntry struct {
+	j    *journal
+	id   uint64
+	op   journalOp
+	vmID string
+}
+
+// interruptedOp Operation of a previous run that did not end
+type interruptedOp struct {
+	op       journalOp
+	vmID     string
+	podNetNS string
+	steps    map[journalStep]bool
+}
+
+// openJournal Opens the journal at path and returns the operations of the previous run
+// that did not end, the journal is not truncated until reset is called
+func openJournal(path string) (*journal, []*interruptedOp, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ops := make(map[uint64]*interruptedOp)
+	var order []uint64
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var rec journalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// A torn last line is the write the crash interrupted
+			log.WithError(err).Warn("Skipping corrupt journal record")
+			continue
+		}
+
+		switch rec.Step {
+		case stepBegin:
+			ops[rec.ID] = &interruptedOp{
+				op:       rec.Op,
+				vmID:     rec.VMID,
+				podNetNS: rec.PodNetNS,
+				steps:    map[journalStep]bool{stepBegin: true},
+			}
+			order = append(order, rec.ID)
+		case stepEnd:
+			delete(ops, rec.ID)
+		default:
+			if op, ok := ops[rec.ID]; ok {
+				op.steps[rec.Step] = true
+				if rec.PodNetNS != "" {
+					op.podNetNS = rec.PodNetNS
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	var interrupted []*interruptedOp
+	for _, id := range order {
+		if op, ok := ops[id]; ok {
+			interrupted = append(interrupted, op)
+		}
+	}
+
+	return &journal{file: file, vms: make(map[string]int)}, interrupted, nil
+}
+
+// reset Truncates the journal and records again the operations that are still pending
+func (j *journal) reset(pending []*interruptedOp) error {
+	j.Lock()
+	defer j.Unlock()
+
+	if j.file == nil {
+		return nil
+	}
+
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+
+	for _, op := range pending {
+		id := j.nextID
+		j.nextID++
+		j.inFlight++
+		// The leftovers of the VM are left to the recovery of the next run
+		j.vms[op.vmID]++
+
+		for _, step := range []journalStep{stepBegin, stepNetwork, stepVM, stepContainer, stepTask} {
+			if !op.steps[step] {
+				continue
+			}
+
+			rec := journalRecord{ID: id, Step: step, PodNetNS: op.podNetNS, Time: time.Now()}
+			if step == stepBegin {
+				rec.Op, rec.VMID = op.op, op.vmID
+			}
+			if err := j.write(rec); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// write Appends a record and syncs it to disk, the lock has to be held
+func (j *journal) write(rec journalRecord) error {
+	if j.file == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	if _, err := j.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	return j.file.Sync()
+}
+
+// begin Records the start of an operation on a VM, podNetNS is the pod network
+// namespace of the VM if known. A nil journal returns a nil entry
+func (j *journal) begin(op journalOp, vmID, podNetNS string) (*journalEntry, error) {
+	if j == nil {
+		return nil, nil
+	}
+
+	j.Lock()
+	defer j.Unlock()
+
+	return j.beginLocked(op, vmID, podNetNS)
+}
+
+// claim Records the start of an operation on a VM like begin, unless an operation on the
+// VM is in flight, in which case nothing is recorded and false is returned
+func (j *journal) claim(op journalOp, vmID string) (*journalEntry, bool, error) {
+	if j == nil {
+		return nil, true, nil
+	}
+
+	j.Lock()
+	defer j.Unlock()
+
+	if j.vms[vmID] > 0 {
+		return nil, false, nil
+	}
+
+	e, err := j.beginLocked(op, vmID, "")
+	return e, err == nil, err
+}
+
+// beginLocked Records the start of an operation, the lock has to be held
+func (j *journal) beginLocked(op journalOp, vmID, podNetNS string) (*journalEntry, error) {
+	e := &journalEntry{j: j, id: j.nextID, op: op, vmID: vmID}
+	rec := journalRecord{ID: e.id, Op: op, VMID: vmID, Step: stepBegin, PodNetNS: podNetNS, Time: time.Now()}
+	if err := j.write(rec); err != nil {
+		return nil, err
+	}
+
+	j.nextID++
+	j.inFlight++
+	j.vms[vmID]++
+
+	return e, nil
+}
+
+// step Records that the operation is about to take a step
+func (e *journalEntry) step(step journalStep) {
+	if e == nil {
+		return
+	}
+	e.record(journalRecord{ID: e.id, Step: step, Time: time.Now()})
+}
+
+// network Records that the network of the VM was set up, in the pod network namespace if any
+func (e *journalEntry) network(podNetNS string) {
+	if e == nil {
+		return
+	}
+	e.record(journalRecord{ID: e.id, Step: stepNetwork, PodNetNS: podNetNS, Time: time.Now()})
+}
+
+func (e *journalEntry) record(rec journalRecord) {
+	e.j.Lock()
+	defer e.j.Unlock()
+
+	if err := e.j.write(rec); err != nil {
+		log.WithError(err).WithFields(log.Fields{"vmID": e.vmID, "op": e.op}).Warnf("Failed to journal step %s", rec.Step)
+	}
+}
+
+// end Records that the operation is over, whether it succeeded or was undone
+func (e *journalEntry) end() {
+	if e == nil {
+		return
+	}
+
+	j := e.j
+	j.Lock()
+	defer j.Unlock()
+
+	j.inFlight--
+	if j.vms[e.vmID]--; j.vms[e.vmID] == 0 {
+		delete(j.vms, e.vmID)
+	}
+
+	if j.file == nil {
+		return
+	}
+
+	if j.inFlight == 0 {
+		// Nothing is in flight, so the journal holds no information
+		if err := j.file.Truncate(0); err == nil {
+			return
+		}
+	}
+
+	if err := j.write(journalRecord{ID: e.id, Step: stepEnd, Time: time.Now()}); err != nil {
+		log.WithError(err).WithFields(log.Fields{"vmID": e.vmID, "op": e.op}).Warn("Failed to journal the end of the operation")
+	}
+}
+
+// busy Returns whether an operation on the VM is in flight
+func (j *journal) busy(vmID string) bool {
+	if j == nil {
+		return false
+	}
+
+	j.Lock()
+	defer j.Unlock()
+
+	return j.vms[vmID] > 0
+}
+
+// reached Returns whether the interrupted operation may have created the resources
+// of a step. Only starts are journaled step by step, the VMs of the other operations
+// had all of their resources already
+func (op *interruptedOp) reached(step journalStep) bool {
+	if op.op != journalStart {
+		return true
+	}
+	return op.steps[step]
+}
+
+// recoverInterrupted Completes the operations interrupted by a crash of the previous run.
+// Offloads and restores of a VM whose snapshot is complete end with the VM offloaded, as
+// its snapshot outlives the crash. Starts are rolled back and stops are rolled forward to
+// a stopped VM, as are offloads and restores of VMs that cannot be kept offloaded.
+// Operations that fail to recover are kept in the journal for the next run
+func (o *Orchestrator) recoverInterrupted(ops []*interruptedOp) []*interruptedOp {
+	var pending []*interruptedOp
+
+	for _, op := range ops {
+		logger := log.WithFields(log.Fields{"vmID": op.vmID, "op": op.op})
+		logger.Info("Recovering interrupted operation")
+
+		if (op.op == journalOffload || op.op == journalRestore) && o.hasSnapshot(op.vmID) {
+			err := o.keepOffloaded(op)
+			if err == nil {
+				continue
+			}
+			// The snapshot is only removed with a VM that cannot be restored from it
+			if !errors.Is(err, errNotRestorable) {
+				logger.WithError(err).Error("Failed to keep the VM offloaded")
+				pending = append(pending, op)
+				continue
+			}
+			logger.WithError(err).Warn("VM cannot be kept offloaded, removing it")
+		}
+
+		if err := o.removeStaleVM(op); err != nil {
+			logger.WithError(err).Error("Failed to recover interrupted operation")
+			pending = append(pending, op)
+		}
+	}
+
+	return pending
+}
+
+// errNotRestorable The VM of an interrupted operation cannot be restored from its snapshot
+var errNotRestorable = errors.New("VM cannot be restored")
+
+// hasSnapshot Returns whether both files of the snapshot of a VM were written
+func (o *Orchestrator) hasSnapshot(vmID string) bool {
+	for _, path := range []string{o.getMemoryFile(vmID), o.getSnapshotFile(vmID)} {
+		if info, err := os.Stat(path); err != nil || info.Size() == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// keepOffloaded Stops the VM an interrupted offload or restore left running and adopts
+// the VM as offloaded, so that it can be restored from its snapshot. The VM keeps its container
+// and snapshot, but not its I/O rate limits. VMs in a pod network namespace cannot be kept
+func (o *Orchestrator) keepOffloaded(op *interruptedOp) error {
+	if op.podNetNS != "" {
+		return errors.Wrap(errNotRestorable, "VM in a pod network namespace")
+	}
+
+	ctx := namespaces.WithNamespace(context.Background(), namespaceName)
+
+	container, err := o.client.LoadContainer(ctx, op.vmID)
+	if isNotFound(err) {
+		return errors.Wrap(errNotRestorable, "container is gone")
+	} else if err != nil {
+		return errors.Wrap(wrapBackendErr(containerdBackend, err), "failed to load container")
+	}
+
+	labels, err := container.Labels(ctx)
+	if err != nil {
+		return errors.Wrap(wrapBackendErr(containerdBackend, err), "failed to get container labels")
+	}
+	vcpus, memSizeMib, err := parseResourceLabels(labels)
+	if err != nil {
+		return errors.Wrap(errNotRestorable, err.Error())
+	}
+
+	// Like Offload, only the firecracker VM is stopped, the task is resumed from the snapshot
+	if _, err := o.fcClient.StopVM(ctx, &proto.StopVMRequest{VMID: op.vmID}); err != nil && !isNotFound(err) {
+		return errors.Wrap(wrapBackendErr(fcBackend, err), "failed to stop firecracker-containerd VM")
+	}
+
+	var snapshotBytes uint64
+	for _, path := range []string{o.getMemoryFile(op.vmID), o.getSnapshotFile(op.vmID)} {
+		if info, err := os.Stat(path); err == nil {
+			snapshotBytes += uint64(info.Size())
+		}
+	}
+
+	_, err = o.vmPool.AdoptOffloaded(op.vmID, container, snapshotBytes, misc.WithResources(vcpus, memSizeMib))
+	return err
+}
+
+// removeStaleVM Removes whatever the interrupted operation may have left of its VM
+func (o *Orchestrator) removeStaleVM(op *interruptedOp) error {
+	ctx := namespaces.WithNamespace(context.Background(), namespaceName)
+
+	if op.reached(stepContainer) {
+		container, err := o.client.LoadContainer(ctx, op.vmID)
+		switch {
+		case err == nil:
+			if op.reached(stepTask) {
+				if task, err := container.Task(ctx, nil); err == nil {
+					if _, err := task.Delete(ctx, containerd.WithProcessKill); err != nil && !isNotFound(err) {
+						return errors.Wrap(err, "failed to delete task")
+					}
+				} else if !isNotFound(err) {
+					return errors.Wrap(err, "failed to load task")
+				}
+			}
+
+			if err := container.Delete(ctx, containerd.WithSnapshotCleanup); err != nil && !isNotFound(err) {
+				return errors.Wrap(err, "failed to delete container")
+			}
+		case !isNotFound(err):
+			return errors.Wrap(err, "failed to load container")
+		}
+	}
+
+	if op.reached(stepVM) {
+		if _, err := o.fcClient.StopVM(ctx, &proto.StopVMRequest{VMID: op.vmID}); err != nil && !isNotFound(err) {
+			return errors.Wrap(wrapBackendErr(fcBackend, err), "failed to stop firecracker-containerd VM")
+		}
+	}
+
+	// Taps are persisted by VM, so a tap created right before the crash is found as well
+	if err := o.vmPool.RemoveStaleNetwork(op.vmID, op.podNetNS); err != nil {
+		return errors.Wrap(err, "failed to remove network")
+	}
+
+	return os.RemoveAll(o.getVMBaseDir(op.vmID))
+}
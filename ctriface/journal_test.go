@@ -0,0 +1,152 @@
+// MIT License
+//
+// # Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ctriface
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJournalInterruptedOps(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+
+	j, interrupted, err := openJournal(path)
+	require.NoError(t, err, "Failed to open journal")
+	require.Empty(t, interrupted)
+	require.NoError(t, j.reset(nil))
+
+	done, err := j.begin(journalStart, "1", "")
+	require.NoError(t, err)
+	done.network("")
+	done.step(stepVM)
+
+	crashed, err := j.begin(journalStart, "2", "")
+	require.NoError(t, err)
+	crashed.network("/var/run/netns/pod")
+	crashed.step(stepVM)
+
+	_, err = j.begin(journalStop, "3", "")
+	require.NoError(t, err)
+
+	done.end()
+
+	// Simulate a crash that tore the last record
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"id":2,"step":"en`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	j, interrupted, err = openJournal(path)
+	require.NoError(t, err, "Failed to reopen journal")
+	require.Len(t, interrupted, 2)
+
+	require.Equal(t, journalStart, interrupted[0].op)
+	require.Equal(t, "2", interrupted[0].vmID)
+	require.Equal(t, "/var/run/netns/pod", interrupted[0].podNetNS)
+	require.True(t, interrupted[0].reached(stepVM))
+	require.False(t, interrupted[0].reached(stepContainer))
+
+	require.Equal(t, journalStop, interrupted[1].op)
+	require.True(t, interrupted[1].reached(stepTask), "A stop may find all resources of the VM")
+
+	// Only the operation that failed to recover is kept
+	require.NoError(t, j.reset(interrupted[:1]))
+
+	_, interrupted, err = openJournal(path)
+	require.NoError(t, err)
+	require.Len(t, interrupted, 1)
+	require.Equal(t, "2", interrupted[0].vmID)
+	require.Equal(t, "/var/run/netns/pod", interrupted[0].podNetNS)
+	require.True(t, interrupted[0].reached(stepVM))
+}
+
+func TestJournalTruncatesWhenIdle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+
+	j, _, err := openJournal(path)
+	require.NoError(t, err)
+	require.NoError(t, j.reset(nil))
+
+	e, err := j.begin(journalOffload, "1", "")
+	require.NoError(t, err)
+	e.end()
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Zero(t, info.Size(), "Journal is not truncated with nothing in flight")
+
+	var nilJournal *journal
+	e, err = nilJournal.begin(journalStart, "1", "")
+	require.NoError(t, err)
+	require.Nil(t, e)
+	e.step(stepVM)
+	e.end()
+}
+
+func TestJournalClaim(t *testing.T) {
+	j := &journal{vms: make(map[string]int)}
+
+	stop, err := j.begin(journalStop, "1", "")
+	require.NoError(t, err)
+
+	_, claimed, err := j.claim(journalStop, "1")
+	require.NoError(t, err)
+	require.False(t, claimed, "VM with a stop in flight was claimed")
+
+	stop.end()
+
+	removal, claimed, err := j.claim(journalStop, "1")
+	require.NoError(t, err)
+	require.True(t, claimed, "Idle VM could not be claimed")
+	require.True(t, j.busy("1"), "Claimed VM is not busy")
+
+	removal.end()
+	require.False(t, j.busy("1"))
+}
+
+func TestHasCompleteSnapshot(t *testing.T) {
+	o := newStopOrchestrator(t)
+
+	require.False(t, o.hasSnapshot("1"))
+
+	require.NoError(t, os.MkdirAll(o.getVMBaseDir("1"), 0777))
+	require.NoError(t, os.WriteFile(o.getMemoryFile("1"), []byte("mem"), 0644))
+	require.NoError(t, os.WriteFile(o.getSnapshotFile("1"), nil, 0644))
+	require.False(t, o.hasSnapshot("1"), "Snapshot with an empty file is complete")
+
+	require.NoError(t, os.WriteFile(o.getSnapshotFile("1"), []byte("snap"), 0644))
+	require.True(t, o.hasSnapshot("1"), "Complete snapshot was not found")
+}
+
+func TestPendingOpsKeepVMBusy(t *testing.T) {
+	j, _, err := openJournal(filepath.Join(t.TempDir(), "journal"))
+	require.NoError(t, err, "Failed to open journal")
+
+	require.NoError(t, j.reset([]*interruptedOp{{op: journalRestore, vmID: "1", steps: map[journalStep]bool{stepBegin: true}}}))
+	require.True(t, j.busy("1"), "Leftovers of a VM whose recovery failed are not protected")
+	require.False(t, j.busy("2"))
+}
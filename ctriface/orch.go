@@ -23,6 +23,7 @@
 package ctriface
 
 import (
+	"context"
 	log "github.com/sirupsen/logrus"
 	"os"
 	"os/signal"
@@ -30,17 +31,22 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/containerd/containerd"
 	fcclient "github.com/firecracker-microvm/firecracker-containerd/firecracker-control/client"
 
 	"github.com/Kingdo777/puffer/misc"
+	"github.com/Kingdo777/puffer/taps"
 )
 
 const (
 	containerdAddress      = "/run/firecracker-containerd/containerd.sock"
 	containerdTTRPCAddress = containerdAddress + ".ttrpc"
 	namespaceName          = "firecracker-containerd"
+	defaultRootDrivePath   = "/var/lib/firecracker-containerd/runtime/default-rootfs.img"
+	defaultStopGracePeriod = 5 * time.Second
+	taskStatusPollInterval = 10 * time.Millisecond
 )
 
 type WorkloadIoWriter struct {
@@ -73,6 +79,26 @@ type Orchestrator struct {
 	snapshotsDir     string
 	isMetricsMode    bool
 	hostIface        string
+	rootDrivePath    string
+	tapOpts          []taps.TapManagerOption
+	cniManager       *taps.CNIManager
+	jailerUID        uint32
+	jailerGID        uint32
+	tapPoolEnabled   bool
+	tapPoolLow       int
+	tapPoolHigh      int
+	capacity         misc.Capacity
+	admissionPolicy  misc.AdmissionPolicy
+	admissionTimeout time.Duration
+	journalPath      string
+	journal          *journal
+	reconciler       reconciler
+	adoptVMs         bool
+	gc               collector
+	stopGracePeriod  time.Duration
+	restartPolicy    misc.RestartPolicy
+	maxRestarts      int
+	nextExecID       uint64
 }
 
 // NewOrchestrator Initializes a new orchestrator
@@ -80,16 +106,37 @@ func NewOrchestrator(snapshotter, hostIface string, opts ...OrchestratorOption)
 	var err error
 
 	o := new(Orchestrator)
-	o.vmPool = misc.NewVMPool()
 	o.cachedImages = make(map[string]containerd.Image)
 	o.snapshotter = snapshotter
 	o.snapshotsDir = "/var/lib/puffer/snapshots"
 	o.hostIface = hostIface
+	o.rootDrivePath = defaultRootDrivePath
+	o.admissionPolicy = misc.AdmissionReject
+	o.stopGracePeriod = defaultStopGracePeriod
+	o.restartPolicy = misc.RestartNever
+	o.maxRestarts = defaultMaxRestarts
+	o.journalPath = defaultJournalPath
+	o.reconciler.interval = defaultReconcileInterval
+	o.reconciler.stop = make(chan struct{})
+	o.gc.stop = make(chan struct{})
 
 	for _, opt := range opts {
 		opt(o)
 	}
 
+	if o.tapPoolEnabled {
+		o.tapOpts = append(o.tapOpts, taps.WithTapPool(o.tapPoolLow, o.tapPoolHigh, o.hostIface))
+	}
+
+	o.vmPool = misc.NewVMPool(
+		misc.WithTapManagerOptions(o.tapOpts...),
+		misc.WithCNIManager(o.cniManager),
+		misc.WithCapacity(o.capacity, o.admissionPolicy, o.admissionTimeout),
+		misc.WithEvictor(func(vmID string) error {
+			return o.StopSingleVM(context.Background(), vmID)
+		}),
+	)
+
 	if _, err := os.Stat(o.snapshotsDir); err != nil {
 		if !os.IsNotExist(err) {
 			log.Panicf("Snapshot dir %s exists", o.snapshotsDir)
@@ -113,6 +160,27 @@ func NewOrchestrator(snapshotter, hostIface string, opts ...OrchestratorOption)
 		log.Fatal("Failed to start firecracker client", err)
 	}
 	log.Info("Created firecracker client")
+
+	if o.journalPath != "" {
+		o.openJournal()
+	} else {
+		o.journal = &journal{vms: make(map[string]int)}
+	}
+
+	if o.adoptVMs && o.gc.interval == 0 {
+		log.Warn("Adopted VMs are not stopped without the collection of orphaned VMs")
+	}
+
+	if _, err := o.Reconcile(context.Background()); err != nil {
+		log.WithError(err).Error("Startup reconciliation failed")
+	}
+	if o.reconciler.interval > 0 {
+		go o.runReconciler()
+	}
+	if o.gc.interval > 0 {
+		go o.runGC()
+	}
+
 	return o
 }
 
@@ -130,6 +198,8 @@ func (o *Orchestrator) setupCloseHandler() {
 
 // Cleanup Removes the bridges created by the VM pool's tap manager
 func (o *Orchestrator) Cleanup() {
+	o.stopReconciler()
+	o.stopGC()
 	o.vmPool.RemoveBridges()
 	if err := os.RemoveAll(o.snapshotsDir); err != nil {
 		log.Panic("failed to delete snapshots dir", err)
@@ -141,6 +211,58 @@ func (o *Orchestrator) GetSnapshotsEnabled() bool {
 	return o.snapshotsEnabled
 }
 
+// GetCNIEnabled Returns whether VMs can be networked by CNI in pod network namespaces
+func (o *Orchestrator) GetCNIEnabled() bool {
+	return o.cniManager != nil
+}
+
+// openJournal Opens the journal of lifecycle operations and completes the operations
+// a crash of the previous run interrupted
+func (o *Orchestrator) openJournal() {
+	j, interrupted, err := openJournal(o.journalPath)
+	if err != nil {
+		log.WithError(err).Fatalf("Failed to open journal %s", o.journalPath)
+	}
+
+	if len(interrupted) > 0 {
+		log.Infof("Recovering %d interrupted operations", len(interrupted))
+	}
+
+	if err := j.reset(o.recoverInterrupted(interrupted)); err != nil {
+		log.WithError(err).Fatalf("Failed to reset journal %s", o.journalPath)
+	}
+
+	o.journal = j
+}
+
+// HasVM Returns whether the VM exists, idle VMs may be evicted to make room for others
+func (o *Orchestrator) HasVM(vmID string) bool {
+	return o.vmPool.HasVM(vmID)
+}
+
+// IsVMIDInUse Returns whether a new VM cannot take the ID, because a VM of the pool has it
+// or because the leftovers of a VM with the ID could not be removed
+func (o *Orchestrator) IsVMIDInUse(vmID string) bool {
+	return o.vmPool.HasVM(vmID) || o.isReserved(vmID)
+}
+
+// GetCapacity Returns the node resources committed to VMs and their limits
+func (o *Orchestrator) GetCapacity() (used, limits misc.Capacity) {
+	return o.vmPool.GetCapacity()
+}
+
+// getSnapshotSize Returns the disk used by the snapshot files of a VM
+func (o *Orchestrator) getSnapshotSize(vmID string) uint64 {
+	var size uint64
+	for _, file := range []string{o.getMemoryFile(vmID), o.getSnapshotFile(vmID)} {
+		if info, err := os.Stat(file); err == nil {
+			size += uint64(info.Size())
+		}
+	}
+
+	return size
+}
+
 func (o *Orchestrator) getMemoryFile(funcName string) string {
 	return filepath.Join(o.getVMBaseDir(funcName), "mem_file")
 }
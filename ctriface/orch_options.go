@@ -22,6 +22,15 @@
 
 package ctriface
 
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Kingdo777/puffer/misc"
+	"github.com/Kingdo777/puffer/taps"
+)
+
 // OrchestratorOption Options to pass to Orchestrator
 type OrchestratorOption func(*Orchestrator)
 
@@ -39,3 +48,142 @@ func WithSnapshots(snapshotsEnabled bool) OrchestratorOption {
 		o.snapshotsEnabled = snapshotsEnabled
 	}
 }
+
+// WithRootDrivePath Sets the path of the VM root filesystem image,
+// it has to match the RootDrive of the firecracker-containerd runtime config
+func WithRootDrivePath(rootDrivePath string) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.rootDrivePath = rootDrivePath
+	}
+}
+
+// WithNetNSIsolation Places the tap of every VM in its own network namespace
+// instead of on a shared bridge. Firecracker can only be started in a network
+// namespace by the jailer, so the jailer IDs have to be set as well
+func WithNetNSIsolation(allowGuestToGuest bool) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.tapOpts = append(o.tapOpts, taps.WithNetNSIsolation(allowGuestToGuest))
+	}
+}
+
+// WithIdentityRemapping Frees the address of offloaded VMs and restores snapshots onto
+// fresh addresses, NAT in the network namespace of the tap maps the address of the
+// snapshot to the fresh one. It implies network namespace isolation and the jailer IDs
+func WithIdentityRemapping() OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.tapOpts = append(o.tapOpts, taps.WithIdentityRemapping())
+	}
+}
+
+// WithJailerIDs Sets the non-root user and group the firecracker jailer runs VMs as
+func WithJailerIDs(uid, gid uint32) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.jailerUID = uid
+		o.jailerGID = gid
+	}
+}
+
+// WithCNI Networks VMs that are given a pod network namespace by calling the CNI
+// plugins of confListFile in that namespace. Firecracker is started in the pod
+// network namespace by the jailer, so the jailer IDs have to be set as well
+func WithCNI(confListFile string, binDirs []string) OrchestratorOption {
+	return func(o *Orchestrator) {
+		cniManager, err := taps.NewCNIManager(confListFile, binDirs)
+		if err != nil {
+			log.Fatal("Failed to create CNI manager", err)
+		}
+		o.cniManager = cniManager
+	}
+}
+
+// WithDualStack Gives every VM an IPv6 address next to its IPv4 address, which the VM
+// configures with the ip tool of its root filesystem, see withGuestIPv6
+func WithDualStack() OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.tapOpts = append(o.tapOpts, taps.WithDualStack())
+	}
+}
+
+// WithTapPool Keeps a background pool of ready taps that VMs claim on start,
+// it is refilled up to high taps once no more than low taps are left
+func WithTapPool(low, high int) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.tapPoolEnabled = true
+		o.tapPoolLow = low
+		o.tapPoolHigh = high
+	}
+}
+
+// WithDryRunNetwork Uses the simulated tap backend, which records the taps, bridges and rules
+// of the VMs in memory instead of creating them. Only the tap manager runs without network
+// privileges, the orchestrator still needs firecracker-containerd and its snapshot directory
+func WithDryRunNetwork() OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.tapOpts = append(o.tapOpts, taps.WithBackend(taps.NewSimBackend()), taps.WithTapNamesFile(""))
+	}
+}
+
+// WithCapacity Limits the vCPUs and memory of running and paused VMs and the disk
+// of snapshots on the node, zero limits are unlimited. A VM that does not fit is
+// queued for up to queueTimeout, rejected, or makes room by evicting idle VMs
+func WithCapacity(limits misc.Capacity, policy misc.AdmissionPolicy, queueTimeout time.Duration) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.capacity = limits
+		o.admissionPolicy = policy
+		o.admissionTimeout = queueTimeout
+	}
+}
+
+// WithJournal Sets the file of the journal of in-flight VM lifecycle operations,
+// an empty path disables the journal
+func WithJournal(path string) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.journalPath = path
+	}
+}
+
+// WithReconcileInterval Sets the period of the reconciliation with firecracker-containerd
+// that follows the one at startup, zero only reconciles at startup
+func WithReconcileInterval(interval time.Duration) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.reconciler.interval = interval
+	}
+}
+
+// WithAdoption Adopts the running VMs of a previous run at reconciliation instead of
+// removing them. No coordinator owns an adopted VM, so it is only stopped by the
+// collection of orphaned VMs, see WithGC
+func WithAdoption(adopt bool) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.adoptVMs = adopt
+	}
+}
+
+// WithGC Enables the collection of orphaned VMs, taps and snapshot directories, which is
+// off by default, with its period, how long a resource stays orphaned before removal, and
+// the audit log of the removals. A zero interval disables it, an empty path only logs the
+// removals. Only an orchestrator whose VMs are owned by a coordinator should enable it
+func WithGC(interval, grace time.Duration, auditPath string) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.gc.interval = interval
+		o.gc.grace = grace
+		o.gc.auditPath = auditPath
+	}
+}
+
+// WithStopGracePeriod Sets how long a stopped VM's task has to exit after SIGTERM before
+// it is killed, for stops that do not come with their own grace period
+func WithStopGracePeriod(grace time.Duration) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.stopGracePeriod = grace
+	}
+}
+
+// WithRestartPolicy Sets how VMs whose task fails are recovered, unless a VM has its own
+// policy, and how many times a VM is recovered before it is left failed
+func WithRestartPolicy(policy misc.RestartPolicy, maxRestarts int) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.restartPolicy = policy
+		o.maxRestarts = maxRestarts
+	}
+}
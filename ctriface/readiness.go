@@ -0,0 +1,185 @@
+// MIT License
+//
+// Copyright (c) 2020 Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ctriface
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netns"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"github.com/Kingdo777/puffer/misc"
+)
+
+const (
+	readinessPollInterval = 50 * time.Millisecond
+	// readinessAttemptTimeout Bound of a single probe, so a hung guest does not use up the whole timeout
+	readinessAttemptTimeout = time.Second
+)
+
+// waitGuestReady Probes the function in the guest of a VM until it is ready,
+// the task of the VM exits or the timeout of the probe expires
+func (o *Orchestrator) waitGuestReady(ctx context.Context, vm *misc.VM) error {
+	probe := vm.Readiness
+	if probe == nil || probe.Type == misc.ProbeNone {
+		return nil
+	}
+
+	logger := log.WithFields(log.Fields{"vmID": vm.ID, "probe": probe.Type})
+	logger.Debug("Waiting for the guest to get ready")
+
+	ctx, cancel := context.WithTimeout(ctx, probe.Timeout)
+	defer cancel()
+
+	// An exit channel closed already belongs to a task from before a restore
+	done := vm.TaskDone()
+	select {
+	case <-done:
+		done = nil
+	default:
+	}
+
+	addr := net.JoinHostPort(vm.Ni.GetExternalAddress(), probe.Port)
+	ticker := time.NewTicker(readinessPollInterval)
+	defer ticker.Stop()
+
+	for {
+		attemptCtx, cancelAttempt := context.WithTimeout(ctx, readinessAttemptTimeout)
+		err := probeGuest(attemptCtx, vm.PodNetNSPath, addr, probe)
+		cancelAttempt()
+		if err == nil {
+			return nil
+		}
+		logger.WithError(err).Trace("Guest is not ready")
+
+		select {
+		case <-ticker.C:
+		case <-done:
+			return errors.Errorf("task of VM %s exited before the guest got ready", vm.ID)
+		case <-ctx.Done():
+			return &misc.TimeoutErr{Op: "readiness probe of VM " + vm.ID, Err: err}
+		}
+	}
+}
+
+// probeGuest Runs a single readiness probe against the guest address
+func probeGuest(ctx context.Context, netNSPath, addr string, probe *misc.ReadinessProbe) error {
+	dial := func(ctx context.Context, addr string) (net.Conn, error) {
+		return dialGuest(ctx, netNSPath, addr)
+	}
+
+	switch probe.Type {
+	case misc.ProbeTCP:
+		conn, err := dial(ctx, addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case misc.ProbeHTTP:
+		client := &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+					return dial(ctx, addr)
+				},
+				DisableKeepAlives: true,
+			},
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+probe.Path, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("HTTP probe returned status %d", resp.StatusCode)
+		}
+		return nil
+	case misc.ProbeGRPC:
+		conn, err := grpc.DialContext(ctx, addr, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithContextDialer(dial))
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: probe.Path})
+		if err != nil {
+			return err
+		}
+		if resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+			return fmt.Errorf("gRPC health probe returned %s", resp.GetStatus())
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown readiness probe %q", probe.Type)
+}
+
+// dialGuest Connects to a guest address over TCP, from the pod network namespace if given,
+// as the guests of pods are only reachable there
+func dialGuest(ctx context.Context, netNSPath, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+
+	if netNSPath == "" {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+
+	// The socket keeps the namespace of the thread that creates it
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origin, err := netns.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer origin.Close()
+
+	ns, err := netns.GetFromPath(netNSPath)
+	if err != nil {
+		return nil, err
+	}
+	defer ns.Close()
+
+	if err := netns.Set(ns); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := netns.Set(origin); err != nil {
+			log.Panic("Could not switch back to the root network namespace")
+		}
+	}()
+
+	return dialer.DialContext(ctx, "tcp", addr)
+}
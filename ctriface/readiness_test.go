@@ -0,0 +1,91 @@
+// MIT License
+//
+// # Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ctriface
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Kingdo777/puffer/misc"
+	"github.com/Kingdo777/puffer/taps"
+)
+
+func newProbedVM(t *testing.T, addr string, probeType misc.ProbeType, timeout time.Duration) *misc.VM {
+	host, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+
+	vm := misc.NewVM("1")
+	vm.Ni = &taps.NetworkInterface{PrimaryAddress: host}
+	vm.Readiness = &misc.ReadinessProbe{Type: probeType, Port: port, Path: "/healthz", Timeout: timeout}
+
+	return vm
+}
+
+func TestWaitGuestReadyHTTP(t *testing.T) {
+	var ready int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" || atomic.LoadInt32(&ready) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	o := &Orchestrator{}
+	vm := newProbedVM(t, server.Listener.Addr().String(), misc.ProbeHTTP, 5*time.Second)
+
+	time.AfterFunc(200*time.Millisecond, func() { atomic.StoreInt32(&ready, 1) })
+
+	start := time.Now()
+	require.NoError(t, o.waitGuestReady(context.Background(), vm))
+	require.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond, "Guest is ready before its probe passes")
+}
+
+func TestWaitGuestReadyTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	require.NoError(t, listener.Close())
+
+	o := &Orchestrator{}
+	vm := newProbedVM(t, addr, misc.ProbeTCP, 200*time.Millisecond)
+
+	err = o.waitGuestReady(context.Background(), vm)
+	var timeoutErr *misc.TimeoutErr
+	require.True(t, errors.As(err, &timeoutErr), "Expected a TimeoutErr, got %v", err)
+
+	listener, err = net.Listen("tcp", addr)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	require.NoError(t, o.waitGuestReady(context.Background(), vm))
+}
@@ -0,0 +1,349 @@
+// MIT License
+//
+// Copyright (c) 2020 Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ctriface
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Kingdo777/puffer/misc"
+)
+
+// defaultReconcileInterval Period of the reconciliation after the one at startup
+const defaultReconcileInterval = 5 * time.Minute
+
+// Labels of the container of a VM recording its size, which an adopted VM is committed with
+const (
+	labelVCPUs      = "puffer.io/vcpus"
+	labelMemSizeMib = "puffer.io/mem-size-mib"
+)
+
+// DriftReport Differences a reconciliation found between firecracker-containerd,
+// the host and the records of puffer, and what was done about them
+type DriftReport struct {
+	Time time.Time `json:"time"`
+	// Adopted Running VMs without a record that were taken into the VM pool, see WithAdoption
+	Adopted []string `json:"adopted,omitempty"`
+	// Removed VMs without a record whose containers, tasks, taps and snapshots were removed
+	Removed []string `json:"removed,omitempty"`
+	// UnknownTaps Puffer taps on the host without a record, which were removed
+	UnknownTaps []string `json:"unknownTaps,omitempty"`
+	// Missing VMs of the pool whose container is gone, they are left to their owner
+	Missing []string `json:"missing,omitempty"`
+	// Failed VMs that could neither be adopted nor removed, with the error
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+// HasDrift Returns whether the reconciliation found anything not matching the records
+func (r *DriftReport) HasDrift() bool {
+	return len(r.Adopted)+len(r.Removed)+len(r.UnknownTaps)+len(r.Missing)+len(r.Failed) > 0
+}
+
+// reconciler State of the periodic reconciliation
+type reconciler struct {
+	sync.Mutex
+	interval time.Duration
+	last     *DriftReport
+	// reserved IDs of the VMs whose leftovers the last reconciliation failed to remove
+	reserved map[string]bool
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// Reconcile Compares the containers, tasks and VMs of firecracker-containerd, the taps
+// on the host and the snapshot directories with the VM pool. Leftovers are removed, unless
+// they are running VMs of a previous run and adoption is enabled. VMs with an operation
+// in flight are skipped
+func (o *Orchestrator) Reconcile(ctx context.Context) (*DriftReport, error) {
+	ctx = namespaces.WithNamespace(ctx, namespaceName)
+	report := &DriftReport{Time: time.Now(), Failed: make(map[string]string)}
+
+	containers, err := o.client.Containers(ctx)
+	if err != nil {
+		return nil, errors.Wrap(wrapBackendErr(containerdBackend, err), "failed to list containers")
+	}
+
+	// Leftovers by VM ID, a VM may have left only a tap or a snapshot directory
+	leftovers := make(map[string]containerd.Container)
+	hasContainer := make(map[string]bool)
+	for _, container := range containers {
+		leftovers[container.ID()] = container
+		hasContainer[container.ID()] = true
+	}
+	for _, vmID := range o.vmPool.ListTapVMs() {
+		if _, ok := leftovers[vmID]; !ok {
+			leftovers[vmID] = nil
+		}
+	}
+	if entries, err := os.ReadDir(o.snapshotsDir); err == nil {
+		for _, entry := range entries {
+			if _, ok := leftovers[entry.Name()]; !ok && entry.IsDir() {
+				leftovers[entry.Name()] = nil
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		log.WithError(err).Warn("Failed to list snapshot directories")
+	}
+
+	vmIDs := make([]string, 0, len(leftovers))
+	for vmID := range leftovers {
+		vmIDs = append(vmIDs, vmID)
+	}
+	sort.Strings(vmIDs)
+
+	for _, vmID := range vmIDs {
+		o.reconcileLeftover(ctx, vmID, report)
+	}
+
+	for vmID, vm := range o.vmPool.GetVMMap() {
+		switch vm.GetState() {
+		case misc.VMRunning, misc.VMPaused, misc.VMSnapshotted, misc.VMFailed, misc.VMOffloaded:
+		default:
+			continue
+		}
+		// VMs started after the containers were listed are not missing
+		if vm.GetStateTimes()[misc.VMStarting].After(report.Time) {
+			continue
+		}
+		if !hasContainer[vmID] && !o.journal.busy(vmID) {
+			report.Missing = append(report.Missing, vmID)
+		}
+	}
+	sort.Strings(report.Missing)
+
+	report.UnknownTaps, err = o.vmPool.RemoveUnknownTaps()
+	if err != nil {
+		log.WithError(err).Error("Failed to remove unknown taps")
+	}
+
+	if report.HasDrift() {
+		log.WithFields(log.Fields{
+			"adopted":     report.Adopted,
+			"removed":     report.Removed,
+			"unknownTaps": report.UnknownTaps,
+			"missing":     report.Missing,
+			"failed":      len(report.Failed),
+		}).Warn("Reconciliation found drift")
+	}
+
+	reserved := make(map[string]bool, len(report.Failed))
+	for vmID := range report.Failed {
+		reserved[vmID] = true
+	}
+
+	o.reconciler.Lock()
+	o.reconciler.last = report
+	o.reconciler.reserved = reserved
+	o.reconciler.Unlock()
+
+	return report, nil
+}
+
+// reconcileLeftover Adopts or removes what is left of a VM without a record. The VM is
+// claimed in the journal first, as an operation adds its VM to the pool while in flight,
+// then its leftovers are listed again, as an operation may have ended since they were found
+func (o *Orchestrator) reconcileLeftover(ctx context.Context, vmID string, report *DriftReport) {
+	logger := log.WithFields(log.Fields{"vmID": vmID})
+
+	jop, claimed, err := o.journal.claim(journalStop, vmID)
+	if err != nil {
+		logger.WithError(err).Error("Failed to journal the removal of the leftovers of VM")
+		report.Failed[vmID] = err.Error()
+		return
+	}
+	if !claimed {
+		return
+	}
+	defer jop.end()
+
+	if o.vmPool.HasVM(vmID) {
+		return
+	}
+
+	container, found, err := o.findLeftovers(ctx, vmID)
+	if err != nil {
+		logger.WithError(err).Error("Failed to list leftovers of VM")
+		report.Failed[vmID] = err.Error()
+		return
+	}
+	if !found {
+		return
+	}
+
+	if container != nil && o.adoptVMs {
+		err := o.adoptVM(ctx, container)
+		if err == nil {
+			report.Adopted = append(report.Adopted, vmID)
+			return
+		}
+		logger.WithError(err).Debug("VM cannot be adopted")
+	}
+
+	if err := o.removeStaleVM(&interruptedOp{op: journalStop, vmID: vmID}); err != nil {
+		logger.WithError(err).Error("Failed to remove leftovers of VM")
+		report.Failed[vmID] = err.Error()
+		return
+	}
+	report.Removed = append(report.Removed, vmID)
+}
+
+// findLeftovers Returns the container of a VM, if any, and whether anything of the VM is left
+func (o *Orchestrator) findLeftovers(ctx context.Context, vmID string) (containerd.Container, bool, error) {
+	container, err := o.client.LoadContainer(ctx, vmID)
+	switch {
+	case err == nil:
+		return container, true, nil
+	case !isNotFound(err):
+		return nil, false, wrapBackendErr(containerdBackend, err)
+	}
+
+	tapVMs := o.vmPool.ListTapVMs()
+	if i := sort.SearchStrings(tapVMs, vmID); i < len(tapVMs) && tapVMs[i] == vmID {
+		return nil, true, nil
+	}
+
+	if _, err := os.Stat(o.getVMBaseDir(vmID)); err == nil {
+		return nil, true, nil
+	} else if !os.IsNotExist(err) {
+		return nil, false, err
+	}
+
+	return nil, false, nil
+}
+
+// adoptVM Takes a running VM of a previous run into the pool, which requires its
+// task to be running, its firecracker VM to exist and its tap to be persisted
+func (o *Orchestrator) adoptVM(ctx context.Context, container containerd.Container) error {
+	vmID := container.ID()
+
+	labels, err := container.Labels(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get container labels")
+	}
+	vcpus, memSizeMib, err := parseResourceLabels(labels)
+	if err != nil {
+		return err
+	}
+
+	task, err := container.Task(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to load task")
+	}
+
+	status, err := task.Status(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get task status")
+	}
+	if status.Status != containerd.Running {
+		return errors.Errorf("task is %s", status.Status)
+	}
+
+	if _, err := o.fcClient.GetVMInfo(ctx, &proto.GetVMInfoRequest{VMID: vmID}); err != nil {
+		return errors.Wrap(wrapBackendErr(fcBackend, err), "failed to get firecracker VM")
+	}
+
+	vm, err := o.vmPool.Adopt(vmID, container, task, misc.WithResources(vcpus, memSizeMib))
+	if err != nil {
+		return err
+	}
+
+	if err := o.watchTask(vm); err != nil {
+		log.WithField("vmID", vmID).WithError(err).Warn("failed to watch the task of the adopted VM")
+	}
+
+	return os.MkdirAll(o.getVMBaseDir(vmID), 0777)
+}
+
+// resourceLabels Returns the labels recording the size of a VM on its container
+func resourceLabels(vm *misc.VM) map[string]string {
+	return map[string]string{
+		labelVCPUs:      strconv.FormatUint(uint64(vm.VCPUs), 10),
+		labelMemSizeMib: strconv.FormatUint(uint64(vm.MemSizeMib), 10),
+	}
+}
+
+// parseResourceLabels Returns the size of a VM recorded on its container, the containers
+// of VMs started before the size was recorded cannot be adopted
+func parseResourceLabels(labels map[string]string) (vcpus, memSizeMib uint32, err error) {
+	v, err := strconv.ParseUint(labels[labelVCPUs], 10, 32)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "invalid label %s", labelVCPUs)
+	}
+	m, err := strconv.ParseUint(labels[labelMemSizeMib], 10, 32)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "invalid label %s", labelMemSizeMib)
+	}
+
+	return uint32(v), uint32(m), nil
+}
+
+// isReserved Returns whether the leftovers of a VM could not be removed, so that its ID
+// cannot be used by a new VM until a reconciliation removes them
+func (o *Orchestrator) isReserved(vmID string) bool {
+	o.reconciler.Lock()
+	defer o.reconciler.Unlock()
+
+	return o.reconciler.reserved[vmID]
+}
+
+// runReconciler Reconciles periodically until Cleanup
+func (o *Orchestrator) runReconciler() {
+	ticker := time.NewTicker(o.reconciler.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-o.reconciler.stop:
+			return
+		case <-ticker.C:
+			if _, err := o.Reconcile(context.Background()); err != nil {
+				log.WithError(err).Error("Periodic reconciliation failed")
+			}
+		}
+	}
+}
+
+// stopReconciler Stops the periodic reconciliation
+func (o *Orchestrator) stopReconciler() {
+	o.reconciler.stopOnce.Do(func() {
+		close(o.reconciler.stop)
+	})
+}
+
+// GetDriftReport Returns the report of the last reconciliation, nil before the first one
+func (o *Orchestrator) GetDriftReport() *DriftReport {
+	o.reconciler.Lock()
+	defer o.reconciler.Unlock()
+
+	return o.reconciler.last
+}
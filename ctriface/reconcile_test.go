@@ -0,0 +1,60 @@
+// MIT License
+//
+// # Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ctriface
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Kingdo777/puffer/misc"
+)
+
+func TestResourceLabels(t *testing.T) {
+	vm := misc.NewVM("1")
+	misc.WithResources(4, 512)(vm)
+
+	vcpus, memSizeMib, err := parseResourceLabels(resourceLabels(vm))
+	require.NoError(t, err, "Failed to parse the recorded size")
+	require.Equal(t, uint32(4), vcpus)
+	require.Equal(t, uint32(512), memSizeMib)
+
+	// Containers of VMs started before their size was recorded are not adopted
+	_, _, err = parseResourceLabels(map[string]string{labelVCPUs: "4"})
+	require.Error(t, err, "Container without the memory label was accepted")
+
+	_, _, err = parseResourceLabels(map[string]string{labelVCPUs: "-1", labelMemSizeMib: "512"})
+	require.Error(t, err, "Invalid vCPUs label was accepted")
+}
+
+func TestFailedLeftoversReserveTheirID(t *testing.T) {
+	o := newStopOrchestrator(t)
+	require.False(t, o.IsVMIDInUse("1"))
+
+	o.reconciler.reserved = map[string]bool{"1": true}
+	require.True(t, o.IsVMIDInUse("1"), "ID of a VM whose container is left was reused")
+
+	newStoppableVM(t, o, &fakeTask{}, &fakeContainer{}, misc.VMRunning)
+	o.reconciler.reserved = nil
+	require.True(t, o.IsVMIDInUse("1"), "ID of a VM of the pool was reused")
+}
@@ -0,0 +1,156 @@
+// MIT License
+//
+// # Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ctriface
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+
+	"github.com/containerd/containerd"
+	fcclient "github.com/firecracker-microvm/firecracker-containerd/firecracker-control/client"
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+	fccontrol "github.com/firecracker-microvm/firecracker-containerd/proto/service/fccontrol/ttrpc"
+	"github.com/gogo/protobuf/types"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Kingdo777/puffer/misc"
+	"github.com/Kingdo777/puffer/taps"
+)
+
+// fakeTask A task that exits when it is killed and fails to be deleted if deleteErr is set
+type fakeTask struct {
+	containerd.Task
+	deleteErr error
+}
+
+func (t *fakeTask) Kill(context.Context, syscall.Signal, ...containerd.KillOpts) error {
+	return nil
+}
+
+func (t *fakeTask) Status(context.Context) (containerd.Status, error) {
+	return containerd.Status{Status: containerd.Stopped}, nil
+}
+
+func (t *fakeTask) Delete(context.Context, ...containerd.ProcessDeleteOpts) (*containerd.ExitStatus, error) {
+	return nil, t.deleteErr
+}
+
+// fakeContainer A container that fails to be deleted if deleteErr is set
+type fakeContainer struct {
+	containerd.Container
+	deleteErr error
+}
+
+func (c *fakeContainer) Delete(context.Context, ...containerd.DeleteOpts) error {
+	return c.deleteErr
+}
+
+// fakeFirecracker A firecracker-control service whose VMs always stop
+type fakeFirecracker struct {
+	fccontrol.FirecrackerService
+}
+
+func (fakeFirecracker) StopVM(context.Context, *proto.StopVMRequest) (*types.Empty, error) {
+	return &types.Empty{}, nil
+}
+
+// failingTapBackend A simulated backend that fails to create taps once failCreate is set
+type failingTapBackend struct {
+	*taps.SimBackend
+	failCreate bool
+}
+
+func (b *failingTapBackend) CreateTap(name, bridgeName, macAddress string) error {
+	if b.failCreate {
+		return errors.New("tap device is busy")
+	}
+	return b.SimBackend.CreateTap(name, bridgeName, macAddress)
+}
+
+func newStoppableVM(t *testing.T, o *Orchestrator, task containerd.Task, container containerd.Container,
+	states ...misc.VMState) *misc.VM {
+	vm, err := o.vmPool.Allocate("1", "")
+	require.NoError(t, err)
+
+	vm.Task = &task
+	vm.Container = &container
+	for _, state := range states {
+		_, err := vm.Transition(state)
+		require.NoError(t, err)
+	}
+
+	return vm
+}
+
+func newStopOrchestrator(t *testing.T) *Orchestrator {
+	return &Orchestrator{
+		snapshotsDir: t.TempDir(),
+		journal:      &journal{vms: make(map[string]int)},
+		vmPool: misc.NewVMPool(
+			misc.WithTapManagerOptions(taps.WithBackend(taps.NewSimBackend()), taps.WithTapNamesFile("")),
+		),
+	}
+}
+
+func TestFailedStopOfKilledVMCanBeRetried(t *testing.T) {
+	o := newStopOrchestrator(t)
+	task := &fakeTask{deleteErr: errors.New("shim is gone")}
+	vm := newStoppableVM(t, o, task, &fakeContainer{}, misc.VMRunning)
+
+	require.Error(t, o.StopSingleVMWithGrace(context.Background(), vm.ID, 0))
+	require.Equal(t, misc.VMFailed, vm.GetState(), "VM with a killed task must be failed after a failed stop")
+
+	_, err := vm.Transition(misc.VMStopping)
+	require.NoError(t, err, "Failed VM cannot be stopped again")
+}
+
+func TestFailedStopOfOffloadedVMRollsBack(t *testing.T) {
+	o := newStopOrchestrator(t)
+	container := &fakeContainer{deleteErr: errors.New("snapshotter is busy")}
+	vm := newStoppableVM(t, o, &fakeTask{}, container, misc.VMRunning, misc.VMOffloading, misc.VMOffloaded)
+
+	require.Error(t, o.StopSingleVMWithGrace(context.Background(), vm.ID, 0))
+	require.Equal(t, misc.VMOffloaded, vm.GetState(), "Offloaded VM must be rolled back after a failed stop")
+
+	_, err := o.vmPool.GetVM(vm.ID)
+	require.NoError(t, err, "VM was freed although its stop failed")
+}
+
+func TestFailedOffloadLeavesVMStoppable(t *testing.T) {
+	backend := &failingTapBackend{SimBackend: taps.NewSimBackend()}
+	o := newStopOrchestrator(t)
+	o.fcClient = &fcclient.Client{FirecrackerService: fakeFirecracker{}}
+	o.vmPool = misc.NewVMPool(misc.WithTapManagerOptions(taps.WithBackend(backend), taps.WithTapNamesFile("")))
+
+	vm := newStoppableVM(t, o, &fakeTask{}, &fakeContainer{},
+		misc.VMRunning, misc.VMPaused, misc.VMSnapshotted, misc.VMRunning)
+
+	backend.failCreate = true
+	require.Error(t, o.Offload(context.Background(), vm.ID))
+	require.Equal(t, misc.VMOffloaded, vm.GetState(), "VM whose firecracker VM stopped must not stay offloading")
+
+	require.NoError(t, o.StopSingleVMWithGrace(context.Background(), vm.ID, 0))
+	require.False(t, o.vmPool.HasVM(vm.ID), "VM was not freed after its failed offload")
+}
@@ -62,17 +62,28 @@ const (
 	TaskWait = "TaskWait"
 	// TaskStart Time to start task
 	TaskStart = "TaskStart"
+	// AllocateTap Time to allocate the network interface of a VM
+	AllocateTap = "AllocateTap"
+	// GuestReady Time for the function in the guest to pass its readiness probe
+	GuestReady = "GuestReady"
+
+	// TapPoolHit Counter set to 1 if the tap was claimed from the tap pool, 0 otherwise
+	TapPoolHit = "TapPoolHit"
 )
 
 // Metric A general metric
 type Metric struct {
 	MetricMap map[string]float64
+	// Counters Values that are not times and are left out of the total,
+	// their mean over several metrics is a rate
+	Counters map[string]float64
 }
 
 // NewMetric Create a new metric
 func NewMetric() *Metric {
 	m := new(Metric)
 	m.MetricMap = make(map[string]float64)
+	m.Counters = make(map[string]float64)
 
 	return m
 }
@@ -98,6 +109,9 @@ func (m *Metric) PrintAll() {
 		fmt.Printf("%s:\t%.1f\n", k, v)
 	}
 	fmt.Printf("Total\t%.1f\n", m.Total())
+	for k, v := range m.Counters {
+		fmt.Printf("%s:\t%.2f\n", k, v)
+	}
 }
 
 // PrintMeanStd prints the mean and standard
@@ -110,6 +124,8 @@ func PrintMeanStd(resultsPath, funcName string, metricsList ...*Metric) error {
 		agg         map[string][]float64 = make(map[string][]float64)
 		totals      []float64            = make([]float64, 0, len(metricsList))
 		keys        []string             = make([]string, 0)
+		counterKeys []string             = make([]string, 0)
+		counterAgg  map[string][]float64 = make(map[string][]float64)
 		forPrinting []string             = make([]string, 0)
 		header                           = []string{"FuncName"}
 	)
@@ -124,10 +140,17 @@ func PrintMeanStd(resultsPath, funcName string, metricsList ...*Metric) error {
 	}
 	sort.Strings(keys)
 
+	for k := range metricsList[0].Counters {
+		counterKeys = append(counterKeys, k)
+		counterAgg[k] = make([]float64, 0, len(metricsList))
+	}
+	sort.Strings(counterKeys)
+
 	for _, key := range keys {
 		header = append(header, key, "StdDev")
 	}
 	header = append(header, "Total", "StdDev")
+	header = append(header, counterKeys...)
 
 	for _, m := range metricsList {
 		totals = append(totals, m.Total())
@@ -135,6 +158,10 @@ func PrintMeanStd(resultsPath, funcName string, metricsList ...*Metric) error {
 		for k, v := range m.MetricMap {
 			agg[k] = append(agg[k], v)
 		}
+
+		for k, v := range m.Counters {
+			counterAgg[k] = append(counterAgg[k], v)
+		}
 	}
 
 	if resultsPath == "" {
@@ -177,6 +204,10 @@ func PrintMeanStd(resultsPath, funcName string, metricsList ...*Metric) error {
 	forPrinting = append(forPrinting, strconv.Itoa(int(mean)))
 	forPrinting = append(forPrinting, fmt.Sprintf("%.1f", std))
 
+	for _, k := range counterKeys {
+		forPrinting = append(forPrinting, fmt.Sprintf("%.2f", stat.Mean(counterAgg[k], nil)))
+	}
+
 	if err := w.Write(forPrinting); err != nil {
 		log.Error("Failed to write to csv file")
 		return err
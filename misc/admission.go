@@ -0,0 +1,297 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package misc
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AdmissionPolicy What the pool does with a VM that does not fit into the node capacity
+type AdmissionPolicy string
+
+const (
+	// AdmissionQueue Waits for capacity to be released, up to the queue timeout
+	AdmissionQueue AdmissionPolicy = "queue"
+	// AdmissionReject Fails the VM right away
+	AdmissionReject AdmissionPolicy = "reject"
+	// AdmissionEvict Stops idle (offloaded) VMs, oldest first, to make room
+	AdmissionEvict AdmissionPolicy = "evict"
+
+	// DefaultVCPUs Number of vCPUs of a VM unless set with WithResources
+	DefaultVCPUs = 1
+	// DefaultMemSizeMib Memory of a VM unless set with WithResources
+	DefaultMemSizeMib = 256
+)
+
+// Capacity Amounts of node resources, a zero field in a limit is not limited
+type Capacity struct {
+	// VCPUs vCPUs of running and paused VMs
+	VCPUs uint64
+	// MemSizeMib Memory of running and paused VMs
+	MemSizeMib uint64
+	// SnapshotBytes Disk held by the snapshots of VMs
+	SnapshotBytes uint64
+}
+
+func (c *Capacity) add(o Capacity) {
+	c.VCPUs += o.VCPUs
+	c.MemSizeMib += o.MemSizeMib
+	c.SnapshotBytes += o.SnapshotBytes
+}
+
+func (c *Capacity) sub(o Capacity) {
+	c.VCPUs -= o.VCPUs
+	c.MemSizeMib -= o.MemSizeMib
+	c.SnapshotBytes -= o.SnapshotBytes
+}
+
+// shortage Returns the resources that are missing to add req to used within limits
+func shortage(used, req, limits Capacity) Capacity {
+	missing := func(used, req, limit uint64) uint64 {
+		if limit == 0 || used+req <= limit {
+			return 0
+		}
+		return used + req - limit
+	}
+
+	return Capacity{
+		VCPUs:         missing(used.VCPUs, req.VCPUs, limits.VCPUs),
+		MemSizeMib:    missing(used.MemSizeMib, req.MemSizeMib, limits.MemSizeMib),
+		SnapshotBytes: missing(used.SnapshotBytes, req.SnapshotBytes, limits.SnapshotBytes),
+	}
+}
+
+// relieves Returns whether releasing held reduces any of the missing resources
+func (c Capacity) relieves(missing Capacity) bool {
+	return (missing.VCPUs > 0 && c.VCPUs > 0) ||
+		(missing.MemSizeMib > 0 && c.MemSizeMib > 0) ||
+		(missing.SnapshotBytes > 0 && c.SnapshotBytes > 0)
+}
+
+// admission Node-wide accounting of the resources committed to VMs of a pool
+type admission struct {
+	mu           sync.Mutex
+	limits       Capacity
+	used         Capacity
+	policy       AdmissionPolicy
+	queueTimeout time.Duration
+	// released Closed and replaced whenever resources are released
+	released chan struct{}
+}
+
+// computeOf Returns the vCPUs and memory a VM holds while its firecracker VM exists
+func computeOf(vm *VM) Capacity {
+	return Capacity{VCPUs: uint64(vm.VCPUs), MemSizeMib: uint64(vm.MemSizeMib)}
+}
+
+// admit Commits req to the VM if it fits the capacity, or applies the admission policy
+func (p *VMPool) admit(vm *VM, req Capacity) error {
+	a := &p.admission
+	logger := log.WithFields(log.Fields{"vmID": vm.ID})
+
+	deadline := time.Now().Add(a.queueTimeout)
+	for {
+		a.mu.Lock()
+		missing := shortage(a.used, req, a.limits)
+		if missing == (Capacity{}) {
+			a.used.add(req)
+			vm.committed.add(req)
+			a.mu.Unlock()
+			return nil
+		}
+		released := a.released
+		a.mu.Unlock()
+
+		switch a.policy {
+		case AdmissionEvict:
+			if p.evictIdle(vm.ID, missing) {
+				continue
+			}
+		case AdmissionQueue:
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				break
+			}
+
+			logger.Debug("Waiting for node capacity")
+			timer := time.NewTimer(wait)
+			select {
+			case <-released:
+				timer.Stop()
+				continue
+			case <-timer.C:
+			}
+		}
+
+		logger.Warnf("VM does not fit into the node capacity, missing %+v", missing)
+		return CapacityExhaustedErr("Node capacity")
+	}
+}
+
+// release Returns resources committed to the VM, up to what it holds
+func (p *VMPool) release(vm *VM, c Capacity) {
+	a := &p.admission
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if c.VCPUs > vm.committed.VCPUs {
+		c.VCPUs = vm.committed.VCPUs
+	}
+	if c.MemSizeMib > vm.committed.MemSizeMib {
+		c.MemSizeMib = vm.committed.MemSizeMib
+	}
+	if c.SnapshotBytes > vm.committed.SnapshotBytes {
+		c.SnapshotBytes = vm.committed.SnapshotBytes
+	}
+	if c == (Capacity{}) {
+		return
+	}
+
+	vm.committed.sub(c)
+	a.used.sub(c)
+
+	close(a.released)
+	a.released = make(chan struct{})
+}
+
+// releaseAll Returns all resources committed to the VM
+func (p *VMPool) releaseAll(vm *VM) {
+	p.admission.mu.Lock()
+	held := vm.committed
+	p.admission.mu.Unlock()
+
+	p.release(vm, held)
+}
+
+// evictIdle Stops the longest offloaded VM whose resources relieve the missing ones,
+// returns false if there is no such VM or it could not be stopped
+func (p *VMPool) evictIdle(requester string, missing Capacity) bool {
+	if p.evictor == nil {
+		return false
+	}
+
+	type candidate struct {
+		vmID  string
+		since time.Time
+	}
+
+	var candidates []candidate
+	p.vmMap.Range(func(key, value interface{}) bool {
+		vm := value.(*VM)
+		if vm.ID == requester || vm.GetState() != VMOffloaded {
+			return true
+		}
+
+		p.admission.mu.Lock()
+		held := vm.committed
+		p.admission.mu.Unlock()
+
+		if held.relieves(missing) {
+			candidates = append(candidates, candidate{vmID: vm.ID, since: vm.GetStateTimes()[VMOffloaded]})
+		}
+		return true
+	})
+
+	if len(candidates) == 0 {
+		return false
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].since.Before(candidates[j].since)
+	})
+
+	victim := candidates[0].vmID
+	logger := log.WithFields(log.Fields{"vmID": victim, "requester": requester})
+	logger.Info("Evicting idle VM to make room")
+
+	if err := p.evictor(victim); err != nil {
+		logger.WithError(err).Error("Failed to evict idle VM")
+		return false
+	}
+
+	return true
+}
+
+// AdmitRestore Commits the vCPUs and memory of an offloaded VM before it is restored
+func (p *VMPool) AdmitRestore(vmID string) error {
+	vm, err := p.GetVM(vmID)
+	if err != nil {
+		return err
+	}
+
+	return p.admit(vm, computeOf(vm))
+}
+
+// ReleaseCompute Returns the vCPUs and memory of a VM whose firecracker VM is gone
+func (p *VMPool) ReleaseCompute(vmID string) error {
+	vm, err := p.GetVM(vmID)
+	if err != nil {
+		return err
+	}
+
+	p.release(vm, computeOf(vm))
+
+	return nil
+}
+
+// AdmitSnapshot Commits disk for a snapshot of the VM of the given estimated size
+func (p *VMPool) AdmitSnapshot(vmID string, bytes uint64) error {
+	vm, err := p.GetVM(vmID)
+	if err != nil {
+		return err
+	}
+
+	return p.admit(vm, Capacity{SnapshotBytes: bytes})
+}
+
+// SetSnapshotSize Replaces the disk committed to the snapshot of the VM with its actual size
+func (p *VMPool) SetSnapshotSize(vmID string, bytes uint64) error {
+	vm, err := p.GetVM(vmID)
+	if err != nil {
+		return err
+	}
+
+	a := &p.admission
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.used.SnapshotBytes = a.used.SnapshotBytes - vm.committed.SnapshotBytes + bytes
+	vm.committed.SnapshotBytes = bytes
+
+	close(a.released)
+	a.released = make(chan struct{})
+
+	return nil
+}
+
+// GetCapacity Returns the resources committed to VMs and the limits of the node
+func (p *VMPool) GetCapacity() (used, limits Capacity) {
+	p.admission.mu.Lock()
+	defer p.admission.mu.Unlock()
+
+	return p.admission.used, p.admission.limits
+}
@@ -0,0 +1,171 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package misc
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Kingdo777/puffer/taps"
+)
+
+func newTestPool(limits Capacity, policy AdmissionPolicy, queueTimeout time.Duration) *VMPool {
+	p := NewVMPool(
+		WithTapManagerOptions(taps.WithBackend(taps.NewSimBackend()), taps.WithTapNamesFile("")),
+		WithCapacity(limits, policy, queueTimeout),
+	)
+	p.evictor = p.Free
+
+	return p
+}
+
+func requireCapacityExhausted(t *testing.T, err error) {
+	var capacityErr CapacityExhaustedErr
+	require.True(t, errors.As(err, &capacityErr), "Expected a CapacityExhaustedErr, got %v", err)
+}
+
+func TestAdmissionReject(t *testing.T) {
+	p := newTestPool(Capacity{VCPUs: 3}, AdmissionReject, 0)
+
+	_, err := p.Allocate("1", "", WithResources(2, 128))
+	require.NoError(t, err, "Failed to allocate VM")
+
+	_, err = p.Allocate("2", "", WithResources(2, 128))
+	requireCapacityExhausted(t, err)
+	require.False(t, p.HasVM("2"), "Rejected VM is in the pool")
+
+	used, _ := p.GetCapacity()
+	require.Equal(t, Capacity{VCPUs: 2, MemSizeMib: 128}, used)
+
+	require.NoError(t, p.Free("1"), "Failed to free VM")
+
+	_, err = p.Allocate("2", "", WithResources(2, 128))
+	require.NoError(t, err, "Failed to allocate VM after capacity was released")
+}
+
+func TestAdmissionQueue(t *testing.T) {
+	p := newTestPool(Capacity{MemSizeMib: DefaultMemSizeMib}, AdmissionQueue, 5*time.Second)
+
+	_, err := p.Allocate("1", "")
+	require.NoError(t, err, "Failed to allocate VM")
+
+	errCh := make(chan error)
+	go func() {
+		_, err := p.Allocate("2", "")
+		errCh <- err
+	}()
+
+	select {
+	case err := <-errCh:
+		t.Fatalf("Queued VM was admitted before capacity was released: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	require.NoError(t, p.Free("1"), "Failed to free VM")
+	require.NoError(t, <-errCh, "Queued VM was not admitted")
+}
+
+func TestAdmissionQueueTimeout(t *testing.T) {
+	p := newTestPool(Capacity{VCPUs: 1}, AdmissionQueue, 50*time.Millisecond)
+
+	_, err := p.Allocate("1", "")
+	require.NoError(t, err, "Failed to allocate VM")
+
+	_, err = p.Allocate("2", "")
+	requireCapacityExhausted(t, err)
+}
+
+func TestAdmissionEvict(t *testing.T) {
+	p := newTestPool(Capacity{VCPUs: 2, SnapshotBytes: 300}, AdmissionEvict, 0)
+
+	vm, err := p.Allocate("1", "")
+	require.NoError(t, err, "Failed to allocate VM")
+	require.NoError(t, p.AdmitSnapshot("1", 200), "Failed to admit snapshot")
+	for _, state := range []VMState{VMRunning, VMPaused, VMSnapshotted, VMOffloading, VMOffloaded} {
+		_, err := vm.Transition(state)
+		require.NoError(t, err)
+	}
+	require.NoError(t, p.ReleaseCompute("1"), "Failed to release compute")
+
+	_, err = p.Allocate("2", "")
+	require.NoError(t, err, "Failed to allocate VM")
+	_, err = p.Allocate("3", "")
+	require.NoError(t, err, "Failed to allocate VM")
+
+	// An offloaded VM holds no vCPUs, so evicting it does not help
+	_, err = p.Allocate("4", "")
+	requireCapacityExhausted(t, err)
+	require.True(t, p.HasVM("1"), "Offloaded VM was evicted for vCPUs")
+
+	require.NoError(t, p.AdmitSnapshot("2", 200), "Failed to admit snapshot by evicting")
+	require.False(t, p.HasVM("1"), "Offloaded VM was not evicted")
+
+	used, _ := p.GetCapacity()
+	require.Equal(t, Capacity{VCPUs: 2, MemSizeMib: 2 * DefaultMemSizeMib, SnapshotBytes: 200}, used)
+}
+
+func TestAdoptCommitsRecordedResources(t *testing.T) {
+	sim := taps.NewSimBackend()
+	namesFile := filepath.Join(t.TempDir(), "taps.json")
+
+	p := NewVMPool(WithTapManagerOptions(taps.WithBackend(sim), taps.WithTapNamesFile(namesFile)))
+	_, err := p.Allocate("1", "", WithResources(4, 512))
+	require.NoError(t, err, "Failed to allocate VM")
+
+	// A restarted pool only has the persisted tap of the VM
+	p = NewVMPool(
+		WithTapManagerOptions(taps.WithBackend(sim), taps.WithTapNamesFile(namesFile)),
+		WithCapacity(Capacity{VCPUs: 2}, AdmissionReject, 0),
+	)
+	vm, err := p.Adopt("1", nil, nil, WithResources(4, 512))
+	require.NoError(t, err, "Failed to adopt VM above the capacity limits")
+	require.Equal(t, uint32(4), vm.VCPUs)
+
+	used, _ := p.GetCapacity()
+	require.Equal(t, Capacity{VCPUs: 4, MemSizeMib: 512}, used)
+}
+
+func TestAdoptOffloadedCommitsSnapshot(t *testing.T) {
+	sim := taps.NewSimBackend()
+	namesFile := filepath.Join(t.TempDir(), "taps.json")
+
+	p := NewVMPool(WithTapManagerOptions(taps.WithBackend(sim), taps.WithTapNamesFile(namesFile)))
+	_, err := p.Allocate("1", "", WithResources(4, 512))
+	require.NoError(t, err, "Failed to allocate VM")
+
+	p = NewVMPool(WithTapManagerOptions(taps.WithBackend(sim), taps.WithTapNamesFile(namesFile)))
+	vm, err := p.AdoptOffloaded("1", nil, 1<<20, WithResources(4, 512))
+	require.NoError(t, err, "Failed to adopt offloaded VM")
+	require.Equal(t, VMOffloaded, vm.GetState())
+	require.True(t, vm.HasSnapshot(), "Offloaded VM has no snapshot")
+
+	used, _ := p.GetCapacity()
+	require.Equal(t, Capacity{SnapshotBytes: 1 << 20}, used, "Offloaded VM must only hold its snapshot")
+
+	_, err = vm.Transition(VMRestoring)
+	require.NoError(t, err, "Offloaded VM cannot be restored")
+}
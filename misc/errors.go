@@ -32,3 +32,63 @@ type NonExistErr string
 func (e NonExistErr) Error() string {
 	return fmt.Sprintf("%v does not exist", string(e))
 }
+
+// AlreadyExistsErr VM, container, etc already exists.
+type AlreadyExistsErr string
+
+func (e AlreadyExistsErr) Error() string {
+	return fmt.Sprintf("%v already exists", string(e))
+}
+
+// CapacityExhaustedErr No addresses, names, etc are left to allocate.
+type CapacityExhaustedErr string
+
+func (e CapacityExhaustedErr) Error() string {
+	return fmt.Sprintf("%v is exhausted", string(e))
+}
+
+// InvalidArgumentErr A request carries a missing or malformed value.
+type InvalidArgumentErr string
+
+func (e InvalidArgumentErr) Error() string {
+	return fmt.Sprintf("invalid argument: %v", string(e))
+}
+
+// BackendUnavailableErr containerd, firecracker-containerd, etc cannot be reached.
+type BackendUnavailableErr struct {
+	Backend string
+	Err     error
+}
+
+func (e *BackendUnavailableErr) Error() string {
+	return fmt.Sprintf("%s is unavailable: %v", e.Backend, e.Err)
+}
+
+func (e *BackendUnavailableErr) Unwrap() error {
+	return e.Err
+}
+
+// TimeoutErr An operation did not finish in time.
+type TimeoutErr struct {
+	Op  string
+	Err error
+}
+
+func (e *TimeoutErr) Error() string {
+	return fmt.Sprintf("%s timed out: %v", e.Op, e.Err)
+}
+
+func (e *TimeoutErr) Unwrap() error {
+	return e.Err
+}
+
+// InvalidTransitionErr A VM operation is not allowed in the current state of the VM
+type InvalidTransitionErr struct {
+	VMID string
+	From VMState
+	To   VMState
+}
+
+func (e *InvalidTransitionErr) Error() string {
+	return fmt.Sprintf("VM %s cannot go from %s to %s", e.VMID, e.From, e.To)
+}
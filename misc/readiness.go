@@ -0,0 +1,64 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package misc
+
+import (
+	"fmt"
+	"time"
+)
+
+// ProbeType How the readiness of the function in a guest is checked
+type ProbeType string
+
+const (
+	// ProbeNone Does not wait for the guest
+	ProbeNone ProbeType = "none"
+	// ProbeTCP Connects to the guest port
+	ProbeTCP ProbeType = "tcp"
+	// ProbeHTTP Sends a GET request to the guest port, any 2xx or 3xx status is ready
+	ProbeHTTP ProbeType = "http"
+	// ProbeGRPC Calls the standard gRPC health service on the guest port
+	ProbeGRPC ProbeType = "grpc"
+)
+
+// ParseProbeType Returns the probe type with the given name
+func ParseProbeType(name string) (ProbeType, error) {
+	switch probeType := ProbeType(name); probeType {
+	case ProbeNone, ProbeTCP, ProbeHTTP, ProbeGRPC:
+		return probeType, nil
+	}
+
+	return "", fmt.Errorf("unknown readiness probe %q", name)
+}
+
+// ReadinessProbe Check that the function in a guest serves requests, run before
+// a started or restored VM is handed out
+type ReadinessProbe struct {
+	Type ProbeType
+	// Port Guest port the function listens on
+	Port string
+	// Path Path of the HTTP request, or service of the gRPC health check
+	Path string
+	// Timeout How long the guest has to become ready
+	Timeout time.Duration
+}
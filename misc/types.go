@@ -24,6 +24,7 @@ package misc
 
 import (
 	"sync"
+	"time"
 
 	"github.com/containerd/containerd"
 
@@ -38,18 +39,88 @@ type VM struct {
 	Task      *containerd.Task
 	TaskCh    <-chan containerd.ExitStatus
 	Ni        *taps.NetworkInterface
+	Limits    *VMLimits
+	// VCPUs Number of vCPUs of the VM
+	VCPUs uint32
+	// MemSizeMib Memory of the VM
+	MemSizeMib uint32
+	// PodNetNSPath Network namespace of the pod sandbox, if set the network
+	// interface is created there by CNI
+	PodNetNSPath string
+	// TapPoolHit The tap was claimed from the tap pool instead of being created
+	TapPoolHit bool
+	// NetStats Traffic counters of the taps the VM had before its current one
+	NetStats taps.LinkStats
+	// Readiness Check run before the started or restored VM is handed out, none if nil
+	Readiness *ReadinessProbe
+	// RestartPolicy How the VM is recovered when its task fails, the orchestrator's default if empty
+	RestartPolicy RestartPolicy
+
+	stateMu    sync.Mutex
+	state      VMState
+	stateTimes map[VMState]time.Time
+
+	labelsMu sync.Mutex
+	labels   map[string]string
+
+	exitMu   sync.Mutex
+	taskDone chan struct{}
+	lastExit *TaskExit
+	restarts int
+
+	// committed Node resources held by the VM, guarded by the admission lock of the pool
+	committed Capacity
+}
+
+// TokenBucket Parameters of a token bucket used for rate limiting
+type TokenBucket struct {
+	// Size Total number of tokens the bucket can hold
+	Size int64
+	// OneTimeBurst Initial number of burst tokens that do not replenish
+	OneTimeBurst int64
+	// RefillTimeMs Time in ms for the bucket to refill completely
+	RefillTimeMs int64
+}
+
+// RateLimiter Bandwidth (bytes) and operations (packets or requests) limits
+type RateLimiter struct {
+	Bandwidth *TokenBucket
+	Ops       *TokenBucket
+}
+
+// VMLimits Per-VM I/O rate limits, nil fields are not limited
+type VMLimits struct {
+	// NetRx Traffic received by the guest
+	NetRx *RateLimiter
+	// NetTx Traffic sent by the guest
+	NetTx *RateLimiter
+	// Block Root block device of the guest
+	Block *RateLimiter
 }
 
 // VMPool Pool of active VMs (can be in several states though)
 type VMPool struct {
 	vmMap      sync.Map
 	tapManager *taps.TapManager
+	cniManager *taps.CNIManager
+	tapOpts    []taps.TapManagerOption
+	admission  admission
+	index      vmIndex
+	// evictor Stops an idle VM to make room under the AdmissionEvict policy
+	evictor func(vmID string) error
 }
 
+// VMPoolOption Options to pass to VMPool
+type VMPoolOption func(*VMPool)
+
 // NewVM Initialize a VM
 func NewVM(vmID string) *VM {
 	vm := new(VM)
 	vm.ID = vmID
+	vm.VCPUs = DefaultVCPUs
+	vm.MemSizeMib = DefaultMemSizeMib
+	vm.stateTimes = make(map[VMState]time.Time)
+	vm.setState(VMStarting)
 
 	return vm
 }
@@ -0,0 +1,125 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package misc
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/containerd/containerd"
+)
+
+// RestartPolicy How a VM whose task exits while it is running is recovered
+type RestartPolicy string
+
+const (
+	// RestartInPlace Starts a new task in the same VM
+	RestartInPlace RestartPolicy = "restart"
+	// RestartFromSnapshot Replaces the VM with one restored from its snapshot,
+	// a VM that cannot be restored is restarted in place
+	RestartFromSnapshot RestartPolicy = "replace"
+	// RestartNever Leaves the VM failed, so its container is reported as exited
+	RestartNever RestartPolicy = "fail"
+)
+
+// ParseRestartPolicy Returns the restart policy with the given name
+func ParseRestartPolicy(name string) (RestartPolicy, error) {
+	switch policy := RestartPolicy(name); policy {
+	case RestartInPlace, RestartFromSnapshot, RestartNever:
+		return policy, nil
+	}
+
+	return "", fmt.Errorf("unknown restart policy %q", name)
+}
+
+// TaskExit Exit of the task of a VM
+type TaskExit struct {
+	Code     uint32
+	ExitedAt time.Time
+}
+
+// WatchTask Waits for the task behind the exit channel in the background, records its exit
+// and calls onExit, if set. The channel returned by TaskDone is closed once it exits
+func (vm *VM) WatchTask(taskCh <-chan containerd.ExitStatus, onExit func(vm *VM, exit TaskExit)) {
+	done := make(chan struct{})
+
+	vm.exitMu.Lock()
+	vm.TaskCh = taskCh
+	vm.taskDone = done
+	vm.exitMu.Unlock()
+
+	go func() {
+		code, exitedAt, _ := (<-taskCh).Result()
+		if exitedAt.IsZero() {
+			exitedAt = time.Now()
+		}
+		exit := TaskExit{Code: code, ExitedAt: exitedAt}
+
+		vm.exitMu.Lock()
+		vm.lastExit = &exit
+		vm.exitMu.Unlock()
+		close(done)
+
+		if onExit != nil {
+			onExit(vm, exit)
+		}
+	}()
+}
+
+// TaskDone Returns a channel closed once the last watched task of the VM exits,
+// nil if no task has been watched
+func (vm *VM) TaskDone() <-chan struct{} {
+	vm.exitMu.Lock()
+	defer vm.exitMu.Unlock()
+
+	return vm.taskDone
+}
+
+// GetLastExit Returns the last exit of a task of the VM, nil if none has exited
+func (vm *VM) GetLastExit() *TaskExit {
+	vm.exitMu.Lock()
+	defer vm.exitMu.Unlock()
+
+	if vm.lastExit == nil {
+		return nil
+	}
+	exit := *vm.lastExit
+	return &exit
+}
+
+// AddRestart Counts a restart of the VM after its task failed and returns the new count
+func (vm *VM) AddRestart() int {
+	vm.exitMu.Lock()
+	defer vm.exitMu.Unlock()
+
+	vm.restarts++
+	return vm.restarts
+}
+
+// GetRestarts Returns how many times the VM was restarted after its task failed
+func (vm *VM) GetRestarts() int {
+	vm.exitMu.Lock()
+	defer vm.exitMu.Unlock()
+
+	return vm.restarts
+}
@@ -0,0 +1,82 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package misc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatchTaskMarksCrashedVMFailed(t *testing.T) {
+	onExit := func(vm *VM, exit TaskExit) {
+		_, _ = vm.Transition(VMFailed)
+	}
+
+	vm := NewVM("1")
+	_, err := vm.Transition(VMRunning)
+	require.NoError(t, err)
+	require.Nil(t, vm.TaskDone())
+
+	exitedAt := time.Now()
+	taskCh := make(chan containerd.ExitStatus, 1)
+	vm.WatchTask(taskCh, onExit)
+	require.Nil(t, vm.GetLastExit())
+
+	taskCh <- *containerd.NewExitStatus(137, exitedAt, nil)
+	<-vm.TaskDone()
+
+	exit := vm.GetLastExit()
+	require.NotNil(t, exit)
+	require.Equal(t, uint32(137), exit.Code)
+	require.True(t, exit.ExitedAt.Equal(exitedAt))
+	require.Eventually(t, func() bool { return vm.GetState() == VMFailed }, time.Second, time.Millisecond)
+
+	// A restarted task is watched anew, and its exit while stopping is not a failure
+	_, err = vm.Transition(VMRunning)
+	require.NoError(t, err)
+	require.Equal(t, 1, vm.AddRestart())
+
+	taskCh = make(chan containerd.ExitStatus, 1)
+	vm.WatchTask(taskCh, onExit)
+	_, err = vm.Transition(VMStopping)
+	require.NoError(t, err)
+
+	taskCh <- *containerd.NewExitStatus(0, time.Now(), nil)
+	<-vm.TaskDone()
+
+	require.Equal(t, uint32(0), vm.GetLastExit().Code)
+	require.Equal(t, VMStopping, vm.GetState())
+	require.Equal(t, 1, vm.GetRestarts())
+}
+
+func TestParseRestartPolicy(t *testing.T) {
+	policy, err := ParseRestartPolicy("replace")
+	require.NoError(t, err)
+	require.Equal(t, RestartFromSnapshot, policy)
+
+	_, err = ParseRestartPolicy("always")
+	require.Error(t, err)
+}
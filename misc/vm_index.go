@@ -0,0 +1,212 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package misc
+
+import (
+	"sort"
+	"sync"
+)
+
+// Labels set by the CRI layer, pod sandbox labels such as the Knative revision are kept as is
+const (
+	LabelImage         = "puffer.io/image"
+	LabelPodName       = "puffer.io/pod-name"
+	LabelPodNamespace  = "puffer.io/pod-namespace"
+	LabelPodUID        = "puffer.io/pod-uid"
+	LabelPodSandboxID  = "puffer.io/pod-sandbox-id"
+	LabelContainerName = "puffer.io/container-name"
+)
+
+// VMQuery Selects VMs of a pool, empty fields match all VMs
+type VMQuery struct {
+	Image     string
+	Namespace string
+	State     VMState
+	// Selector Labels the VM must have with the given values
+	Selector map[string]string
+}
+
+// selector Returns all label constraints of the query
+func (q VMQuery) selector() map[string]string {
+	selector := make(map[string]string, len(q.Selector)+2)
+	for k, v := range q.Selector {
+		selector[k] = v
+	}
+	if q.Image != "" {
+		selector[LabelImage] = q.Image
+	}
+	if q.Namespace != "" {
+		selector[LabelPodNamespace] = q.Namespace
+	}
+
+	return selector
+}
+
+// vmIndex Sets of VM IDs by label key and value
+type vmIndex struct {
+	mu      sync.RWMutex
+	byLabel map[string]map[string]map[string]struct{}
+}
+
+func (idx *vmIndex) add(vmID string, labels map[string]string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if idx.byLabel == nil {
+		idx.byLabel = make(map[string]map[string]map[string]struct{})
+	}
+
+	for k, v := range labels {
+		values, ok := idx.byLabel[k]
+		if !ok {
+			values = make(map[string]map[string]struct{})
+			idx.byLabel[k] = values
+		}
+		ids, ok := values[v]
+		if !ok {
+			ids = make(map[string]struct{})
+			values[v] = ids
+		}
+		ids[vmID] = struct{}{}
+	}
+}
+
+func (idx *vmIndex) remove(vmID string, labels map[string]string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	for k, v := range labels {
+		ids := idx.byLabel[k][v]
+		delete(ids, vmID)
+		if len(ids) == 0 {
+			delete(idx.byLabel[k], v)
+		}
+		if len(idx.byLabel[k]) == 0 {
+			delete(idx.byLabel, k)
+		}
+	}
+}
+
+// lookup Returns the IDs of the VMs matching all of the selector, which must not be empty
+func (idx *vmIndex) lookup(selector map[string]string) []string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	sets := make([]map[string]struct{}, 0, len(selector))
+	for k, v := range selector {
+		ids := idx.byLabel[k][v]
+		if len(ids) == 0 {
+			return nil
+		}
+		sets = append(sets, ids)
+	}
+
+	// Intersect starting from the smallest set
+	sort.Slice(sets, func(i, j int) bool { return len(sets[i]) < len(sets[j]) })
+
+	var vmIDs []string
+	for vmID := range sets[0] {
+		matches := true
+		for _, ids := range sets[1:] {
+			if _, ok := ids[vmID]; !ok {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			vmIDs = append(vmIDs, vmID)
+		}
+	}
+
+	return vmIDs
+}
+
+// GetLabels Returns a copy of the labels of the VM
+func (vm *VM) GetLabels() map[string]string {
+	vm.labelsMu.Lock()
+	defer vm.labelsMu.Unlock()
+
+	labels := make(map[string]string, len(vm.labels))
+	for k, v := range vm.labels {
+		labels[k] = v
+	}
+
+	return labels
+}
+
+// SetLabels Replaces the labels of the VM and reindexes it
+func (p *VMPool) SetLabels(vmID string, labels map[string]string) error {
+	vm, err := p.GetVM(vmID)
+	if err != nil {
+		return err
+	}
+
+	copied := make(map[string]string, len(labels))
+	for k, v := range labels {
+		copied[k] = v
+	}
+
+	vm.labelsMu.Lock()
+	defer vm.labelsMu.Unlock()
+
+	// The VM may have been freed in the meantime
+	if !p.HasVM(vmID) {
+		return NonExistErr("VM " + vmID)
+	}
+
+	p.index.remove(vmID, vm.labels)
+	vm.labels = copied
+	p.index.add(vmID, copied)
+
+	return nil
+}
+
+// Query Returns the VMs matching the query sorted by ID, label constraints are
+// resolved with the index so that only the matching VMs are visited
+func (p *VMPool) Query(q VMQuery) []*VM {
+	var candidates []*VM
+
+	if selector := q.selector(); len(selector) == 0 {
+		p.vmMap.Range(func(_, value interface{}) bool {
+			candidates = append(candidates, value.(*VM))
+			return true
+		})
+	} else {
+		for _, vmID := range p.index.lookup(selector) {
+			if vm, ok := p.vmMap.Load(vmID); ok {
+				candidates = append(candidates, vm.(*VM))
+			}
+		}
+	}
+
+	vms := candidates[:0]
+	for _, vm := range candidates {
+		if q.State == "" || vm.GetState() == q.State {
+			vms = append(vms, vm)
+		}
+	}
+
+	sort.Slice(vms, func(i, j int) bool { return vms[i].ID < vms[j].ID })
+
+	return vms
+}
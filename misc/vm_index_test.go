@@ -0,0 +1,76 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package misc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func vmIDs(vms []*VM) []string {
+	ids := make([]string, 0, len(vms))
+	for _, vm := range vms {
+		ids = append(ids, vm.ID)
+	}
+	return ids
+}
+
+func TestVMQuery(t *testing.T) {
+	p := newTestPool(Capacity{}, AdmissionReject, 0)
+
+	labels := map[string]map[string]string{
+		"1": {LabelImage: "hello", LabelPodNamespace: "default", "serving.knative.dev/revision": "hello-1"},
+		"2": {LabelImage: "hello", LabelPodNamespace: "default", "serving.knative.dev/revision": "hello-2"},
+		"3": {LabelImage: "world", LabelPodNamespace: "prod"},
+	}
+	for _, vmID := range []string{"1", "2", "3"} {
+		_, err := p.Allocate(vmID, "")
+		require.NoError(t, err, "Failed to allocate VM")
+		require.NoError(t, p.SetLabels(vmID, labels[vmID]), "Failed to set labels")
+	}
+
+	vm, err := p.GetVM("2")
+	require.NoError(t, err)
+	_, err = vm.Transition(VMRunning)
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"1", "2", "3"}, vmIDs(p.Query(VMQuery{})))
+	require.Equal(t, []string{"1", "2"}, vmIDs(p.Query(VMQuery{Image: "hello"})))
+	require.Equal(t, []string{"3"}, vmIDs(p.Query(VMQuery{Namespace: "prod"})))
+	require.Equal(t, []string{"2"}, vmIDs(p.Query(VMQuery{Image: "hello", State: VMRunning})))
+	require.Equal(t, []string{"1"}, vmIDs(p.Query(VMQuery{
+		Namespace: "default",
+		Selector:  map[string]string{"serving.knative.dev/revision": "hello-1"},
+	})))
+	require.Empty(t, p.Query(VMQuery{Image: "world", Namespace: "default"}))
+
+	// Relabeling moves the VM in the index
+	require.NoError(t, p.SetLabels("1", map[string]string{LabelImage: "world"}))
+	require.Equal(t, []string{"1", "3"}, vmIDs(p.Query(VMQuery{Image: "world"})))
+	require.Equal(t, []string{"2"}, vmIDs(p.Query(VMQuery{Namespace: "default"})))
+
+	require.NoError(t, p.Free("3"), "Failed to free VM")
+	require.Equal(t, []string{"1"}, vmIDs(p.Query(VMQuery{Image: "world"})))
+	require.NotContains(t, p.index.byLabel[LabelPodNamespace], "prod", "Freed VM left in the index")
+}
@@ -0,0 +1,102 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package misc
+
+import (
+	"time"
+
+	"github.com/Kingdo777/puffer/taps"
+)
+
+// VMOption Options to pass to a VM when it is allocated
+type VMOption func(*VM)
+
+// WithLimits Sets the I/O rate limits of the VM
+func WithLimits(limits *VMLimits) VMOption {
+	return func(vm *VM) {
+		vm.Limits = limits
+	}
+}
+
+// WithPodNetNS Creates the network interface of the VM with CNI in the given pod
+// network namespace, instead of on a tap manager bridge
+func WithPodNetNS(netNSPath string) VMOption {
+	return func(vm *VM) {
+		vm.PodNetNSPath = netNSPath
+	}
+}
+
+// WithResources Sets the vCPUs and memory of the VM
+func WithResources(vcpus, memSizeMib uint32) VMOption {
+	return func(vm *VM) {
+		vm.VCPUs = vcpus
+		vm.MemSizeMib = memSizeMib
+	}
+}
+
+// WithRestartPolicy Sets how the VM is recovered when its task fails
+func WithRestartPolicy(policy RestartPolicy) VMOption {
+	return func(vm *VM) {
+		vm.RestartPolicy = policy
+	}
+}
+
+// WithReadinessProbe Waits for the function in the guest to pass the probe whenever
+// the VM is started or restored
+func WithReadinessProbe(probe *ReadinessProbe) VMOption {
+	return func(vm *VM) {
+		vm.Readiness = probe
+	}
+}
+
+// WithTapManagerOptions Sets the options of the tap manager of the pool
+func WithTapManagerOptions(tapOpts ...taps.TapManagerOption) VMPoolOption {
+	return func(p *VMPool) {
+		p.tapOpts = append(p.tapOpts, tapOpts...)
+	}
+}
+
+// WithCNIManager Enables CNI-driven network interfaces for VMs with a pod network namespace
+func WithCNIManager(cniManager *taps.CNIManager) VMPoolOption {
+	return func(p *VMPool) {
+		p.cniManager = cniManager
+	}
+}
+
+// WithCapacity Limits the resources committed to the VMs of the pool, a VM that does
+// not fit is handled according to the policy. Queued VMs wait up to queueTimeout
+func WithCapacity(limits Capacity, policy AdmissionPolicy, queueTimeout time.Duration) VMPoolOption {
+	return func(p *VMPool) {
+		p.admission.limits = limits
+		p.admission.policy = policy
+		p.admission.queueTimeout = queueTimeout
+	}
+}
+
+// WithEvictor Sets how idle VMs are stopped under the AdmissionEvict policy,
+// the evictor is expected to free the VM from the pool
+func WithEvictor(evictor func(vmID string) error) VMPoolOption {
+	return func(p *VMPool) {
+		p.evictor = evictor
+	}
+}
@@ -23,36 +23,69 @@
 package misc
 
 import (
+	"errors"
+
+	"github.com/containerd/containerd"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/Kingdo777/puffer/taps"
 )
 
 // NewVMPool Initializes a pool of VMs
-func NewVMPool() *VMPool {
+func NewVMPool(opts ...VMPoolOption) *VMPool {
 	p := new(VMPool)
-	p.tapManager = taps.NewTapManager()
+	p.admission.policy = AdmissionReject
+	p.admission.released = make(chan struct{})
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	p.tapManager = taps.NewTapManager(p.tapOpts...)
 
 	return p
 }
 
 // Allocate Initializes a VM, activates it and then adds it to VM map
-func (p *VMPool) Allocate(vmID, hostIface string) (*VM, error) {
+func (p *VMPool) Allocate(vmID, hostIface string, opts ...VMOption) (*VM, error) {
 
 	logger := log.WithFields(log.Fields{"vmID": vmID})
 
 	logger.Debug("Allocating a VM instance")
 
 	if _, isPresent := p.vmMap.Load(vmID); isPresent {
-		logger.Panic("Allocate (VM): VM exists in the map")
+		logger.Error("Allocate (VM): VM exists in the map")
+		return nil, AlreadyExistsErr("VM " + vmID)
 	}
 
 	vm := NewVM(vmID)
+	for _, opt := range opts {
+		opt(vm)
+	}
+
+	if vm.PodNetNSPath != "" && p.cniManager == nil {
+		logger.Error("VM requests a pod network namespace but CNI is not enabled")
+		return nil, errors.New("CNI is not enabled")
+	}
+
+	if err := p.admit(vm, computeOf(vm)); err != nil {
+		return nil, err
+	}
 
 	var err error
-	vm.Ni, err = p.tapManager.AddTap(vmID+"_tap", hostIface)
+	if vm.PodNetNSPath != "" {
+		vm.Ni, err = p.cniManager.AddInterface(vmID, vm.PodNetNSPath)
+	} else {
+		vm.Ni, vm.TapPoolHit, err = p.tapManager.ClaimTap(vmID, hostIface)
+	}
 	if err != nil {
 		logger.Warn("Ni allocation failed")
+		if vm.PodNetNSPath == "" {
+			_ = p.tapManager.ReleaseTapName(vmID)
+		}
+		p.releaseAll(vm)
+		if errors.Is(err, taps.ErrCapacityExhausted) {
+			return nil, CapacityExhaustedErr("Tap capacity")
+		}
 		return nil, err
 	}
 
@@ -61,24 +94,47 @@ func (p *VMPool) Allocate(vmID, hostIface string) (*VM, error) {
 	return vm, nil
 }
 
-// Free Removes a VM from the pool and transitions it to Deactivating
+// Free Removes a VM from the pool and releases its network, the VM has to be stopped first
 func (p *VMPool) Free(vmID string) error {
 	logger := log.WithFields(log.Fields{"vmID": vmID})
 
 	logger.Debug("Freeing a VM instance")
 
-	_, isPresent := p.vmMap.Load(vmID)
+	vm, isPresent := p.vmMap.Load(vmID)
 	if !isPresent {
 		logger.Warn("VM does not exist in the map")
 		return nil
 	}
 
-	if err := p.tapManager.RemoveTap(vmID + "_tap"); err != nil {
-		logger.Error("Could not delete tap")
+	if err := p.RemovePortMappings(vmID); err != nil {
+		logger.Error("Could not remove published ports")
 		return err
 	}
 
+	if podNetNSPath := vm.(*VM).PodNetNSPath; podNetNSPath != "" {
+		if err := p.cniManager.RemoveInterface(vmID, podNetNSPath); err != nil {
+			logger.Error("Could not delete CNI interface")
+			return err
+		}
+	} else {
+		if err := p.tapManager.RemoveTap(vm.(*VM).Ni.HostDevName); err != nil {
+			logger.Error("Could not delete tap")
+			return err
+		}
+
+		p.tapManager.ReleaseTap(vm.(*VM).Ni.HostDevName)
+
+		if err := p.tapManager.ReleaseTapName(vmID); err != nil {
+			logger.Warn("Could not release tap name")
+		}
+	}
+
+	p.releaseAll(vm.(*VM))
+
+	vm.(*VM).labelsMu.Lock()
+	p.index.remove(vmID, vm.(*VM).labels)
 	p.vmMap.Delete(vmID)
+	vm.(*VM).labelsMu.Unlock()
 
 	return nil
 }
@@ -89,18 +145,33 @@ func (p *VMPool) RecreateTap(vmID, hostIface string) error {
 
 	logger.Debug("Recreating tap")
 
-	_, isPresent := p.vmMap.Load(vmID)
+	vm, isPresent := p.vmMap.Load(vmID)
 	if !isPresent {
-		log.WithFields(log.Fields{"vmID": vmID}).Panic("RecreateTap: VM does not exist in the map")
-		return NonExistErr("RecreateTap: VM does not exist when recreating its tap")
+		logger.Error("RecreateTap: VM does not exist in the map")
+		return NonExistErr("VM " + vmID)
+	}
+
+	if vm.(*VM).PodNetNSPath != "" {
+		// CNI interfaces belong to the pod and are not recreated
+		logger.Error("Cannot recreate the tap of a VM in a pod network namespace")
+		return errors.New("cannot recreate the tap of a VM in a pod network namespace")
+	}
+
+	tapName := vm.(*VM).Ni.HostDevName
+
+	// The counters of the tap are lost with it
+	if stats, err := p.tapManager.GetLinkStats(vm.(*VM).Ni); err == nil {
+		vm.(*VM).NetStats.Add(stats)
+	} else {
+		logger.WithError(err).Warn("Failed to read tap statistics")
 	}
 
-	if err := p.tapManager.RemoveTap(vmID + "_tap"); err != nil {
+	if err := p.tapManager.RemoveTap(tapName); err != nil {
 		logger.Error("Failed to delete tap")
 		return err
 	}
 
-	_, err := p.tapManager.AddTap(vmID+"_tap", hostIface)
+	_, err := p.tapManager.AddTap(tapName, hostIface)
 	if err != nil {
 		logger.Error("Failed to add tap")
 		return err
@@ -109,6 +180,118 @@ func (p *VMPool) RecreateTap(vmID, hostIface string) error {
 	return nil
 }
 
+// ReleaseNetwork Removes the tap of an offloaded VM and frees its address, the VM keeps
+// its network interface as the identity of its snapshot, see RestoreNetwork
+func (p *VMPool) ReleaseNetwork(vmID string) error {
+	logger := log.WithFields(log.Fields{"vmID": vmID})
+
+	logger.Debug("Releasing network of VM")
+
+	vm, err := p.GetVM(vmID)
+	if err != nil {
+		return err
+	}
+
+	if vm.PodNetNSPath != "" {
+		return errors.New("cannot release the network of a VM in a pod network namespace")
+	}
+
+	if stats, err := p.tapManager.GetLinkStats(vm.Ni); err == nil {
+		vm.NetStats.Add(stats)
+	} else {
+		logger.WithError(err).Warn("Failed to read tap statistics")
+	}
+
+	if err := p.tapManager.RemoveTap(vm.Ni.HostDevName); err != nil {
+		logger.Error("Failed to delete tap")
+		return err
+	}
+
+	p.tapManager.ReleaseTap(vm.Ni.HostDevName)
+
+	return nil
+}
+
+// RestoreNetwork Recreates the tap of a VM with released network on a fresh address,
+// remapped to the identity of the snapshot of the VM
+func (p *VMPool) RestoreNetwork(vmID, hostIface string) error {
+	vm, err := p.GetVM(vmID)
+	if err != nil {
+		return err
+	}
+
+	ni, err := p.tapManager.RestoreTap(vm.Ni, hostIface)
+	if err != nil {
+		log.WithFields(log.Fields{"vmID": vmID}).Error("Failed to restore tap")
+		return err
+	}
+
+	vm.Ni = ni
+
+	return nil
+}
+
+// GetIdentityRemapping Returns whether offloaded VMs release their network
+func (p *VMPool) GetIdentityRemapping() bool {
+	return p.tapManager.GetIdentityRemapping()
+}
+
+// GetNetStats Returns the traffic counters of the VM, accumulated over all its taps
+func (p *VMPool) GetNetStats(vmID string) (taps.LinkStats, error) {
+	vm, err := p.GetVM(vmID)
+	if err != nil {
+		return taps.LinkStats{}, err
+	}
+
+	stats := vm.NetStats
+
+	current, err := p.tapManager.GetLinkStats(vm.Ni)
+	if err != nil {
+		return taps.LinkStats{}, err
+	}
+	stats.Add(current)
+
+	return stats, nil
+}
+
+// AddPortMapping Publishes a guest port of the VM on a host port
+func (p *VMPool) AddPortMapping(vmID string, m taps.PortMapping) error {
+	vm, err := p.GetVM(vmID)
+	if err != nil {
+		return err
+	}
+
+	if vm.PodNetNSPath != "" {
+		return errors.New("ports of VMs in a pod network namespace are published by CNI")
+	}
+
+	return p.tapManager.AddPortMapping(vm.Ni.HostDevName, m)
+}
+
+// RemovePortMappings Removes all published ports of the VM
+func (p *VMPool) RemovePortMappings(vmID string) error {
+	vm, err := p.GetVM(vmID)
+	if err != nil {
+		return err
+	}
+
+	if vm.PodNetNSPath != "" {
+		return nil
+	}
+
+	return p.tapManager.RemovePortMappings(vm.Ni.HostDevName)
+}
+
+// GetPortMappings Returns the published ports of the VM
+func (p *VMPool) GetPortMappings(vmID string) ([]taps.PortMapping, error) {
+	vm, err := p.GetVM(vmID)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.tapManager.GetPortMappings(vm.Ni.HostDevName), nil
+}
+
 // GetVMMap Returns a copy of vmMap as a regular concurrency-unsafe map
 func (p *VMPool) GetVMMap() map[string]*VM {
 	m := make(map[string]*VM)
@@ -125,12 +308,143 @@ func (p *VMPool) GetVM(vmID string) (*VM, error) {
 	vm, found := p.vmMap.Load(vmID)
 	if !found {
 		log.WithFields(log.Fields{"vmID": vmID}).Error("VM is not in the VM map")
-		return nil, NonExistErr("GetVM: VM is not in the VM map")
+		return nil, NonExistErr("VM " + vmID)
 	}
 
 	return vm.(*VM), nil
 }
 
+// Adopt Adds a running VM of a previous run to the pool. Its persisted tap is taken
+// over and its resources are committed even if they exceed the capacity limits
+func (p *VMPool) Adopt(vmID string, container containerd.Container, task containerd.Task, opts ...VMOption) (*VM, error) {
+	logger := log.WithFields(log.Fields{"vmID": vmID})
+
+	if p.HasVM(vmID) {
+		return nil, AlreadyExistsErr("VM " + vmID)
+	}
+
+	ni, err := p.tapManager.AdoptTap(vmID)
+	if err != nil {
+		logger.WithError(err).Error("Failed to adopt tap")
+		return nil, err
+	}
+
+	vm := NewVM(vmID)
+	for _, opt := range opts {
+		opt(vm)
+	}
+	vm.Ni = ni
+	vm.Container = &container
+	vm.Task = &task
+	if _, err := vm.Transition(VMRunning); err != nil {
+		return nil, err
+	}
+
+	if _, loaded := p.vmMap.LoadOrStore(vmID, vm); loaded {
+		p.tapManager.ReleaseTap(ni.HostDevName)
+		return nil, AlreadyExistsErr("VM " + vmID)
+	}
+
+	p.admission.mu.Lock()
+	p.admission.used.add(computeOf(vm))
+	vm.committed.add(computeOf(vm))
+	p.admission.mu.Unlock()
+
+	logger.Info("Adopted VM")
+
+	return vm, nil
+}
+
+// AdoptOffloaded Adds an offloaded VM of a previous run to the pool, with its persisted tap
+// and the disk of its snapshot committed. The VM has no task until it is restored
+func (p *VMPool) AdoptOffloaded(vmID string, container containerd.Container, snapshotBytes uint64, opts ...VMOption) (*VM, error) {
+	logger := log.WithFields(log.Fields{"vmID": vmID})
+
+	if p.HasVM(vmID) {
+		return nil, AlreadyExistsErr("VM " + vmID)
+	}
+
+	ni, err := p.tapManager.AdoptTap(vmID)
+	if err != nil {
+		logger.WithError(err).Error("Failed to adopt tap")
+		return nil, err
+	}
+
+	vm := NewVM(vmID)
+	for _, opt := range opts {
+		opt(vm)
+	}
+	vm.Ni = ni
+	vm.Container = &container
+	vm.stateMu.Lock()
+	vm.setState(VMSnapshotted)
+	vm.setState(VMOffloaded)
+	vm.stateMu.Unlock()
+
+	if _, loaded := p.vmMap.LoadOrStore(vmID, vm); loaded {
+		p.tapManager.ReleaseTap(ni.HostDevName)
+		return nil, AlreadyExistsErr("VM " + vmID)
+	}
+
+	p.admission.mu.Lock()
+	p.admission.used.add(Capacity{SnapshotBytes: snapshotBytes})
+	vm.committed.add(Capacity{SnapshotBytes: snapshotBytes})
+	p.admission.mu.Unlock()
+
+	// An offloaded VM holds no address with identity remapping, see ReleaseNetwork
+	if p.GetIdentityRemapping() {
+		if err := p.ReleaseNetwork(vmID); err != nil {
+			logger.WithError(err).Warn("Failed to release the network of the offloaded VM")
+		}
+	}
+
+	logger.Info("Adopted offloaded VM")
+
+	return vm, nil
+}
+
+// ListTapVMs Returns the VMs with a persisted tap, including VMs that are not in the pool
+func (p *VMPool) ListTapVMs() []string {
+	return p.tapManager.ListTapVMs()
+}
+
+// RemoveUnknownTaps Removes the puffer taps on the host the pool has no record of
+func (p *VMPool) RemoveUnknownTaps() ([]string, error) {
+	return p.tapManager.RemoveUnknownTaps()
+}
+
+// ListUnknownTaps Returns the puffer taps on the host the pool has no record of
+func (p *VMPool) ListUnknownTaps() ([]string, error) {
+	return p.tapManager.ListUnknownTaps()
+}
+
+// RemoveUnknownTap Removes a puffer tap on the host the pool has no record of
+func (p *VMPool) RemoveUnknownTap(tapName string) error {
+	if _, ok := p.tapManager.GetVMID(tapName); ok {
+		return errors.New("tap " + tapName + " belongs to a VM")
+	}
+
+	return p.tapManager.RemoveTap(tapName)
+}
+
+// RemoveStaleNetwork Removes the network interface of a VM of a previous run that is not in the pool
+func (p *VMPool) RemoveStaleNetwork(vmID, podNetNSPath string) error {
+	if podNetNSPath != "" {
+		if p.cniManager == nil {
+			return errors.New("CNI is not enabled")
+		}
+		return p.cniManager.RemoveInterface(vmID, podNetNSPath)
+	}
+
+	return p.tapManager.RemoveStaleTap(vmID)
+}
+
+// HasVM Returns whether the VM is in the pool
+func (p *VMPool) HasVM(vmID string) bool {
+	_, found := p.vmMap.Load(vmID)
+	return found
+}
+
 // RemoveBridges Removes the bridges created by the tap manager
 func (p *VMPool) RemoveBridges() {
 	p.tapManager.RemoveBridges()
@@ -0,0 +1,138 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package misc
+
+import (
+	"time"
+)
+
+// VMState Lifecycle state of a VM
+type VMState string
+
+const (
+	// VMStarting The VM is allocated and being created
+	VMStarting VMState = "Starting"
+	// VMRunning The VM is running its function
+	VMRunning VMState = "Running"
+	// VMPaused The VM is paused
+	VMPaused VMState = "Paused"
+	// VMSnapshotted The VM is paused and a snapshot of it was taken
+	VMSnapshotted VMState = "Snapshotted"
+	// VMOffloading The VM is being shut down to be restored from its snapshot later
+	VMOffloading VMState = "Offloading"
+	// VMOffloaded Only the snapshot of the VM is left
+	VMOffloaded VMState = "Offloaded"
+	// VMRestoring The VM is being restored from its snapshot
+	VMRestoring VMState = "Restoring"
+	// VMFailed The task of the VM exited while it was running, or a stop failed after killing it
+	VMFailed VMState = "Failed"
+	// VMStopping The VM is being shut down for good
+	VMStopping VMState = "Stopping"
+	// VMStopped The VM is shut down and removed from the pool
+	VMStopped VMState = "Stopped"
+)
+
+// vmTransitions Legal transitions of the VM lifecycle
+var vmTransitions = map[VMState][]VMState{
+	VMStarting:    {VMRunning, VMStopping},
+	VMRunning:     {VMPaused, VMOffloading, VMFailed, VMStopping},
+	VMPaused:      {VMRunning, VMSnapshotted, VMOffloading, VMStopping},
+	VMSnapshotted: {VMRunning, VMOffloading, VMStopping},
+	VMOffloading:  {VMOffloaded},
+	VMOffloaded:   {VMRestoring, VMStopping},
+	VMRestoring:   {VMRunning},
+	VMFailed:      {VMRunning, VMOffloading, VMStopping},
+	VMStopping:    {VMStopped},
+}
+
+// canTransition Returns whether the lifecycle allows going from one state to another
+func canTransition(from, to VMState) bool {
+	for _, next := range vmTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetState Returns the lifecycle state of the VM
+func (vm *VM) GetState() VMState {
+	vm.stateMu.Lock()
+	defer vm.stateMu.Unlock()
+
+	return vm.state
+}
+
+// Transition Moves the VM to a new state and returns the state it was in, an illegal
+// transition leaves the state unchanged and returns an InvalidTransitionErr
+func (vm *VM) Transition(to VMState) (VMState, error) {
+	vm.stateMu.Lock()
+	defer vm.stateMu.Unlock()
+
+	from := vm.state
+	if !canTransition(from, to) {
+		return from, &InvalidTransitionErr{VMID: vm.ID, From: from, To: to}
+	}
+
+	vm.setState(to)
+
+	return from, nil
+}
+
+// Rollback Moves the VM out of the transient state of a failed operation, back to the
+// state it was in, or to VMFailed if the operation left the VM without a task
+func (vm *VM) Rollback(from VMState) {
+	vm.stateMu.Lock()
+	defer vm.stateMu.Unlock()
+
+	vm.setState(from)
+}
+
+// setState Sets the state and records when it was entered, the lock has to be held
+func (vm *VM) setState(state VMState) {
+	vm.state = state
+	vm.stateTimes[state] = time.Now()
+}
+
+// GetStateTimes Returns when the VM last entered each of the states it has been in
+func (vm *VM) GetStateTimes() map[VMState]time.Time {
+	vm.stateMu.Lock()
+	defer vm.stateMu.Unlock()
+
+	times := make(map[VMState]time.Time, len(vm.stateTimes))
+	for state, t := range vm.stateTimes {
+		times[state] = t
+	}
+
+	return times
+}
+
+// HasSnapshot Returns whether a snapshot of the VM was taken
+func (vm *VM) HasSnapshot() bool {
+	vm.stateMu.Lock()
+	defer vm.stateMu.Unlock()
+
+	_, ok := vm.stateTimes[VMSnapshotted]
+	return ok
+}
@@ -0,0 +1,69 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package misc
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVMLifecycle(t *testing.T) {
+	vm := NewVM("1")
+	require.Equal(t, VMStarting, vm.GetState())
+
+	for _, state := range []VMState{VMRunning, VMPaused, VMSnapshotted, VMOffloading, VMOffloaded, VMRestoring, VMRunning} {
+		_, err := vm.Transition(state)
+		require.NoError(t, err, "Failed to transition to %s", state)
+	}
+
+	require.True(t, vm.HasSnapshot())
+	require.Len(t, vm.GetStateTimes(), 7)
+}
+
+func TestVMInvalidTransition(t *testing.T) {
+	vm := NewVM("1")
+
+	_, err := vm.Transition(VMOffloaded)
+
+	var transitionErr *InvalidTransitionErr
+	require.True(t, errors.As(err, &transitionErr), "Expected an InvalidTransitionErr")
+	require.Equal(t, VMStarting, transitionErr.From)
+	require.Equal(t, VMOffloaded, transitionErr.To)
+	require.Equal(t, VMStarting, vm.GetState(), "Invalid transition changed the state")
+}
+
+func TestVMRollback(t *testing.T) {
+	vm := NewVM("1")
+
+	_, err := vm.Transition(VMRunning)
+	require.NoError(t, err)
+
+	prevState, err := vm.Transition(VMStopping)
+	require.NoError(t, err)
+	require.Equal(t, VMRunning, prevState)
+
+	vm.Rollback(prevState)
+	require.Equal(t, VMRunning, vm.GetState())
+}
@@ -27,18 +27,28 @@ import (
 	"github.com/Kingdo777/puffer/cri"
 	fccri "github.com/Kingdo777/puffer/cri/firecracker"
 	"github.com/Kingdo777/puffer/ctriface"
+	"github.com/Kingdo777/puffer/misc"
 	ctrdlog "github.com/containerd/containerd/log"
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 	"net"
 	"os"
+	"strings"
+	"time"
 )
 
 var (
 	orch *ctriface.Orchestrator
 
-	criSock   *string
-	hostIface *string
+	criSock          *string
+	hostIface        *string
+	rateLimitClasses *string
+	readinessProbe   *string
+	readinessPath    *string
+	readinessTimeout *time.Duration
+	runtimeHandlers  *string
+	knativeNames     *bool
+	streamAddr       *string
 )
 
 func main() {
@@ -47,6 +57,38 @@ func main() {
 
 	criSock = flag.String("criSock", "/run/puffer/puffer.sock", "Socket address for CRI service")
 	hostIface = flag.String("hostIface", "", "Host net-interface for the VMs to bind to for internet access")
+	rateLimitClasses = flag.String("rateLimitClasses", "", "JSON file with the rate limit classes that pods can select")
+	readinessProbe = flag.String("readinessProbe", "tcp", "How the guest port is checked before a started or restored VM is handed out unless its pod selects a probe, valid options: tcp, http, grpc, none")
+	readinessPath = flag.String("readinessPath", "", "Path of the HTTP readiness probe, or service of the gRPC health check")
+	readinessTimeout = flag.Duration("readinessTimeout", 30*time.Second, "How long a guest has to pass its readiness probe")
+	runtimeHandlers = flag.String("runtimeHandlers", "", "Comma-separated runtime handlers (RuntimeClasses) of pods that get a microVM, the stock runtime has to know them too")
+	streamAddr = flag.String("streamAddr", "127.0.0.1:0", "Address of the stream server of kubectl exec into guests, empty disables it")
+	knativeNames = flag.Bool("knativeNames", true, "Give a microVM to containers named user-container, paired with queue-proxy, in pods that do not select it otherwise")
+	netnsIsolation := flag.Bool("netnsIsolation", false, "Place the tap of every VM in its own network namespace")
+	identityRemapping := flag.Bool("identityRemapping", false, "Restore snapshots onto fresh addresses with NAT, implies netnsIsolation")
+	guestToGuest := flag.Bool("guestToGuest", false, "Allow guest-to-guest traffic when network namespaces are isolated")
+	jailerUID := flag.Uint("jailerUID", 0, "User ID the firecracker jailer runs VMs as, required for netns isolation and CNI")
+	jailerGID := flag.Uint("jailerGID", 0, "Group ID the firecracker jailer runs VMs as, required for netns isolation and CNI")
+	cniConfList := flag.String("cniConfList", "", "CNI network config list to network VMs in their pod network namespace, e.g. a chain ending with tc-redirect-tap")
+	cniBinDir := flag.String("cniBinDir", "/opt/cni/bin", "Directory of the CNI plugin binaries")
+	dualStack := flag.Bool("dualStack", false, "Give every VM an IPv6 address next to its IPv4 address, the VM root filesystem needs /sbin/ip")
+	tapPoolLow := flag.Int("tapPoolLow", 0, "Refill the pool of ready taps once no more than this many are left")
+	tapPoolHigh := flag.Int("tapPoolHigh", 0, "Number of ready taps to refill the tap pool to, 0 disables the pool")
+	dryRunNet := flag.Bool("dryRunNet", false, "Record taps, bridges and rules in memory instead of creating them, firecracker-containerd is still required")
+	maxVCPUs := flag.Uint64("maxVCPUs", 0, "vCPUs of running and paused VMs on the node, 0 is unlimited")
+	maxMemMib := flag.Uint64("maxMemMib", 0, "Memory in MiB of running and paused VMs on the node, 0 is unlimited")
+	maxSnapshotMib := flag.Uint64("maxSnapshotMib", 0, "Disk in MiB held by VM snapshots on the node, 0 is unlimited")
+	admissionPolicy := flag.String("admissionPolicy", "reject", "What to do with a VM exceeding the node capacity, valid options: queue, reject, evict")
+	admissionTimeout := flag.Duration("admissionTimeout", 30*time.Second, "How long a VM waits for capacity with the queue admission policy")
+	journal := flag.String("journal", "/var/lib/puffer/journal", "Journal of in-flight VM operations to recover after a crash, empty disables it")
+	restartPolicy := flag.String("restartPolicy", "fail", "How a VM whose task fails is recovered unless its pod selects a policy, valid options: restart, replace, fail")
+	maxRestarts := flag.Int("maxRestarts", 3, "How many times a VM is recovered before it is left failed")
+	stopGracePeriod := flag.Duration("stopGracePeriod", 5*time.Second, "How long a VM's task has to exit after SIGTERM when stopped without a CRI timeout")
+	gcInterval := flag.Duration("gcInterval", 0, "Period of the collection of orphaned VMs, taps and snapshot directories, 0 disables it")
+	gcGracePeriod := flag.Duration("gcGracePeriod", 10*time.Minute, "How long a resource stays orphaned before the collection removes it")
+	gcAuditLog := flag.String("gcAuditLog", "/var/lib/puffer/gc-audit.log", "Audit log of the resources removed by the collection, empty only logs them")
+	adoptVMs := flag.Bool("adoptVMs", false, "Adopt the running VMs of a previous run instead of stopping them, adopted VMs are only stopped by the collection, see -gcInterval")
+	reconcileInterval := flag.Duration("reconcileInterval", 5*time.Minute, "Period of the reconciliation with firecracker-containerd after startup, 0 only reconciles at startup")
 	sandbox := flag.String("sandbox", "firecracker", "Sandbox tech to use, valid options: firecracker, gvisor")
 	flag.Parse()
 
@@ -55,6 +97,21 @@ func main() {
 		return
 	}
 
+	switch misc.AdmissionPolicy(*admissionPolicy) {
+	case misc.AdmissionQueue, misc.AdmissionReject, misc.AdmissionEvict:
+	default:
+		log.Fatalf("Unknown admission policy %q", *admissionPolicy)
+	}
+
+	vmRestartPolicy, err := misc.ParseRestartPolicy(*restartPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := misc.ParseProbeType(*readinessProbe); err != nil {
+		log.Fatal(err)
+	}
+
 	log.SetFormatter(&log.TextFormatter{
 		TimestampFormat: ctrdlog.RFC3339NanoFixed,
 		FullTimestamp:   true,
@@ -72,10 +129,44 @@ func main() {
 
 	switch *sandbox {
 	case "firecracker":
+		orchOpts := []ctriface.OrchestratorOption{
+			ctriface.WithSnapshots(true),
+		}
+		if *cniConfList != "" {
+			orchOpts = append(orchOpts, ctriface.WithCNI(*cniConfList, []string{*cniBinDir}))
+		}
+		if *netnsIsolation || *identityRemapping || *cniConfList != "" {
+			orchOpts = append(orchOpts, ctriface.WithJailerIDs(uint32(*jailerUID), uint32(*jailerGID)))
+		}
+		if *netnsIsolation {
+			orchOpts = append(orchOpts, ctriface.WithNetNSIsolation(*guestToGuest))
+		}
+		if *identityRemapping {
+			orchOpts = append(orchOpts, ctriface.WithIdentityRemapping())
+		}
+		if *dualStack {
+			orchOpts = append(orchOpts, ctriface.WithDualStack())
+		}
+		if *dryRunNet {
+			orchOpts = append(orchOpts, ctriface.WithDryRunNetwork())
+		}
+		if *tapPoolHigh > 0 {
+			orchOpts = append(orchOpts, ctriface.WithTapPool(*tapPoolLow, *tapPoolHigh))
+		}
+		orchOpts = append(orchOpts, ctriface.WithCapacity(misc.Capacity{
+			VCPUs:         *maxVCPUs,
+			MemSizeMib:    *maxMemMib,
+			SnapshotBytes: *maxSnapshotMib << 20,
+		}, misc.AdmissionPolicy(*admissionPolicy), *admissionTimeout))
+		orchOpts = append(orchOpts, ctriface.WithJournal(*journal), ctriface.WithReconcileInterval(*reconcileInterval))
+		orchOpts = append(orchOpts, ctriface.WithAdoption(*adoptVMs))
+		orchOpts = append(orchOpts, ctriface.WithStopGracePeriod(*stopGracePeriod))
+		orchOpts = append(orchOpts, ctriface.WithRestartPolicy(vmRestartPolicy, *maxRestarts))
+		orchOpts = append(orchOpts, ctriface.WithGC(*gcInterval, *gcGracePeriod, *gcAuditLog))
 		orch = ctriface.NewOrchestrator(
 			*snapshotter,
 			*hostIface,
-			ctriface.WithSnapshots(true),
+			orchOpts...,
 		)
 		setupFirecrackerCRI()
 	}
@@ -89,7 +180,23 @@ func setupFirecrackerCRI() {
 
 	s := grpc.NewServer()
 
-	fcService, err := fccri.NewFirecrackerService(orch)
+	fcOpts := []fccri.ServiceOption{
+		fccri.WithReadinessProbe(misc.ProbeType(*readinessProbe), *readinessPath, *readinessTimeout),
+		fccri.WithKnativeNames(*knativeNames),
+		fccri.WithStreamServer(*streamAddr),
+	}
+	if *runtimeHandlers != "" {
+		fcOpts = append(fcOpts, fccri.WithRuntimeHandlers(strings.Split(*runtimeHandlers, ",")...))
+	}
+	if *rateLimitClasses != "" {
+		classes, err := fccri.LoadRateLimitClasses(*rateLimitClasses)
+		if err != nil {
+			log.Fatalf("failed to load rate limit classes %v", err)
+		}
+		fcOpts = append(fcOpts, fccri.WithRateLimitClasses(classes))
+	}
+
+	fcService, err := fccri.NewFirecrackerService(orch, fcOpts...)
 	if err != nil {
 		log.Fatalf("failed to create firecracker service %v", err)
 	}
@@ -21,8 +21,9 @@ echo -e "\e[31mCleaning Kubernetes...\e[0m"
 
 echo -e "\e[31mCleaning Puffer...\e[0m"
 sudo pkill -9 puffer
-ifconfig -a | grep _tap | cut -f1 -d":" | while read line; do sudo ip link delete "$line"; done
-ifconfig -a | grep tap_ | cut -f1 -d":" | while read line; do sudo ip link delete "$line"; done
+# all interfaces created by puffer (taps, veths and bridges) are prefixed with "pfr"
+ip -o link show | awk -F': ' '{print $2}' | cut -f1 -d"@" | grep '^pfr' | while read line; do sudo ip link delete "$line"; done
+ip netns list | cut -f1 -d" " | grep '^puffer-' | while read line; do sudo ip netns delete "$line"; done
 bridge -j vlan | jq -r '.[].ifname' | while read line; do sudo ip link delete "$line"; done
 sudo rm -rf /run/puffer/*
 sudo rm -rf /var/lib/puffer/*
@@ -0,0 +1,184 @@
+// MIT License
+//
+// Copyright (c) 2021 Plamen Petrov, Amory Hoste and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package taps
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// parseTapSlot Returns the position in the bridge address pools of an address
+// created by getPrimaryAddress
+func parseTapSlot(address string) (tapSlot, error) {
+	var bridgeID, hi, lo int
+	if _, err := fmt.Sscanf(address, "19%d.128.%d.%d", &bridgeID, &hi, &lo); err != nil {
+		return tapSlot{}, fmt.Errorf("address %s is not from a bridge pool: %w", address, err)
+	}
+
+	slot := hi*256 + lo - 2
+	if bridgeID < 0 || bridgeID >= MaxBridges || slot < 0 || slot >= TapsPerBridge {
+		return tapSlot{}, fmt.Errorf("address %s is out of the bridge pools", address)
+	}
+
+	return tapSlot{bridgeID: bridgeID, slot: slot}, nil
+}
+
+// ListTapVMs Returns the VMs that have a persisted tap, sorted
+func (tm *TapManager) ListTapVMs() []string {
+	tm.tapNames.Lock()
+	defer tm.tapNames.Unlock()
+
+	vmIDs := make([]string, 0, len(tm.tapNames.Taps))
+	for vmID := range tm.tapNames.Taps {
+		vmIDs = append(vmIDs, vmID)
+	}
+	sort.Strings(vmIDs)
+
+	return vmIDs
+}
+
+// AdoptTap Takes over the persisted tap of a VM of a previous run, its address is
+// reserved and the tap is recreated if it is gone. The forwarding rules of the tap
+// outlive the previous run and are left as they are
+func (tm *TapManager) AdoptTap(vmID string) (*NetworkInterface, error) {
+	rec, ok := tm.tapNames.lookup(vmID)
+	if !ok || rec.Ni == nil {
+		return nil, fmt.Errorf("VM %s has no persisted tap", vmID)
+	}
+	ni := rec.Ni
+
+	ts, err := parseTapSlot(ni.GetExternalAddress())
+	if err != nil {
+		return nil, err
+	}
+
+	logger := log.WithFields(log.Fields{"vmID": vmID, "tap": ni.HostDevName})
+	logger.Debug("Adopting tap")
+
+	tm.Lock()
+	if _, ok := tm.createdTaps[ni.HostDevName]; ok {
+		tm.Unlock()
+		return nil, fmt.Errorf("tap %s is in use", ni.HostDevName)
+	}
+
+	br, ok := tm.bridges[ts.bridgeID]
+	if !ok {
+		// The bridge device survives the previous run unless the taps are isolated
+		if tm.netNSIsolation || !tm.backend.LinkExists(getBridgeName(ts.bridgeID)) {
+			if err := tm.createBridge(ts.bridgeID); err != nil {
+				tm.Unlock()
+				return nil, err
+			}
+		}
+		br = &bridge{id: ts.bridgeID, slots: make([]bool, TapsPerBridge)}
+		tm.bridges[ts.bridgeID] = br
+	}
+
+	if br.slots[ts.slot] {
+		tm.Unlock()
+		return nil, fmt.Errorf("address %s is in use", ni.GetExternalAddress())
+	}
+	br.slots[ts.slot] = true
+	br.used++
+	tm.tapSlots[ni.HostDevName] = ts
+	tm.createdTaps[ni.HostDevName] = ni
+	tm.Unlock()
+
+	if ni.NetNSPath == "" && !tm.backend.LinkExists(ni.HostDevName) {
+		if err := tm.reconnectTap(ni.HostDevName, ni); err != nil {
+			tm.releaseTap(ni.HostDevName)
+			return nil, err
+		}
+	}
+
+	return ni, nil
+}
+
+// ListUnknownTaps Returns the taps with the puffer prefix in the root network
+// namespace that the tap manager has no record of
+func (tm *TapManager) ListUnknownTaps() ([]string, error) {
+	names, err := tm.backend.ListTaps()
+	if err != nil {
+		return nil, err
+	}
+
+	var unknown []string
+	for _, name := range names {
+		tm.tapNames.Lock()
+		_, known := tm.tapNames.byName[name]
+		tm.tapNames.Unlock()
+
+		tm.Lock()
+		_, created := tm.createdTaps[name]
+		tm.Unlock()
+
+		if !known && !created {
+			unknown = append(unknown, name)
+		}
+	}
+
+	return unknown, nil
+}
+
+// RemoveUnknownTaps Removes the taps with the puffer prefix in the root network
+// namespace that the tap manager has no record of, and returns their names
+func (tm *TapManager) RemoveUnknownTaps() ([]string, error) {
+	unknown, err := tm.ListUnknownTaps()
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, name := range unknown {
+		if err := tm.removeTap(name, nil); err != nil {
+			return removed, err
+		}
+		removed = append(removed, name)
+	}
+
+	return removed, nil
+}
+
+// ListTaps Returns the names of the taps with the puffer prefix in the root network namespace
+func (netlinkBackend) ListTaps() ([]string, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, link := range links {
+		if _, ok := link.(*netlink.Tuntap); !ok {
+			continue
+		}
+		if name := link.Attrs().Name; strings.HasPrefix(name, tapNamePrefix) {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
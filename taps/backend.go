@@ -0,0 +1,80 @@
+// MIT License
+//
+// Copyright (c) 2021 Plamen Petrov, Amory Hoste and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package taps
+
+import (
+	"github.com/google/nftables"
+)
+
+// Backend Performs the host network operations of the tap manager
+type Backend interface {
+	// CreateBridge Creates an enabled bridge holding the gateway addresses
+	CreateBridge(name string, gatewayAddrs []string) error
+	// RemoveBridge Removes a bridge
+	RemoveBridge(name string) error
+	// CreateTap Creates an enabled tap with the MAC address and connects it to the bridge
+	CreateTap(name, bridgeName, macAddress string) error
+	// RemoveTap Removes a tap from the root network namespace, a missing tap is not an error
+	RemoveTap(name string) error
+	// AddNetNSTap Creates the network namespace, veth pair, tap and routes of an isolated tap
+	AddNetNSTap(ni *NetworkInterface) error
+	// AddRemapRules Maps the primary address of an isolated tap to its external address
+	// with NAT inside the network namespace of the tap
+	AddRemapRules(ni *NetworkInterface) error
+	// RemoveNetNSTap Removes the veth pair and network namespace of an isolated tap
+	RemoveNetNSTap(ni *NetworkInterface) error
+	// LinkExists Returns whether a network interface exists in the root network namespace
+	LinkExists(name string) bool
+	// ListTaps Returns the names of the taps with the puffer prefix in the root network namespace
+	ListTaps() ([]string, error)
+	// LinkStats Returns the traffic counters of the tap of a network interface
+	LinkStats(ni *NetworkInterface) (LinkStats, error)
+	// DefaultHostIface Returns the interface of the default route of the host
+	DefaultHostIface() (string, error)
+	// AddForwardRules Accepts forwarded traffic between a link and the host interface
+	AddForwardRules(linkName, hostIface string, families []nftables.TableFamily) error
+	// RemoveForwardRules Removes the forwarding and isolation rules of a link, missing rules are not an error
+	RemoveForwardRules(linkName string) error
+	// AddIsolationRule Drops forwarded traffic from a link that is not headed to the host interface
+	AddIsolationRule(linkName, hostIface string, families []nftables.TableFamily) error
+	// AddDNATRule Rewrites the destination of traffic to a host port to the guest
+	AddDNATRule(tapName, guestIP string, m PortMapping) error
+	// RemoveDNATRules Removes all DNAT rules of a tap
+	RemoveDNATRules(tapName string) error
+}
+
+// netlinkBackend Configures the host through netlink and nftables, which requires CAP_NET_ADMIN
+type netlinkBackend struct{}
+
+// NewNetlinkBackend Creates the backend that configures the host network
+func NewNetlinkBackend() Backend {
+	return netlinkBackend{}
+}
+
+// WithBackend Sets the backend performing the host network operations,
+// the default backend configures the host through netlink and nftables
+func WithBackend(backend Backend) TapManagerOption {
+	return func(tm *TapManager) {
+		tm.backend = backend
+	}
+}
@@ -0,0 +1,180 @@
+// MIT License
+//
+// Copyright (c) 2021 Plamen Petrov, Amory Hoste and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package taps
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// bridge Address pool of a bridge, slot i holds the tap with the (i+2)-th address
+type bridge struct {
+	id    int
+	slots []bool
+	used  int
+}
+
+// tapSlot Position of a tap in the address pool of a bridge
+type tapSlot struct {
+	bridgeID int
+	slot     int
+}
+
+// allocateSlot Reserves an address for a tap on the least loaded bridge, creating
+// a new bridge if all existing bridges are full. The lock has to be held
+func (tm *TapManager) allocateSlot() (tapSlot, error) {
+	var best *bridge
+	for _, br := range tm.bridges {
+		if br.used < TapsPerBridge && (best == nil || br.used < best.used) {
+			best = br
+		}
+	}
+
+	if best == nil {
+		id := -1
+		for i := 0; i < MaxBridges; i++ {
+			if _, ok := tm.bridges[i]; !ok {
+				id = i
+				break
+			}
+		}
+		if id < 0 {
+			return tapSlot{}, fmt.Errorf("%w: no space for creating taps", ErrCapacityExhausted)
+		}
+
+		if err := tm.createBridge(id); err != nil {
+			return tapSlot{}, err
+		}
+
+		best = &bridge{id: id, slots: make([]bool, TapsPerBridge)}
+		tm.bridges[id] = best
+	}
+
+	for i, taken := range best.slots {
+		if !taken {
+			best.slots[i] = true
+			best.used++
+			return tapSlot{bridgeID: best.id, slot: i}, nil
+		}
+	}
+
+	log.Panic("Bridge is not full but has no free slot")
+	return tapSlot{}, nil
+}
+
+// releaseSlot Frees the address of a tap and removes its bridge once it is empty.
+// The lock has to be held
+func (tm *TapManager) releaseSlot(ts tapSlot) {
+	br, ok := tm.bridges[ts.bridgeID]
+	if !ok || !br.slots[ts.slot] {
+		return
+	}
+
+	br.slots[ts.slot] = false
+	br.used--
+
+	if br.used == 0 {
+		tm.removeBridge(br.id)
+		delete(tm.bridges, br.id)
+	}
+}
+
+// createBridge Creates the bridge device for a bridge ID, isolated taps have
+// an address pool but no bridge device
+func (tm *TapManager) createBridge(id int) error {
+	if tm.netNSIsolation {
+		return nil
+	}
+
+	gatewayAddrs := []string{getGatewayAddr(id) + Subnet}
+	if tm.dualStack {
+		gatewayAddrs = append(gatewayAddrs, getGatewayAddrV6(id)+SubnetV6)
+	}
+
+	return tm.backend.CreateBridge(getBridgeName(id), gatewayAddrs)
+}
+
+// removeBridge Removes the bridge device of a bridge ID
+func (tm *TapManager) removeBridge(id int) {
+	if tm.netNSIsolation {
+		return
+	}
+
+	bridgeName := getBridgeName(id)
+
+	log.WithFields(log.Fields{"bridge": bridgeName}).Debug("Removing empty bridge")
+
+	if err := tm.backend.RemoveBridge(bridgeName); err != nil {
+		log.WithFields(log.Fields{"bridge": bridgeName}).WithError(err).Error("Bridge could not be deleted")
+	}
+}
+
+// CreateBridge Creates the bridge, add the gateway addresses to it, and enables it
+func (netlinkBackend) CreateBridge(bridgeName string, gatewayAddrs []string) error {
+	logger := log.WithFields(log.Fields{"bridge": bridgeName})
+
+	logger.Debug("Creating bridge")
+
+	la := netlink.NewLinkAttrs()
+	la.Name = bridgeName
+
+	br := &netlink.Bridge{LinkAttrs: la}
+
+	if err := netlink.LinkAdd(br); err != nil {
+		logger.Error("Bridge could not be created")
+		return err
+	}
+
+	if err := netlink.LinkSetUp(br); err != nil {
+		logger.Error("Bridge could not be enabled")
+		return err
+	}
+
+	for _, bridgeAddress := range gatewayAddrs {
+		addr, err := netlink.ParseAddr(bridgeAddress)
+		if err != nil {
+			logger.Error(fmt.Sprintf("could not parse bridge address %s", bridgeAddress))
+			return err
+		}
+
+		if err := netlink.AddrAdd(br, addr); err != nil {
+			logger.Error(fmt.Sprintf("could not add %s to bridge", bridgeAddress))
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RemoveBridge Removes the bridge, the taps connected to it are detached
+func (netlinkBackend) RemoveBridge(bridgeName string) error {
+	br, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		log.WithFields(log.Fields{"bridge": bridgeName}).Warn("Could not find bridge")
+		return nil
+	}
+
+	return netlink.LinkDel(br)
+}
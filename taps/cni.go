@@ -0,0 +1,174 @@
+// MIT License
+//
+// Copyright (c) 2021 Plamen Petrov, Amory Hoste and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package taps
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	gocni "github.com/containerd/go-cni"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultCNIIfName Name of the interface CNI creates in the network namespace
+	DefaultCNIIfName = "eth1"
+	// cniTimeout Maximum time a CNI ADD or DEL may take
+	cniTimeout = 30 * time.Second
+)
+
+// CNIManager Creates VM network interfaces by calling CNI plugins in existing
+// network namespaces, e.g. the network namespace of a pod sandbox
+type CNIManager struct {
+	cni    gocni.CNI
+	ifName string
+}
+
+// NewCNIManager Creates a CNI manager that runs the network configuration list in
+// confListFile. The list has to end with a plugin that hands the interface over to
+// a tap, such as tc-redirect-tap, so that the guest gets the address CNI assigned
+func NewCNIManager(confListFile string, binDirs []string) (*CNIManager, error) {
+	cm := &CNIManager{ifName: DefaultCNIIfName}
+
+	cni, err := gocni.New(
+		gocni.WithPluginDir(binDirs),
+		gocni.WithInterfacePrefix(cm.ifName[:len(cm.ifName)-1]),
+		gocni.WithMinNetworkCount(1),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cni.Load(gocni.WithConfListFile(confListFile)); err != nil {
+		return nil, fmt.Errorf("failed to load CNI config %s: %w", confListFile, err)
+	}
+
+	cm.cni = cni
+	return cm, nil
+}
+
+// AddInterface Runs CNI ADD for the VM in the network namespace and returns the tap
+// created there together with the address the guest has to use
+func (cm *CNIManager) AddInterface(vmID, netNSPath string) (*NetworkInterface, error) {
+	logger := log.WithFields(log.Fields{"vmID": vmID, "netns": netNSPath})
+
+	logger.Debug("Adding CNI interface")
+
+	ctx, cancel := context.WithTimeout(context.Background(), cniTimeout)
+	defer cancel()
+
+	result, err := cm.cni.Setup(ctx, vmID, netNSPath)
+	if err != nil {
+		logger.WithError(err).Error("CNI ADD failed")
+		return nil, err
+	}
+
+	ni, err := cm.getNetworkInterface(result, netNSPath)
+	if err != nil {
+		logger.WithError(err).Error("Unexpected CNI result")
+		if err := cm.cni.Remove(ctx, vmID, netNSPath); err != nil {
+			logger.WithError(err).Error("CNI DEL failed after unexpected result")
+		}
+		return nil, err
+	}
+
+	return ni, nil
+}
+
+// RemoveInterface Runs CNI DEL for the VM in the network namespace
+func (cm *CNIManager) RemoveInterface(vmID, netNSPath string) error {
+	logger := log.WithFields(log.Fields{"vmID": vmID, "netns": netNSPath})
+
+	logger.Debug("Removing CNI interface")
+
+	ctx, cancel := context.WithTimeout(context.Background(), cniTimeout)
+	defer cancel()
+
+	if err := cm.cni.Remove(ctx, vmID, netNSPath); err != nil {
+		logger.WithError(err).Error("CNI DEL failed")
+		return err
+	}
+
+	return nil
+}
+
+// getNetworkInterface Finds the tap and the guest addresses in a CNI result. The tap is
+// the interface in the namespace that carries no address, the guest takes the
+// address and MAC of the interface that does
+func (cm *CNIManager) getNetworkInterface(result *gocni.Result, netNSPath string) (*NetworkInterface, error) {
+	ni := &NetworkInterface{NetNSPath: netNSPath}
+
+	for _, res := range result.Raw() {
+		for _, ipConf := range res.IPs {
+			if ipConf.Address.IP.To4() == nil {
+				if ni.PrimaryAddressV6 == "" {
+					ones, _ := ipConf.Address.Mask.Size()
+					ni.PrimaryAddressV6 = ipConf.Address.IP.String()
+					ni.SubnetV6 = fmt.Sprintf("/%d", ones)
+					if ipConf.Gateway != nil {
+						ni.GatewayAddressV6 = ipConf.Gateway.String()
+					}
+				}
+				continue
+			}
+
+			if ni.PrimaryAddress != "" {
+				continue
+			}
+
+			ones, _ := ipConf.Address.Mask.Size()
+			ni.PrimaryAddress = ipConf.Address.IP.String()
+			ni.Subnet = fmt.Sprintf("/%d", ones)
+			if ipConf.Gateway != nil {
+				ni.GatewayAddress = ipConf.Gateway.String()
+			}
+			if ipConf.Interface != nil && *ipConf.Interface < len(res.Interfaces) {
+				ni.MacAddress = res.Interfaces[*ipConf.Interface].Mac
+			}
+		}
+
+		for _, iface := range res.Interfaces {
+			if iface.Sandbox == netNSPath && iface.Name != cm.ifName {
+				ni.HostDevName = iface.Name
+			}
+		}
+	}
+
+	if ni.PrimaryAddress == "" {
+		return nil, errors.New("CNI result has no IPv4 address")
+	}
+
+	if ni.HostDevName == "" {
+		return nil, errors.New("CNI result has no tap device in the network namespace")
+	}
+
+	if ni.MacAddress == "" {
+		if cfg, ok := result.Interfaces[cm.ifName]; ok {
+			ni.MacAddress = cfg.Mac
+		}
+	}
+
+	return ni, nil
+}
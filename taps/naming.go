@@ -0,0 +1,296 @@
+// MIT License
+//
+// Copyright (c) 2021 Plamen Petrov, Amory Hoste and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package taps
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// IfacePrefix Prefix of all network interfaces created by puffer
+	IfacePrefix = "pfr"
+	// tapNamePrefix Prefix of tap names, followed by a base-36 counter
+	tapNamePrefix = IfacePrefix + "t"
+	// maxIfaceNameLen Maximum length of a Linux interface name (IFNAMSIZ - 1)
+	maxIfaceNameLen = 15
+	// DefaultTapNamesFile File persisting the tap names, under /run as taps do not survive reboots
+	DefaultTapNamesFile = "/run/puffer/taps.json"
+)
+
+// tapRecord Persisted tap of a VM
+type tapRecord struct {
+	Name string            `json:"name"`
+	Ni   *NetworkInterface `json:"ni,omitempty"`
+}
+
+// tapNames Allocates short, unique tap names for VMs and persists the mapping
+// from VM ID to tap, so that the mapping survives restarts
+type tapNames struct {
+	sync.Mutex
+	path       string
+	linkExists func(string) bool
+	Next       uint64                `json:"next"`
+	Taps       map[string]*tapRecord `json:"taps"`
+	byName     map[string]string
+}
+
+// newTapNames Loads the tap names persisted at path, if any, names of existing
+// network interfaces are skipped
+func newTapNames(path string, linkExists func(string) bool) *tapNames {
+	tn := &tapNames{
+		path:       path,
+		linkExists: linkExists,
+		Taps:       make(map[string]*tapRecord),
+		byName:     make(map[string]string),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithError(err).Warnf("Failed to read tap names from %s", path)
+		}
+		return tn
+	}
+
+	if err := json.Unmarshal(data, tn); err != nil {
+		log.WithError(err).Warnf("Failed to parse tap names from %s", path)
+		tn.Taps = make(map[string]*tapRecord)
+		return tn
+	}
+
+	for vmID, rec := range tn.Taps {
+		tn.byName[rec.Name] = vmID
+	}
+
+	return tn
+}
+
+// get Returns the tap name of the VM, allocating a new one if the VM has none
+func (tn *tapNames) get(vmID string) (string, error) {
+	tn.Lock()
+	defer tn.Unlock()
+
+	if rec, ok := tn.Taps[vmID]; ok {
+		return rec.Name, nil
+	}
+
+	name, err := tn.nextName()
+	if err != nil {
+		return "", err
+	}
+
+	tn.Taps[vmID] = &tapRecord{Name: name}
+	tn.byName[name] = vmID
+
+	return name, tn.persist()
+}
+
+// reserve Allocates a tap name that is not bound to a VM yet, it is not persisted
+func (tn *tapNames) reserve() (string, error) {
+	tn.Lock()
+	defer tn.Unlock()
+
+	name, err := tn.nextName()
+	if err != nil {
+		return "", err
+	}
+	tn.byName[name] = ""
+
+	return name, nil
+}
+
+// unreserve Frees a tap name that is not bound to a VM
+func (tn *tapNames) unreserve(name string) {
+	tn.Lock()
+	defer tn.Unlock()
+
+	if vmID, ok := tn.byName[name]; ok && vmID == "" {
+		delete(tn.byName, name)
+	}
+}
+
+// bind Binds a reserved tap and its network interface to the VM, the tap stays
+// reserved if the binding cannot be persisted
+func (tn *tapNames) bind(vmID string, ni *NetworkInterface) error {
+	tn.Lock()
+	defer tn.Unlock()
+
+	tn.Taps[vmID] = &tapRecord{Name: ni.HostDevName, Ni: ni}
+	tn.byName[ni.HostDevName] = vmID
+
+	if err := tn.persist(); err != nil {
+		delete(tn.Taps, vmID)
+		tn.byName[ni.HostDevName] = ""
+		return err
+	}
+
+	return nil
+}
+
+// has Returns whether a tap name was allocated for the VM
+func (tn *tapNames) has(vmID string) bool {
+	tn.Lock()
+	defer tn.Unlock()
+
+	_, ok := tn.Taps[vmID]
+	return ok
+}
+
+// nextName Returns the next free tap name, the lock has to be held
+func (tn *tapNames) nextName() (string, error) {
+	var name string
+	for {
+		name = tapNamePrefix + strconv.FormatUint(tn.Next, 36)
+		tn.Next++
+
+		if len(name) > maxIfaceNameLen {
+			return "", fmt.Errorf("%w: tap name space is exhausted", ErrCapacityExhausted)
+		}
+
+		// Skip names of leftover interfaces that are not in the persisted mapping
+		if _, taken := tn.byName[name]; taken {
+			continue
+		}
+		if tn.linkExists(name) {
+			continue
+		}
+		break
+	}
+
+	return name, nil
+}
+
+// lookup Returns the persisted tap of the VM
+func (tn *tapNames) lookup(vmID string) (tapRecord, bool) {
+	tn.Lock()
+	defer tn.Unlock()
+
+	rec, ok := tn.Taps[vmID]
+	if !ok {
+		return tapRecord{}, false
+	}
+	return *rec, true
+}
+
+// getVMID Returns the VM a tap name was allocated for
+func (tn *tapNames) getVMID(name string) (string, bool) {
+	tn.Lock()
+	defer tn.Unlock()
+
+	vmID, ok := tn.byName[name]
+	return vmID, ok && vmID != ""
+}
+
+// setInterface Records the network interface created for the VM's tap
+func (tn *tapNames) setInterface(vmID string, ni *NetworkInterface) error {
+	tn.Lock()
+	defer tn.Unlock()
+
+	rec, ok := tn.Taps[vmID]
+	if !ok {
+		return nil
+	}
+
+	rec.Ni = ni
+	return tn.persist()
+}
+
+// release Frees the tap name of the VM
+func (tn *tapNames) release(vmID string) error {
+	tn.Lock()
+	defer tn.Unlock()
+
+	rec, ok := tn.Taps[vmID]
+	if !ok {
+		return nil
+	}
+
+	delete(tn.byName, rec.Name)
+	delete(tn.Taps, vmID)
+
+	return tn.persist()
+}
+
+// persist Atomically writes the mapping to disk, the lock has to be held
+func (tn *tapNames) persist() error {
+	if tn.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(tn)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(tn.path), 0755); err != nil {
+		return err
+	}
+
+	tmpPath := tn.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		log.WithError(err).Errorf("Failed to persist tap names to %s", tn.path)
+		return err
+	}
+
+	return os.Rename(tmpPath, tn.path)
+}
+
+// GetTapName Returns the tap name of the VM, allocating a short unique name
+// with the IfacePrefix prefix if the VM has none
+func (tm *TapManager) GetTapName(vmID string) (string, error) {
+	return tm.tapNames.get(vmID)
+}
+
+// GetVMID Returns the VM a tap name was allocated for
+func (tm *TapManager) GetVMID(tapName string) (string, bool) {
+	return tm.tapNames.getVMID(tapName)
+}
+
+// ReleaseTapName Frees the tap name of the VM, the tap itself has to be removed first
+func (tm *TapManager) ReleaseTapName(vmID string) error {
+	return tm.tapNames.release(vmID)
+}
+
+// RemoveStaleTap Removes the tap persisted for a VM of a previous run, which the
+// tap manager did not create, and frees its name
+func (tm *TapManager) RemoveStaleTap(vmID string) error {
+	rec, ok := tm.tapNames.lookup(vmID)
+	if !ok {
+		return nil
+	}
+
+	log.WithFields(log.Fields{"vmID": vmID, "tap": rec.Name}).Debug("Removing stale tap")
+
+	if err := tm.removeTap(rec.Name, rec.Ni); err != nil {
+		return err
+	}
+
+	return tm.tapNames.release(vmID)
+}
@@ -0,0 +1,428 @@
+// MIT License
+//
+// Copyright (c) 2021 Plamen Petrov, Amory Hoste and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package taps
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// netNSDir Directory where named network namespaces are bind-mounted
+	netNSDir = "/var/run/netns"
+	// nsVethName Name of the namespace end of the veth pair, the same in every namespace
+	nsVethName = "veth0"
+	// vethSubnet Veth pairs are addressed from 169.254.0.0/16 in /31 point-to-point subnets
+	vethSubnet = "/31"
+	// vethSubnetV6 IPv6 veth pairs are addressed from fd00:fe::/64 in /127 point-to-point subnets
+	vethSubnetV6 = "/127"
+)
+
+// getNetNSName Creates the name of the network namespace of a tap
+func getNetNSName(tapName string) string {
+	return "puffer-" + tapName
+}
+
+// getHostVethName Creates the name of the host end of the veth pair of a tap
+func getHostVethName(tapIndex int) string {
+	return fmt.Sprintf("%sv%d", IfacePrefix, tapIndex)
+}
+
+// getVethAddresses Creates the host and namespace addresses of the veth pair of a tap
+func getVethAddresses(tapIndex int) (string, string) {
+	hostIdx, nsIdx := 2*tapIndex, 2*tapIndex+1
+	return fmt.Sprintf("169.254.%d.%d", hostIdx/256, hostIdx%256),
+		fmt.Sprintf("169.254.%d.%d", nsIdx/256, nsIdx%256)
+}
+
+// getVethAddressesV6 Creates the IPv6 host and namespace addresses of the veth pair of a tap
+func getVethAddressesV6(tapIndex int) (string, string) {
+	return fmt.Sprintf("fd00:fe::%x", 2*tapIndex), fmt.Sprintf("fd00:fe::%x", 2*tapIndex+1)
+}
+
+// AddNetNSTap Creates a network namespace holding the tap of the network interface,
+// connects it to the root namespace with a veth pair and routes the guest address to it.
+// A partially set up namespace is removed again on failure
+func (b netlinkBackend) AddNetNSTap(ni *NetworkInterface) (err error) {
+	logger := log.WithFields(log.Fields{"tap": ni.HostDevName, "netns": ni.NetNSPath})
+
+	logger.Debug("Creating network namespace for tap")
+
+	ns, err := newNetNS(filepath.Base(ni.NetNSPath))
+	if err != nil {
+		logger.Error("Network namespace could not be created")
+		return err
+	}
+	defer ns.Close()
+
+	defer func() {
+		if err == nil {
+			return
+		}
+		if rmErr := b.RemoveNetNSTap(ni); rmErr != nil {
+			logger.WithError(rmErr).Warn("Could not remove partially created network namespace")
+		}
+	}()
+
+	nsHandle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		logger.Error("Could not get a netlink handle for the network namespace")
+		return err
+	}
+	defer nsHandle.Delete()
+
+	la := netlink.NewLinkAttrs()
+	la.Name = ni.HostVethName
+	veth := &netlink.Veth{LinkAttrs: la, PeerName: nsVethName, PeerNamespace: netlink.NsFd(int(ns))}
+
+	if err := netlink.LinkAdd(veth); err != nil {
+		logger.Error("Veth pair could not be created")
+		return err
+	}
+
+	if err := setLinkAddrUp(&netlink.Handle{}, veth, ni.HostVethAddress+vethSubnet, ni.HostVethAddressV6, vethSubnetV6); err != nil {
+		logger.Error("Could not configure host end of the veth pair")
+		return err
+	}
+
+	// Everything below is configured inside the namespace
+	lo, err := nsHandle.LinkByName("lo")
+	if err != nil {
+		return err
+	}
+	if err := nsHandle.LinkSetUp(lo); err != nil {
+		logger.Error("Loopback could not be enabled")
+		return err
+	}
+
+	nsVeth, err := nsHandle.LinkByName(nsVethName)
+	if err != nil {
+		logger.Error("Could not find namespace end of the veth pair")
+		return err
+	}
+
+	if err := setLinkAddrUp(nsHandle, nsVeth, ni.NetNSVethAddress+vethSubnet, ni.NetNSVethAddressV6, vethSubnetV6); err != nil {
+		logger.Error("Could not configure namespace end of the veth pair")
+		return err
+	}
+
+	tapLa := netlink.NewLinkAttrs()
+	tapLa.Name = ni.HostDevName
+	tap := &netlink.Tuntap{LinkAttrs: tapLa, Mode: netlink.TUNTAP_MODE_TAP}
+
+	if err := nsHandle.LinkAdd(tap); err != nil {
+		logger.Error("Tap could not be created")
+		return err
+	}
+
+	hwAddr, err := net.ParseMAC(ni.MacAddress)
+	if err != nil {
+		logger.Error("Could not parse MAC")
+		return err
+	}
+
+	if err := nsHandle.LinkSetHardwareAddr(tap, hwAddr); err != nil {
+		logger.Error("Could not set MAC address")
+		return err
+	}
+
+	// The guest gateway lives on the tap, so the namespace answers for it
+	if err := setLinkAddrUp(nsHandle, tap, ni.GatewayAddress+ni.Subnet, ni.GatewayAddressV6, ni.SubnetV6); err != nil {
+		logger.Error("Could not configure tap")
+		return err
+	}
+
+	if err := nsHandle.RouteAdd(&netlink.Route{
+		LinkIndex: nsVeth.Attrs().Index,
+		Gw:        net.ParseIP(ni.HostVethAddress),
+	}); err != nil {
+		logger.Error("Could not add default route in the network namespace")
+		return err
+	}
+
+	if err := netlink.RouteAdd(&netlink.Route{
+		LinkIndex: veth.Attrs().Index,
+		Dst:       &net.IPNet{IP: net.ParseIP(ni.GetExternalAddress()), Mask: net.CIDRMask(32, 32)},
+		Gw:        net.ParseIP(ni.NetNSVethAddress),
+	}); err != nil {
+		logger.Error("Could not add route to the guest")
+		return err
+	}
+
+	if ni.PrimaryAddressV6 == "" {
+		return nil
+	}
+
+	if err := nsHandle.RouteAdd(&netlink.Route{
+		LinkIndex: nsVeth.Attrs().Index,
+		Gw:        net.ParseIP(ni.HostVethAddressV6),
+	}); err != nil {
+		logger.Error("Could not add IPv6 default route in the network namespace")
+		return err
+	}
+
+	if err := netlink.RouteAdd(&netlink.Route{
+		LinkIndex: veth.Attrs().Index,
+		Dst:       &net.IPNet{IP: net.ParseIP(ni.PrimaryAddressV6), Mask: net.CIDRMask(128, 128)},
+		Gw:        net.ParseIP(ni.NetNSVethAddressV6),
+	}); err != nil {
+		logger.Error("Could not add IPv6 route to the guest")
+		return err
+	}
+
+	return nil
+}
+
+// AddRemapRules Rewrites the external address to the primary address of the guest for
+// traffic entering the network namespace, and back for traffic leaving it
+func (netlinkBackend) AddRemapRules(ni *NetworkInterface) error {
+	logger := log.WithFields(log.Fields{"tap": ni.HostDevName, "netns": ni.NetNSPath})
+
+	externalAddr := net.ParseIP(ni.ExternalAddress).To4()
+	guestAddr := net.ParseIP(ni.PrimaryAddress).To4()
+	if externalAddr == nil || guestAddr == nil {
+		return fmt.Errorf("invalid remapping of %q to %q", ni.PrimaryAddress, ni.ExternalAddress)
+	}
+
+	ns, err := netns.GetFromPath(ni.NetNSPath)
+	if err != nil {
+		logger.Error("Could not open network namespace")
+		return err
+	}
+	defer ns.Close()
+
+	conn := nftables.Conn{NetNS: int(ns)}
+
+	natTable := &nftables.Table{
+		Name:   "nat",
+		Family: nftables.TableFamilyIPv4,
+	}
+
+	preCh := &nftables.Chain{
+		Name:     "PREROUTING",
+		Table:    natTable,
+		Type:     nftables.ChainTypeNAT,
+		Priority: nftables.ChainPriorityNATDest,
+		Hooknum:  nftables.ChainHookPrerouting,
+	}
+
+	postCh := &nftables.Chain{
+		Name:     "POSTROUTING",
+		Table:    natTable,
+		Type:     nftables.ChainTypeNAT,
+		Priority: nftables.ChainPriorityNATSource,
+		Hooknum:  nftables.ChainHookPostrouting,
+	}
+
+	// nft add rule ip nat PREROUTING iifname veth0 ip daddr externalAddr dnat to guestAddr
+	dnatRule := &nftables.Rule{
+		Table: natTable,
+		Chain: preCh,
+		Exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte(nsVethName + "\x00")},
+			// Load the destination address in register 1
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: externalAddr},
+			&expr.Immediate{Register: 1, Data: guestAddr},
+			&expr.NAT{Type: expr.NATTypeDestNAT, Family: unix.NFPROTO_IPV4, RegAddrMin: 1},
+		},
+	}
+
+	// nft add rule ip nat POSTROUTING oifname veth0 ip saddr guestAddr snat to externalAddr
+	snatRule := &nftables.Rule{
+		Table: natTable,
+		Chain: postCh,
+		Exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte(nsVethName + "\x00")},
+			// Load the source address in register 1
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: guestAddr},
+			&expr.Immediate{Register: 1, Data: externalAddr},
+			&expr.NAT{Type: expr.NATTypeSourceNAT, Family: unix.NFPROTO_IPV4, RegAddrMin: 1},
+		},
+	}
+
+	conn.AddTable(natTable)
+	conn.AddChain(preCh)
+	conn.AddChain(postCh)
+	conn.AddRule(dnatRule)
+	conn.AddRule(snatRule)
+
+	if err := conn.Flush(); err != nil {
+		logger.WithError(err).Error("Failed to remap guest address")
+		return err
+	}
+
+	return nil
+}
+
+// RemoveNetNSTap Removes the veth pair and the network namespace of a tap, the tap is
+// destroyed together with the namespace
+func (netlinkBackend) RemoveNetNSTap(ni *NetworkInterface) error {
+	logger := log.WithFields(log.Fields{"tap": ni.HostDevName, "netns": ni.NetNSPath})
+
+	logger.Debug("Removing network namespace of tap")
+
+	if veth, err := netlink.LinkByName(ni.HostVethName); err == nil {
+		if err := netlink.LinkDel(veth); err != nil {
+			logger.Error("Veth pair could not be removed")
+			return err
+		}
+	} else {
+		logger.Warn("Could not find veth pair")
+	}
+
+	if err := netns.DeleteNamed(filepath.Base(ni.NetNSPath)); err != nil && !os.IsNotExist(err) {
+		logger.Error("Network namespace could not be removed")
+		return err
+	}
+
+	return nil
+}
+
+// newNetNS Creates a named network namespace with IP forwarding enabled,
+// without changing the namespace of the calling thread
+func newNetNS(name string) (netns.NsHandle, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origin, err := netns.Get()
+	if err != nil {
+		return netns.None(), err
+	}
+	defer origin.Close()
+
+	ns, err := netns.NewNamed(name)
+	if err != nil {
+		_ = netns.Set(origin)
+		return netns.None(), err
+	}
+
+	// /proc/sys/net resolves to the namespace of the opening thread
+	fwdErr := os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644)
+	if fwdErr == nil {
+		fwdErr = os.WriteFile("/proc/sys/net/ipv6/conf/all/forwarding", []byte("1"), 0644)
+	}
+
+	if err := netns.Set(origin); err != nil {
+		log.Panic("Could not switch back to the root network namespace")
+	}
+
+	if fwdErr != nil {
+		ns.Close()
+		_ = netns.DeleteNamed(name)
+		return netns.None(), fwdErr
+	}
+
+	return ns, nil
+}
+
+// setLinkAddrUp Adds an address, and an IPv6 address if given, to a link and enables it
+func setLinkAddrUp(h *netlink.Handle, link netlink.Link, address, addressV6, subnetV6 string) error {
+	addresses := []string{address}
+	if addressV6 != "" {
+		addresses = append(addresses, addressV6+subnetV6)
+	}
+
+	for _, address := range addresses {
+		addr, err := netlink.ParseAddr(address)
+		if err != nil {
+			return err
+		}
+
+		if err := h.AddrAdd(link, addr); err != nil {
+			return err
+		}
+	}
+
+	return h.LinkSetUp(link)
+}
+
+// AddIsolationRule Drops traffic from the guest that is not headed to the host interface,
+// which blocks guest-to-guest traffic routed through the root namespace
+func (netlinkBackend) AddIsolationRule(hostVethName, hostIface string, families []nftables.TableFamily) error {
+	conn := nftables.Conn{}
+
+	for _, family := range families {
+		filterTable := &nftables.Table{
+			Name:   "filter",
+			Family: family,
+		}
+
+		polAccept := nftables.ChainPolicyAccept
+		priority := nftables.ChainPriority(0)
+		fwdCh := &nftables.Chain{
+			Name:     fmt.Sprintf("FORWARD%s", hostVethName),
+			Table:    filterTable,
+			Type:     nftables.ChainTypeFilter,
+			Priority: &priority,
+			Hooknum:  nftables.ChainHookForward,
+			Policy:   &polAccept,
+		}
+
+		// nft add rule ip filter FORWARD iifname hostVethName oifname != hostIface drop
+		dropRule := &nftables.Rule{
+			Table: filterTable,
+			Chain: fwdCh,
+			Exprs: []expr.Any{
+				&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+				&expr.Cmp{
+					Op:       expr.CmpOpEq,
+					Register: 1,
+					Data:     []byte(fmt.Sprintf("%s\x00", hostVethName)),
+				},
+				&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+				&expr.Cmp{
+					Op:       expr.CmpOpNeq,
+					Register: 1,
+					Data:     []byte(fmt.Sprintf("%s\x00", hostIface)),
+				},
+				&expr.Verdict{
+					Kind: expr.VerdictDrop,
+				},
+			},
+		}
+
+		conn.AddTable(filterTable)
+		conn.AddChain(fwdCh)
+		conn.AddRule(dropRule)
+	}
+
+	if err := conn.Flush(); err != nil {
+		log.Warnf("Failed to setup isolation of %v\n%s\n", hostVethName, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+// MIT License
+//
+// Copyright (c) 2021 Plamen Petrov, Amory Hoste and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package taps
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// ProtocolTCP TCP port mapping
+	ProtocolTCP = "tcp"
+	// ProtocolUDP UDP port mapping
+	ProtocolUDP = "udp"
+)
+
+// PortMapping Publishes a guest port on a host port
+type PortMapping struct {
+	// Protocol Either ProtocolTCP or ProtocolUDP
+	Protocol string
+	// HostIP Host address to match, e.g. the pod IP, empty matches any address
+	HostIP string
+	// HostPort Port on the host
+	HostPort uint16
+	// GuestPort Port in the guest
+	GuestPort uint16
+}
+
+// getNATChains Creates the prerouting and output DNAT chains of a tap, the output
+// chain makes mappings reachable from the host itself
+func getNATChains(tapName string) (*nftables.Table, []*nftables.Chain) {
+	natTable := &nftables.Table{
+		Name:   "nat",
+		Family: nftables.TableFamilyIPv4,
+	}
+
+	priority := nftables.ChainPriorityNATDest
+	return natTable, []*nftables.Chain{
+		{
+			Name:     fmt.Sprintf("PREROUTING%s", tapName),
+			Table:    natTable,
+			Type:     nftables.ChainTypeNAT,
+			Priority: priority,
+			Hooknum:  nftables.ChainHookPrerouting,
+		},
+		{
+			Name:     fmt.Sprintf("OUTPUT%s", tapName),
+			Table:    natTable,
+			Type:     nftables.ChainTypeNAT,
+			Priority: priority,
+			Hooknum:  nftables.ChainHookOutput,
+		},
+	}
+}
+
+// getDNATExprs Creates the expressions of a rule that rewrites the destination of
+// packets to the mapped host port to the guest
+func getDNATExprs(guestIP string, m PortMapping) ([]expr.Any, error) {
+	var proto byte
+	switch m.Protocol {
+	case ProtocolTCP:
+		proto = unix.IPPROTO_TCP
+	case ProtocolUDP:
+		proto = unix.IPPROTO_UDP
+	default:
+		return nil, fmt.Errorf("unsupported protocol %q", m.Protocol)
+	}
+
+	guestAddr := net.ParseIP(guestIP).To4()
+	if guestAddr == nil {
+		return nil, fmt.Errorf("invalid guest address %q", guestIP)
+	}
+
+	var exprs []expr.Any
+
+	if m.HostIP != "" {
+		hostAddr := net.ParseIP(m.HostIP).To4()
+		if hostAddr == nil {
+			return nil, fmt.Errorf("invalid host address %q", m.HostIP)
+		}
+		exprs = append(exprs,
+			// Load the destination address in register 1
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: hostAddr},
+		)
+	}
+
+	return append(exprs,
+		// Check the transport protocol
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+		// Load the destination port in register 1
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(m.HostPort)},
+		// dnat to guestIP:guestPort
+		&expr.Immediate{Register: 1, Data: guestAddr},
+		&expr.Immediate{Register: 2, Data: binaryutil.BigEndian.PutUint16(m.GuestPort)},
+		&expr.NAT{
+			Type:        expr.NATTypeDestNAT,
+			Family:      unix.NFPROTO_IPV4,
+			RegAddrMin:  1,
+			RegProtoMin: 2,
+		},
+	), nil
+}
+
+// AddDNATRule Adds the DNAT rule of the port mapping to the prerouting and output chains of the tap
+func (netlinkBackend) AddDNATRule(tapName, guestIP string, m PortMapping) error {
+	exprs, err := getDNATExprs(guestIP, m)
+	if err != nil {
+		return err
+	}
+
+	conn := nftables.Conn{}
+	natTable, chains := getNATChains(tapName)
+	conn.AddTable(natTable)
+	for _, ch := range chains {
+		conn.AddChain(ch)
+		conn.AddRule(&nftables.Rule{Table: natTable, Chain: ch, Exprs: exprs})
+	}
+
+	return conn.Flush()
+}
+
+// RemoveDNATRules Flushes and deletes the DNAT chains of the tap
+func (netlinkBackend) RemoveDNATRules(tapName string) error {
+	conn := nftables.Conn{}
+	_, chains := getNATChains(tapName)
+	for _, ch := range chains {
+		conn.FlushChain(ch)
+		conn.DelChain(ch)
+	}
+
+	return conn.Flush()
+}
+
+// AddPortMapping Publishes a guest port of the tap's VM on a host port
+func (tm *TapManager) AddPortMapping(tapName string, m PortMapping) error {
+	logger := log.WithFields(log.Fields{"tap": tapName, "hostPort": m.HostPort, "guestPort": m.GuestPort})
+
+	tm.Lock()
+	defer tm.Unlock()
+
+	ni, ok := tm.createdTaps[tapName]
+	if !ok {
+		return errors.New("tap does not exist")
+	}
+
+	for otherTap, mappings := range tm.portMappings {
+		for _, other := range mappings {
+			if other.Protocol == m.Protocol && other.HostPort == m.HostPort &&
+				(other.HostIP == "" || m.HostIP == "" || other.HostIP == m.HostIP) {
+				logger.Errorf("Host port is already published for tap %s", otherTap)
+				return fmt.Errorf("host port %s/%d is already published", m.Protocol, m.HostPort)
+			}
+		}
+	}
+
+	logger.Debug("Publishing port")
+
+	if err := tm.backend.AddDNATRule(tapName, ni.GetExternalAddress(), m); err != nil {
+		logger.WithError(err).Error("Failed to publish port")
+		return err
+	}
+
+	tm.portMappings[tapName] = append(tm.portMappings[tapName], m)
+
+	return nil
+}
+
+// RemovePortMappings Removes all published ports of the tap's VM
+func (tm *TapManager) RemovePortMappings(tapName string) error {
+	tm.Lock()
+	defer tm.Unlock()
+
+	if len(tm.portMappings[tapName]) == 0 {
+		return nil
+	}
+
+	log.WithFields(log.Fields{"tap": tapName}).Debug("Removing published ports")
+
+	if err := tm.backend.RemoveDNATRules(tapName); err != nil {
+		log.WithFields(log.Fields{"tap": tapName}).WithError(err).Error("Failed to remove published ports")
+		return err
+	}
+
+	delete(tm.portMappings, tapName)
+
+	return nil
+}
+
+// GetPortMappings Returns the published ports of the tap's VM
+func (tm *TapManager) GetPortMappings(tapName string) []PortMapping {
+	tm.Lock()
+	defer tm.Unlock()
+
+	return append([]PortMapping(nil), tm.portMappings[tapName]...)
+}
@@ -0,0 +1,109 @@
+// MIT License
+//
+// Copyright (c) 2021 Plamen Petrov, Amory Hoste and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package taps
+
+import (
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RestoreTap Recreates a released tap for a VM restored from a snapshot. The tap keeps
+// the name, MAC and primary address of snapshotNi in its network namespace, while the
+// guest is reachable from the host at a freshly allocated external address
+func (tm *TapManager) RestoreTap(snapshotNi *NetworkInterface, hostIface string) (*NetworkInterface, error) {
+	if !tm.identityRemapping {
+		return nil, errors.New("identity remapping is not enabled")
+	}
+
+	tapName := snapshotNi.HostDevName
+	logger := log.WithFields(log.Fields{"tap": tapName})
+
+	tm.Lock()
+
+	if _, ok := tm.createdTaps[tapName]; ok {
+		tm.Unlock()
+		return nil, fmt.Errorf("tap %s was not released", tapName)
+	}
+
+	ts, err := tm.allocateSlot()
+	if err != nil {
+		tm.Unlock()
+		logger.WithError(err).Error("Could not allocate an external address for the tap")
+		return nil, err
+	}
+	tm.tapSlots[tapName] = ts
+
+	tm.Unlock()
+
+	ni := tm.getIsolatedInterface(tapName, ts.bridgeID, ts.slot)
+	if external := ni.PrimaryAddress; external != snapshotNi.PrimaryAddress {
+		ni.ExternalAddress = external
+	}
+	ni.MacAddress = snapshotNi.MacAddress
+	ni.PrimaryAddress = snapshotNi.PrimaryAddress
+	ni.Subnet = snapshotNi.Subnet
+	ni.GatewayAddress = snapshotNi.GatewayAddress
+
+	logger.Debugf("Restoring tap with guest address %s at %s", ni.PrimaryAddress, ni.GetExternalAddress())
+
+	if err := tm.backend.AddNetNSTap(ni); err != nil {
+		tm.releaseTap(tapName)
+		return nil, err
+	}
+
+	if ni.ExternalAddress != "" {
+		if err := tm.backend.AddRemapRules(ni); err != nil {
+			_ = tm.backend.RemoveNetNSTap(ni)
+			tm.releaseTap(tapName)
+			return nil, err
+		}
+	}
+
+	tm.Lock()
+	tm.createdTaps[tapName] = ni
+	tm.Unlock()
+
+	if err := tm.setupRules(ni, hostIface); err != nil {
+		// The remap rules are removed with the network namespace
+		if rmErr := tm.removeTap(tapName, ni); rmErr != nil {
+			logger.WithError(rmErr).Warn("Failed to remove tap after failure")
+		}
+		tm.releaseTap(tapName)
+		return nil, err
+	}
+
+	if vmID, ok := tm.GetVMID(tapName); ok {
+		if err := tm.tapNames.setInterface(vmID, ni); err != nil {
+			log.WithError(err).Warn("Failed to persist network interface")
+		}
+	}
+
+	return ni, nil
+}
+
+// GetIdentityRemapping Returns whether restored taps are remapped onto fresh addresses
+func (tm *TapManager) GetIdentityRemapping() bool {
+	return tm.identityRemapping
+}
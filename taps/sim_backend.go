@@ -0,0 +1,432 @@
+// MIT License
+//
+// Copyright (c) 2021 Plamen Petrov, Amory Hoste and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package taps
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/nftables"
+)
+
+const (
+	// SimHostIface Default host interface of the simulated backend
+	SimHostIface = "sim0"
+
+	// SimLinkBridge Kind of a simulated bridge
+	SimLinkBridge = "bridge"
+	// SimLinkTap Kind of a simulated tap
+	SimLinkTap = "tap"
+	// SimLinkVeth Kind of the host end of a simulated veth pair
+	SimLinkVeth = "veth"
+
+	// SimRuleForward Kind of a simulated forwarding rule
+	SimRuleForward = "forward"
+	// SimRuleMasquerade Kind of a simulated IPv6 masquerading rule
+	SimRuleMasquerade = "masquerade"
+	// SimRuleIsolation Kind of a simulated isolation rule
+	SimRuleIsolation = "isolation"
+	// SimRuleDNAT Kind of a simulated DNAT rule
+	SimRuleDNAT = "dnat"
+	// SimRuleRemap Kind of a simulated address remapping in a network namespace
+	SimRuleRemap = "remap"
+)
+
+// SimLink Network interface the simulated backend would have created
+type SimLink struct {
+	Kind       string
+	Name       string
+	Master     string
+	MacAddress string
+	Addresses  []string
+	// NetNS Name of the network namespace holding the link, empty for the root namespace
+	NetNS string
+}
+
+// SimRule nftables rule the simulated backend would have added
+type SimRule struct {
+	Kind      string
+	Link      string
+	HostIface string
+	Family    nftables.TableFamily
+	// GuestIP is only set for DNAT and remap rules
+	GuestIP string
+	// PortMapping is only set for DNAT rules
+	PortMapping PortMapping
+	// ExternalIP and NetNS are only set for remap rules
+	ExternalIP string
+	NetNS      string
+}
+
+// SimBackend Records the devices and rules it would have created in memory, it
+// needs no privileges so the tap manager can run on development hosts and in tests
+type SimBackend struct {
+	sync.Mutex
+	links  map[string]*SimLink
+	netNSs map[string]bool
+	rules  []SimRule
+	stats  map[string]LinkStats
+}
+
+// NewSimBackend Creates a simulated backend without any devices
+func NewSimBackend() *SimBackend {
+	return &SimBackend{
+		links:  make(map[string]*SimLink),
+		netNSs: make(map[string]bool),
+		stats:  make(map[string]LinkStats),
+	}
+}
+
+// linkKey Returns the key of a link, links in different namespaces may share a name
+func linkKey(netNS, name string) string {
+	return netNS + "/" + name
+}
+
+// addLink Records a link, the lock has to be held
+func (b *SimBackend) addLink(link *SimLink) error {
+	key := linkKey(link.NetNS, link.Name)
+	if _, ok := b.links[key]; ok {
+		return fmt.Errorf("link %s already exists", key)
+	}
+
+	b.links[key] = link
+	return nil
+}
+
+// CreateBridge Records a bridge
+func (b *SimBackend) CreateBridge(name string, gatewayAddrs []string) error {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.addLink(&SimLink{Kind: SimLinkBridge, Name: name, Addresses: append([]string(nil), gatewayAddrs...)})
+}
+
+// RemoveBridge Removes a bridge and detaches its taps
+func (b *SimBackend) RemoveBridge(name string) error {
+	b.Lock()
+	defer b.Unlock()
+
+	delete(b.links, linkKey("", name))
+	for _, link := range b.links {
+		if link.Master == name {
+			link.Master = ""
+		}
+	}
+
+	return nil
+}
+
+// CreateTap Records a tap connected to a bridge, the bridge has to exist
+func (b *SimBackend) CreateTap(name, bridgeName, macAddress string) error {
+	b.Lock()
+	defer b.Unlock()
+
+	if br, ok := b.links[linkKey("", bridgeName)]; !ok || br.Kind != SimLinkBridge {
+		return fmt.Errorf("bridge %s does not exist", bridgeName)
+	}
+
+	return b.addLink(&SimLink{Kind: SimLinkTap, Name: name, Master: bridgeName, MacAddress: macAddress})
+}
+
+// RemoveTap Removes a tap, its rules are removed separately like the netlink backend does
+func (b *SimBackend) RemoveTap(name string) error {
+	b.Lock()
+	defer b.Unlock()
+
+	delete(b.links, linkKey("", name))
+
+	return nil
+}
+
+// AddNetNSTap Records the network namespace, veth pair and tap of an isolated tap
+func (b *SimBackend) AddNetNSTap(ni *NetworkInterface) error {
+	b.Lock()
+	defer b.Unlock()
+
+	nsName := filepath.Base(ni.NetNSPath)
+	if b.netNSs[nsName] {
+		return fmt.Errorf("network namespace %s already exists", nsName)
+	}
+
+	veth := &SimLink{Kind: SimLinkVeth, Name: ni.HostVethName, Addresses: []string{ni.HostVethAddress + vethSubnet}}
+	if ni.HostVethAddressV6 != "" {
+		veth.Addresses = append(veth.Addresses, ni.HostVethAddressV6+vethSubnetV6)
+	}
+	if err := b.addLink(veth); err != nil {
+		return err
+	}
+
+	tap := &SimLink{Kind: SimLinkTap, Name: ni.HostDevName, MacAddress: ni.MacAddress, NetNS: nsName,
+		Addresses: []string{ni.GatewayAddress + ni.Subnet}}
+	if ni.GatewayAddressV6 != "" {
+		tap.Addresses = append(tap.Addresses, ni.GatewayAddressV6+ni.SubnetV6)
+	}
+	b.links[linkKey(nsName, tap.Name)] = tap
+	b.netNSs[nsName] = true
+
+	return nil
+}
+
+// AddRemapRules Records the remapping of the guest address in the network namespace of a tap
+func (b *SimBackend) AddRemapRules(ni *NetworkInterface) error {
+	b.Lock()
+	defer b.Unlock()
+
+	nsName := filepath.Base(ni.NetNSPath)
+	if !b.netNSs[nsName] {
+		return fmt.Errorf("network namespace %s does not exist", nsName)
+	}
+
+	b.rules = append(b.rules, SimRule{
+		Kind:       SimRuleRemap,
+		Link:       nsVethName,
+		Family:     nftables.TableFamilyIPv4,
+		GuestIP:    ni.PrimaryAddress,
+		ExternalIP: ni.ExternalAddress,
+		NetNS:      nsName,
+	})
+
+	return nil
+}
+
+// RemoveNetNSTap Removes the network namespace, veth pair and tap of an isolated tap
+func (b *SimBackend) RemoveNetNSTap(ni *NetworkInterface) error {
+	b.Lock()
+	defer b.Unlock()
+
+	nsName := filepath.Base(ni.NetNSPath)
+	delete(b.links, linkKey("", ni.HostVethName))
+	delete(b.links, linkKey(nsName, ni.HostDevName))
+	delete(b.netNSs, nsName)
+
+	// The rules of the namespace are gone with it
+	rules := b.rules[:0]
+	for _, rule := range b.rules {
+		if rule.NetNS != nsName {
+			rules = append(rules, rule)
+		}
+	}
+	b.rules = rules
+
+	return nil
+}
+
+// LinkExists Returns whether a link was recorded in the root namespace
+func (b *SimBackend) LinkExists(name string) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	_, ok := b.links[linkKey("", name)]
+	return ok
+}
+
+// ListTaps Returns the names of the recorded taps with the puffer prefix in the root namespace
+func (b *SimBackend) ListTaps() ([]string, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	var names []string
+	for _, link := range b.links {
+		if link.Kind == SimLinkTap && link.NetNS == "" && strings.HasPrefix(link.Name, tapNamePrefix) {
+			names = append(names, link.Name)
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// LinkStats Returns the counters set for the tap with SetLinkStats
+func (b *SimBackend) LinkStats(ni *NetworkInterface) (LinkStats, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	nsName := ""
+	if ni.NetNSPath != "" {
+		nsName = filepath.Base(ni.NetNSPath)
+	}
+	if _, ok := b.links[linkKey(nsName, ni.HostDevName)]; !ok {
+		return LinkStats{}, fmt.Errorf("link %s does not exist", ni.HostDevName)
+	}
+
+	return b.stats[ni.HostDevName], nil
+}
+
+// SetLinkStats Sets the counters returned for a tap
+func (b *SimBackend) SetLinkStats(tapName string, stats LinkStats) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.stats[tapName] = stats
+}
+
+// DefaultHostIface Returns SimHostIface
+func (b *SimBackend) DefaultHostIface() (string, error) {
+	return SimHostIface, nil
+}
+
+// AddForwardRules Records the forwarding rules of a link, and its masquerading rule for IPv6
+func (b *SimBackend) AddForwardRules(linkName, hostIface string, families []nftables.TableFamily) error {
+	if err := b.addRules(SimRuleForward, linkName, hostIface, families); err != nil {
+		return err
+	}
+
+	for _, family := range families {
+		if family == nftables.TableFamilyIPv6 {
+			return b.addRules(SimRuleMasquerade, linkName, hostIface, []nftables.TableFamily{family})
+		}
+	}
+
+	return nil
+}
+
+// RemoveForwardRules Removes the forwarding, masquerading and isolation rules of a link
+func (b *SimBackend) RemoveForwardRules(linkName string) error {
+	b.Lock()
+	defer b.Unlock()
+
+	b.removeRules(linkName, SimRuleForward)
+	b.removeRules(linkName, SimRuleMasquerade)
+	b.removeRules(linkName, SimRuleIsolation)
+
+	return nil
+}
+
+// AddIsolationRule Records the isolation rule of a link
+func (b *SimBackend) AddIsolationRule(linkName, hostIface string, families []nftables.TableFamily) error {
+	return b.addRules(SimRuleIsolation, linkName, hostIface, families)
+}
+
+func (b *SimBackend) addRules(kind, linkName, hostIface string, families []nftables.TableFamily) error {
+	b.Lock()
+	defer b.Unlock()
+
+	for _, family := range families {
+		b.rules = append(b.rules, SimRule{Kind: kind, Link: linkName, HostIface: hostIface, Family: family})
+	}
+
+	return nil
+}
+
+// AddDNATRule Records the DNAT rule of a port mapping
+func (b *SimBackend) AddDNATRule(tapName, guestIP string, m PortMapping) error {
+	if _, err := getDNATExprs(guestIP, m); err != nil {
+		return err
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.rules = append(b.rules, SimRule{
+		Kind:        SimRuleDNAT,
+		Link:        tapName,
+		Family:      nftables.TableFamilyIPv4,
+		GuestIP:     guestIP,
+		PortMapping: m,
+	})
+
+	return nil
+}
+
+// RemoveDNATRules Removes the DNAT rules of a tap
+func (b *SimBackend) RemoveDNATRules(tapName string) error {
+	b.Lock()
+	defer b.Unlock()
+
+	b.removeRules(tapName, SimRuleDNAT)
+
+	return nil
+}
+
+// removeRules Removes the rules of the given kind of a link, the lock has to be held
+func (b *SimBackend) removeRules(linkName, kind string) {
+	rules := b.rules[:0]
+	for _, rule := range b.rules {
+		if rule.Link != linkName || rule.Kind != kind {
+			rules = append(rules, rule)
+		}
+	}
+	b.rules = rules
+}
+
+// Links Returns the recorded links sorted by namespace and name
+func (b *SimBackend) Links() []SimLink {
+	b.Lock()
+	defer b.Unlock()
+
+	keys := make([]string, 0, len(b.links))
+	for key := range b.links {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	links := make([]SimLink, 0, len(keys))
+	for _, key := range keys {
+		link := *b.links[key]
+		link.Addresses = append([]string(nil), link.Addresses...)
+		links = append(links, link)
+	}
+
+	return links
+}
+
+// Link Returns the recorded link of the root namespace with the given name
+func (b *SimBackend) Link(name string) (SimLink, bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	link, ok := b.links[linkKey("", name)]
+	if !ok {
+		return SimLink{}, false
+	}
+
+	copied := *link
+	copied.Addresses = append([]string(nil), link.Addresses...)
+
+	return copied, true
+}
+
+// NetNSs Returns the names of the recorded network namespaces
+func (b *SimBackend) NetNSs() []string {
+	b.Lock()
+	defer b.Unlock()
+
+	names := make([]string, 0, len(b.netNSs))
+	for name := range b.netNSs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Rules Returns the recorded rules in the order they were added
+func (b *SimBackend) Rules() []SimRule {
+	b.Lock()
+	defer b.Unlock()
+
+	return append([]SimRule(nil), b.rules...)
+}
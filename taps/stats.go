@@ -0,0 +1,91 @@
+// MIT License
+//
+// Copyright (c) 2021 Plamen Petrov, Amory Hoste and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package taps
+
+import (
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// LinkStats Traffic counters of a VM network interface, seen from the guest
+type LinkStats struct {
+	RxBytes   uint64
+	RxPackets uint64
+	RxErrors  uint64
+	TxBytes   uint64
+	TxPackets uint64
+	TxErrors  uint64
+}
+
+// Add Adds the counters of other to the counters
+func (s *LinkStats) Add(other LinkStats) {
+	s.RxBytes += other.RxBytes
+	s.RxPackets += other.RxPackets
+	s.RxErrors += other.RxErrors
+	s.TxBytes += other.TxBytes
+	s.TxPackets += other.TxPackets
+	s.TxErrors += other.TxErrors
+}
+
+// GetLinkStats Reads the counters of the tap of a network interface,
+// they start from zero whenever the tap is created
+func (tm *TapManager) GetLinkStats(ni *NetworkInterface) (LinkStats, error) {
+	return tm.backend.LinkStats(ni)
+}
+
+// LinkStats Reads the counters of the tap of a network interface from netlink
+func (netlinkBackend) LinkStats(ni *NetworkInterface) (LinkStats, error) {
+	h := &netlink.Handle{}
+	if ni.NetNSPath != "" {
+		ns, err := netns.GetFromPath(ni.NetNSPath)
+		if err != nil {
+			return LinkStats{}, err
+		}
+		defer ns.Close()
+
+		if h, err = netlink.NewHandleAt(ns); err != nil {
+			return LinkStats{}, err
+		}
+		defer h.Delete()
+	}
+
+	link, err := h.LinkByName(ni.HostDevName)
+	if err != nil {
+		return LinkStats{}, err
+	}
+
+	st := link.Attrs().Statistics
+	if st == nil {
+		return LinkStats{}, nil
+	}
+
+	// What the tap transmits is received by the guest, and vice versa
+	return LinkStats{
+		RxBytes:   st.TxBytes,
+		RxPackets: st.TxPackets,
+		RxErrors:  st.TxErrors,
+		TxBytes:   st.RxBytes,
+		TxPackets: st.RxPackets,
+		TxErrors:  st.RxErrors,
+	}, nil
+}
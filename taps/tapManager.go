@@ -25,13 +25,12 @@ package taps
 import (
 	"bufio"
 	"bytes"
-	"errors"
 	"fmt"
 	"github.com/google/nftables"
 	"github.com/google/nftables/expr"
 	"os/exec"
+	"path/filepath"
 	"strings"
-	"sync/atomic"
 
 	log "github.com/sirupsen/logrus"
 
@@ -47,7 +46,7 @@ func getGatewayAddr(bridgeID int) string {
 
 // getBridgeName Create bridge name
 func getBridgeName(id int) string {
-	return fmt.Sprintf("br%d", id)
+	return fmt.Sprintf("%sbr%d", IfacePrefix, id)
 }
 
 // getPrimaryAddress Creates the primary address for a tap
@@ -55,308 +54,524 @@ func getPrimaryAddress(curTaps, bridgeID int) string {
 	return fmt.Sprintf("19%d.128.%d.%d", bridgeID, (curTaps+2)/256, (curTaps+2)%256)
 }
 
+// getGatewayAddrV6 Creates the IPv6 gateway address (first address in the bridge prefix)
+func getGatewayAddrV6(bridgeID int) string {
+	return fmt.Sprintf("%s%x::1", PrefixV6, bridgeID)
+}
+
+// getPrimaryAddressV6 Creates the IPv6 primary address for a tap
+func getPrimaryAddressV6(curTaps, bridgeID int) string {
+	return fmt.Sprintf("%s%x::%x", PrefixV6, bridgeID, curTaps+2)
+}
+
 // NewTapManager Creates a new tap manager
-func NewTapManager() *TapManager {
+func NewTapManager(opts ...TapManagerOption) *TapManager {
 	tm := new(TapManager)
 
-	tm.numBridges = NumBridges
-	tm.TapCountsPerBridge = make([]int64, NumBridges)
+	tm.bridges = make(map[int]*bridge)
+	tm.tapSlots = make(map[string]tapSlot)
 	tm.createdTaps = make(map[string]*NetworkInterface)
+	tm.portMappings = make(map[string][]PortMapping)
+	tm.tapNamesFile = DefaultTapNamesFile
+	tm.backend = netlinkBackend{}
+
+	for _, opt := range opts {
+		opt(tm)
+	}
+
+	tm.tapNames = newTapNames(tm.tapNamesFile, tm.backend.LinkExists)
 
-	log.Info("Registering bridges for tap manager")
+	if tm.identityRemapping && tm.dualStack {
+		log.Panic("Identity remapping only supports IPv4 and cannot be combined with dual-stack")
+	}
 
-	for i := 0; i < NumBridges; i++ {
-		brName := getBridgeName(i)
-		gatewayAddr := getGatewayAddr(i)
+	if tm.netNSIsolation {
+		log.Info("Tap manager isolates taps in network namespaces")
+	} else {
+		log.Info("Tap manager creates bridges on demand")
+	}
 
-		createBridge(brName, gatewayAddr)
+	if tm.pool != nil {
+		log.Infof("Tap manager keeps %d to %d ready taps", tm.pool.low, tm.pool.high)
+		go tm.runTapPool()
+		tm.pool.signal()
 	}
 
 	return tm
 }
 
-// Creates the bridge, add a gateway to it, and enables it
-func createBridge(bridgeName, gatewayAddr string) {
-	logger := log.WithFields(log.Fields{"bridge": bridgeName})
-
-	logger.Debug("Creating bridge")
+// getHostIface Returns the host default interface if hostIface is not specified
+func (tm *TapManager) getHostIface(hostIface string) (string, error) {
+	if hostIface != "" {
+		return hostIface, nil
+	}
 
-	la := netlink.NewLinkAttrs()
-	la.Name = bridgeName
+	return tm.backend.DefaultHostIface()
+}
 
-	br := &netlink.Bridge{LinkAttrs: la}
+// DefaultHostIface Returns the interface of the default route of the host
+func (netlinkBackend) DefaultHostIface() (string, error) {
+	var hostIface string
 
-	if err := netlink.LinkAdd(br); err != nil {
-		logger.Panic("Bridge could not be created")
+	out, err := exec.Command(
+		"route",
+	).Output()
+	if err != nil {
+		log.Warnf("Failed to fetch host net interfaces %v\n%s\n", err, out)
+		return "", err
 	}
-
-	if err := netlink.LinkSetUp(br); err != nil {
-		logger.Panic("Bridge could not be enabled")
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.Contains(line, "default") {
+			hostIface = line[strings.LastIndex(line, " ")+1:]
+		}
 	}
 
-	bridgeAddress := gatewayAddr + Subnet
+	return hostIface, nil
+}
 
-	addr, err := netlink.ParseAddr(bridgeAddress)
-	if err != nil {
-		log.Panic(fmt.Sprintf("could not parse bridge address %s", bridgeAddress))
+// AddForwardRules sets up forwarding rules to enable internet access inside the vm,
+// for each of the given address families
+func (netlinkBackend) AddForwardRules(tapName, hostIface string, families []nftables.TableFamily) error {
+	conn := nftables.Conn{}
+
+	for _, family := range families {
+		// 1. nft add table ip filter (and ip6 filter for dual-stack)
+		filterTable := &nftables.Table{
+			Name:   "filter",
+			Family: family,
+		}
+
+		// 2. nft add chain ip filter FORWARD { type filter hook forward priority 0; policy accept; }
+		polAccept := nftables.ChainPolicyAccept
+		priority := nftables.ChainPriority(0)
+		fwdCh := &nftables.Chain{
+			Name:     fmt.Sprintf("FORWARD%s", tapName),
+			Table:    filterTable,
+			Type:     nftables.ChainTypeFilter,
+			Priority: &priority,
+			Hooknum:  nftables.ChainHookForward,
+			Policy:   &polAccept,
+		}
+
+		// 3. iptables -A FORWARD -i tapName -o hostIface -j ACCEPT
+		// 3.1 nft add rule ip filter FORWARD iifname tapName oifname hostIface counter accept
+		outRule := &nftables.Rule{
+			Table: filterTable,
+			Chain: fwdCh,
+			Exprs: []expr.Any{
+				// Load iffname in register 1
+				&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+				// Check iifname == tapName
+				&expr.Cmp{
+					Op:       expr.CmpOpEq,
+					Register: 1,
+					Data:     []byte(fmt.Sprintf("%s\x00", tapName)),
+				},
+				// Load oifname in register 1
+				&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+				// Check oifname == hostIface
+				&expr.Cmp{
+					Op:       expr.CmpOpEq,
+					Register: 1,
+					Data:     []byte(fmt.Sprintf("%s\x00", hostIface)),
+				},
+				&expr.Verdict{
+					Kind: expr.VerdictAccept,
+				},
+			},
+		}
+
+		// 4. iptables -A FORWARD -o tapName -i hostIface -j ACCEPT
+		// 4.1 nft add rule ip filter FORWARD iifname hostIface oifname tapName counter accept
+		inRule := &nftables.Rule{
+			Table: filterTable,
+			Chain: fwdCh,
+			Exprs: []expr.Any{
+				// Load oifname in register 1
+				&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+				// Check oifname == tapName
+				&expr.Cmp{
+					Op:       expr.CmpOpEq,
+					Register: 1,
+					Data:     []byte(fmt.Sprintf("%s\x00", tapName)),
+				},
+				// Load iifname in register 1
+				&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+				// Check iifname == hostIface
+				&expr.Cmp{
+					Op:       expr.CmpOpEq,
+					Register: 1,
+					Data:     []byte(fmt.Sprintf("%s\x00", hostIface)),
+				},
+				&expr.Verdict{
+					Kind: expr.VerdictAccept,
+				},
+			},
+		}
+		conn.AddTable(filterTable)
+		conn.AddChain(fwdCh)
+		conn.AddRule(outRule)
+		conn.AddRule(inRule)
+
+		if family == nftables.TableFamilyIPv6 {
+			addMasqueradeV6(&conn, tapName, hostIface)
+		}
 	}
 
-	if err := netlink.AddrAdd(br, addr); err != nil {
-		logger.Panic(fmt.Sprintf("could not add %s to bridge", bridgeAddress))
+	if err := conn.Flush(); err != nil {
+		log.Warnf("Failed to setup forwarding out from tap %v\n%s\n", tapName, err)
+		return err
 	}
+	return nil
 }
 
-// setupForwardRules sets up forwarding rules to enable internet access inside the vm
-func setupForwardRules(tapName, hostIface string) error {
-	// Fetch host default interface if not specified
-	if hostIface == "" {
-		out, err := exec.Command(
-			"route",
-		).Output()
-		if err != nil {
-			log.Warnf("Failed to fetch host net interfaces %v\n%s\n", err, out)
-			return err
-		}
-		scanner := bufio.NewScanner(bytes.NewReader(out))
-		for scanner.Scan() {
-			line := scanner.Text()
-			if strings.Contains(line, "default") {
-				hostIface = line[strings.LastIndex(line, " ")+1:]
-			}
-		}
+// addMasqueradeV6 Masquerades the traffic of the IPv6 guests leaving through the host interface,
+// as their ULA addresses are not routed outside of the host
+func addMasqueradeV6(conn *nftables.Conn, linkName, hostIface string) {
+	_, guestNet, _ := net.ParseCIDR(GuestNetV6)
+
+	natTable := &nftables.Table{
+		Name:   "nat",
+		Family: nftables.TableFamilyIPv6,
 	}
 
-	conn := nftables.Conn{}
+	// nft add chain ip6 nat POSTROUTINGlinkName { type nat hook postrouting priority srcnat; }
+	postCh := &nftables.Chain{
+		Name:     fmt.Sprintf("POSTROUTING%s", linkName),
+		Table:    natTable,
+		Type:     nftables.ChainTypeNAT,
+		Priority: nftables.ChainPriorityNATSource,
+		Hooknum:  nftables.ChainHookPostrouting,
+	}
 
-	// 1. nft add table ip filter
-	filterTable := &nftables.Table{
-		Name:   "filter",
-		Family: nftables.TableFamilyIPv4,
-	}
-
-	// 2. nft add chain ip filter FORWARD { type filter hook forward priority 0; policy accept; }
-	polAccept := nftables.ChainPolicyAccept
-	priority := nftables.ChainPriority(0)
-	fwdCh := &nftables.Chain{
-		Name:     fmt.Sprintf("FORWARD%s", tapName),
-		Table:    filterTable,
-		Type:     nftables.ChainTypeFilter,
-		Priority: &priority,
-		Hooknum:  nftables.ChainHookForward,
-		Policy:   &polAccept,
-	}
-
-	// 3. iptables -A FORWARD -i tapName -o hostIface -j ACCEPT
-	// 3.1 nft add rule ip filter FORWARD iifname tapName oifname hostIface counter accept
-	outRule := &nftables.Rule{
-		Table: filterTable,
-		Chain: fwdCh,
+	// nft add rule ip6 nat POSTROUTINGlinkName ip6 saddr GuestNetV6 oifname hostIface masquerade
+	masqRule := &nftables.Rule{
+		Table: natTable,
+		Chain: postCh,
 		Exprs: []expr.Any{
-			// Load iffname in register 1
-			&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
-			// Check iifname == tapName
-			&expr.Cmp{
-				Op:       expr.CmpOpEq,
-				Register: 1,
-				Data:     []byte(fmt.Sprintf("%s\x00", tapName)),
+			// Load the source address in register 1 and keep the bits of the prefix
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 8, Len: 16},
+			&expr.Bitwise{
+				SourceRegister: 1,
+				DestRegister:   1,
+				Len:            16,
+				Mask:           guestNet.Mask,
+				Xor:            make([]byte, 16),
 			},
-			// Load oifname in register 1
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: guestNet.IP.To16()},
 			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
-			// Check oifname == hostIface
 			&expr.Cmp{
 				Op:       expr.CmpOpEq,
 				Register: 1,
 				Data:     []byte(fmt.Sprintf("%s\x00", hostIface)),
 			},
-			&expr.Verdict{
-				Kind: expr.VerdictAccept,
-			},
+			&expr.Masq{},
 		},
 	}
 
-	// 4. iptables -A FORWARD -o tapName -i hostIface -j ACCEPT
-	// 4.1 nft add rule ip filter FORWARD iifname hostIface oifname tapName counter accept
-	inRule := &nftables.Rule{
-		Table: filterTable,
-		Chain: fwdCh,
-		Exprs: []expr.Any{
-			// Load oifname in register 1
-			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
-			// Check oifname == tapName
-			&expr.Cmp{
-				Op:       expr.CmpOpEq,
-				Register: 1,
-				Data:     []byte(fmt.Sprintf("%s\x00", tapName)),
-			},
-			// Load iifname in register 1
-			&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
-			// Check iifname == hostIface
-			&expr.Cmp{
-				Op:       expr.CmpOpEq,
-				Register: 1,
-				Data:     []byte(fmt.Sprintf("%s\x00", hostIface)),
-			},
-			&expr.Verdict{
-				Kind: expr.VerdictAccept,
-			},
-		},
+	conn.AddTable(natTable)
+	conn.AddChain(postCh)
+	conn.AddRule(masqRule)
+}
+
+// RemoveForwardRules Flushes and deletes the forwarding chains of a link in all address
+// families, which also hold its isolation rule, and its IPv6 masquerading chain
+func (netlinkBackend) RemoveForwardRules(linkName string) error {
+	conn := nftables.Conn{}
+
+	chains, err := conn.ListChains()
+	if err != nil {
+		return err
+	}
+
+	fwdChName := fmt.Sprintf("FORWARD%s", linkName)
+	postChName := fmt.Sprintf("POSTROUTING%s", linkName)
+	for _, ch := range chains {
+		if (ch.Name == fwdChName && ch.Table.Name == "filter") ||
+			(ch.Name == postChName && ch.Table.Name == "nat" && ch.Table.Family == nftables.TableFamilyIPv6) {
+			conn.FlushChain(ch)
+			conn.DelChain(ch)
+		}
 	}
-	conn.AddTable(filterTable)
-	conn.AddChain(fwdCh)
-	conn.AddRule(outRule)
-	conn.AddRule(inRule)
 
 	if err := conn.Flush(); err != nil {
-		log.Warnf("Failed to setup forwarding out from tap %v\n%s\n", tapName, err)
+		log.Warnf("Failed to remove forwarding rules of %v\n%s\n", linkName, err)
 		return err
 	}
 	return nil
 }
 
-// AddTap Creates a new tap and returns the corresponding network interface
+// AddTap Creates a new tap and returns the corresponding network interface. A tap that
+// was removed but not released is recreated with the same network interface
 func (tm *TapManager) AddTap(tapName, hostIface string) (*NetworkInterface, error) {
 	tm.Lock()
 
 	if ni, ok := tm.createdTaps[tapName]; ok {
 		tm.Unlock()
-		return ni, tm.reconnectTap(tapName, ni)
+		if err := tm.reconnectTap(tapName, ni); err != nil {
+			return nil, err
+		}
+		// The rules of the tap were removed with it
+		return ni, tm.setupRules(ni, hostIface)
 	}
 
+	ts, err := tm.allocateSlot()
+	if err != nil {
+		tm.Unlock()
+		log.WithError(err).Error("Could not allocate an address for the tap")
+		return nil, err
+	}
+	tm.tapSlots[tapName] = ts
+
+	tm.Unlock()
+
+	ni, err := tm.addTap(tapName, ts.bridgeID, ts.slot)
+	if err != nil {
+		tm.releaseTap(tapName)
+		return nil, err
+	}
+
+	tm.Lock()
+	tm.createdTaps[tapName] = ni
 	tm.Unlock()
 
-	for i := 0; i < tm.numBridges; i++ {
-		tapsInBridge := atomic.AddInt64(&tm.TapCountsPerBridge[i], 1)
-		if tapsInBridge-1 < TapsPerBridge {
-			// Create a tap with this bridge
-			ni, err := tm.addTap(tapName, i, int(tapsInBridge-1))
-			if err == nil {
-				tm.Lock()
-				tm.createdTaps[tapName] = ni
-				tm.Unlock()
-				err := setupForwardRules(tapName, hostIface)
-				if err != nil {
-					return nil, err
-				}
-			}
-
-			return ni, err
+	if err := tm.setupRules(ni, hostIface); err != nil {
+		if rmErr := tm.removeTap(tapName, ni); rmErr != nil {
+			log.WithError(rmErr).Warn("Failed to remove tap after failure")
 		}
+		tm.releaseTap(tapName)
+		return nil, err
 	}
-	log.Error("No space for creating taps")
-	return nil, errors.New("No space for creating taps")
-}
 
-// Reconnects a single tap with the same network interface that it was
-// create with previously
-func (tm *TapManager) reconnectTap(tapName string, ni *NetworkInterface) error {
-	logger := log.WithFields(log.Fields{"tap": tapName, "bridge": ni.BridgeName})
+	if vmID, ok := tm.GetVMID(tapName); ok {
+		if err := tm.tapNames.setInterface(vmID, ni); err != nil {
+			log.WithError(err).Warn("Failed to persist network interface")
+		}
+	}
 
-	la := netlink.NewLinkAttrs()
-	la.Name = tapName
+	return ni, nil
+}
 
-	logger.Debug("Reconnecting tap")
+// ReleaseTap Frees the addresses of a removed tap, after which the bridge of the tap
+// is removed if it has no taps left
+func (tm *TapManager) ReleaseTap(tapName string) {
+	tm.releaseTap(tapName)
+}
 
-	tap := &netlink.Tuntap{LinkAttrs: la, Mode: netlink.TUNTAP_MODE_TAP}
+func (tm *TapManager) releaseTap(tapName string) {
+	tm.Lock()
+	defer tm.Unlock()
 
-	if err := netlink.LinkAdd(tap); err != nil {
-		logger.Error("Tap could not be reconnected")
-		return err
+	ts, ok := tm.tapSlots[tapName]
+	if !ok {
+		return
 	}
 
-	br, err := netlink.LinkByName(ni.BridgeName)
+	delete(tm.tapSlots, tapName)
+	delete(tm.createdTaps, tapName)
+	tm.releaseSlot(ts)
+}
+
+// setupRules Sets up the forwarding rules of a tap, or of its veth pair when isolated
+func (tm *TapManager) setupRules(ni *NetworkInterface, hostIface string) error {
+	// Fetch host default interface if not specified
+	hostIface, err := tm.getHostIface(hostIface)
 	if err != nil {
-		logger.Error("Could not reconnect tap, because corresponding bridge does not exist")
 		return err
 	}
 
-	hwAddr, err := net.ParseMAC(ni.MacAddress)
-	if err != nil {
-		logger.Error("Could not parse MAC")
-		return err
+	if ni.NetNSPath == "" {
+		return tm.backend.AddForwardRules(ni.HostDevName, hostIface, tm.getFamilies())
 	}
 
-	if err := netlink.LinkSetHardwareAddr(tap, hwAddr); err != nil {
-		logger.Error("Could not set MAC address")
+	if err := tm.backend.AddForwardRules(ni.HostVethName, hostIface, tm.getFamilies()); err != nil {
 		return err
 	}
 
-	if err := netlink.LinkSetMaster(tap, br); err != nil {
-		logger.Error("Master could not be set")
-		return err
+	if tm.allowGuestToGuest {
+		return nil
 	}
 
-	if err := netlink.LinkSetUp(tap); err != nil {
-		logger.Error("Tap could not be enabled")
-		return err
+	return tm.backend.AddIsolationRule(ni.HostVethName, hostIface, tm.getFamilies())
+}
+
+// getFamilies Returns the address families the taps are configured for
+func (tm *TapManager) getFamilies() []nftables.TableFamily {
+	if tm.dualStack {
+		return []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6}
 	}
 
-	return nil
+	return []nftables.TableFamily{nftables.TableFamilyIPv4}
+}
+
+// Reconnects a single tap with the same network interface that it was
+// create with previously
+func (tm *TapManager) reconnectTap(tapName string, ni *NetworkInterface) error {
+	if ni.NetNSPath != "" {
+		return tm.backend.AddNetNSTap(ni)
+	}
+
+	log.WithFields(log.Fields{"tap": tapName, "bridge": ni.BridgeName}).Debug("Reconnecting tap")
+
+	return tm.backend.CreateTap(tapName, ni.BridgeName, ni.MacAddress)
 }
 
 // Creates a single tap and connects it to the corresponding bridge
 func (tm *TapManager) addTap(tapName string, bridgeID, currentNumTaps int) (*NetworkInterface, error) {
+	if tm.netNSIsolation {
+		return tm.addIsolatedTap(tapName, bridgeID, currentNumTaps)
+	}
+
 	bridgeName := getBridgeName(bridgeID)
 
+	log.WithFields(log.Fields{"tap": tapName, "bridge": bridgeName}).Debug("Creating tap")
+
+	macIndex := bridgeID*TapsPerBridge + currentNumTaps
+	macAddress := fmt.Sprintf("02:FC:00:00:%02X:%02X", macIndex/256, macIndex%256)
+
+	if err := tm.backend.CreateTap(tapName, bridgeName, macAddress); err != nil {
+		return nil, err
+	}
+
+	ni := &NetworkInterface{
+		BridgeName:     bridgeName,
+		MacAddress:     macAddress,
+		PrimaryAddress: getPrimaryAddress(currentNumTaps, bridgeID),
+		HostDevName:    tapName,
+		Subnet:         Subnet,
+		GatewayAddress: getGatewayAddr(bridgeID),
+	}
+	tm.setAddressesV6(ni, bridgeID, currentNumTaps)
+
+	return ni, nil
+}
+
+// setAddressesV6 Assigns the IPv6 addresses of a tap if the tap manager is dual-stack
+func (tm *TapManager) setAddressesV6(ni *NetworkInterface, bridgeID, currentNumTaps int) {
+	if !tm.dualStack {
+		return
+	}
+
+	ni.PrimaryAddressV6 = getPrimaryAddressV6(currentNumTaps, bridgeID)
+	ni.GatewayAddressV6 = getGatewayAddrV6(bridgeID)
+	ni.SubnetV6 = SubnetV6
+}
+
+// Creates a single tap in its own network namespace, the addresses are taken from the
+// pool of the corresponding bridge even though the bridge does not exist
+func (tm *TapManager) addIsolatedTap(tapName string, bridgeID, currentNumTaps int) (*NetworkInterface, error) {
+	ni := tm.getIsolatedInterface(tapName, bridgeID, currentNumTaps)
+
+	if err := tm.backend.AddNetNSTap(ni); err != nil {
+		return nil, err
+	}
+
+	return ni, nil
+}
+
+// getIsolatedInterface Creates the network interface of a tap in its own network namespace
+func (tm *TapManager) getIsolatedInterface(tapName string, bridgeID, currentNumTaps int) *NetworkInterface {
+	tapIndex := bridgeID*TapsPerBridge + currentNumTaps
+	hostVethAddr, nsVethAddr := getVethAddresses(tapIndex)
+
+	ni := &NetworkInterface{
+		MacAddress:       fmt.Sprintf("02:FC:00:00:%02X:%02X", tapIndex/256, tapIndex%256),
+		PrimaryAddress:   getPrimaryAddress(currentNumTaps, bridgeID),
+		HostDevName:      tapName,
+		Subnet:           Subnet,
+		GatewayAddress:   getGatewayAddr(bridgeID),
+		NetNSPath:        filepath.Join(netNSDir, getNetNSName(tapName)),
+		HostVethName:     getHostVethName(tapIndex),
+		HostVethAddress:  hostVethAddr,
+		NetNSVethAddress: nsVethAddr,
+	}
+	tm.setAddressesV6(ni, bridgeID, currentNumTaps)
+	if tm.dualStack {
+		ni.HostVethAddressV6, ni.NetNSVethAddressV6 = getVethAddressesV6(tapIndex)
+	}
+
+	return ni
+}
+
+// RemoveTap Removes the tap
+func (tm *TapManager) RemoveTap(tapName string) error {
+	logger := log.WithFields(log.Fields{"tap": tapName})
+
+	logger.Debug("Removing tap")
+
+	tm.Lock()
+	ni := tm.createdTaps[tapName]
+	tm.Unlock()
+
+	return tm.removeTap(tapName, ni)
+}
+
+// removeTap Removes the devices of a tap, with its network namespace if it has one, and its rules
+func (tm *TapManager) removeTap(tapName string, ni *NetworkInterface) error {
+	linkName := tapName
+
+	if ni != nil && ni.NetNSPath != "" {
+		linkName = ni.HostVethName
+		if err := tm.backend.RemoveNetNSTap(ni); err != nil {
+			return err
+		}
+	} else if err := tm.backend.RemoveTap(tapName); err != nil {
+		return err
+	}
+
+	return tm.backend.RemoveForwardRules(linkName)
+}
+
+// CreateTap Creates the tap, sets its MAC address, connects it to the bridge and enables it
+func (netlinkBackend) CreateTap(tapName, bridgeName, macAddress string) error {
 	logger := log.WithFields(log.Fields{"tap": tapName, "bridge": bridgeName})
 
 	la := netlink.NewLinkAttrs()
 	la.Name = tapName
 
-	logger.Debug("Creating tap")
-
 	tap := &netlink.Tuntap{LinkAttrs: la, Mode: netlink.TUNTAP_MODE_TAP}
 
 	if err := netlink.LinkAdd(tap); err != nil {
 		logger.Error("Tap could not be created")
-		return nil, err
+		return err
 	}
 
 	br, err := netlink.LinkByName(bridgeName)
 	if err != nil {
 		logger.Error("Could not create tap, because corresponding bridge does not exist")
-		return nil, err
-	}
-
-	if err := netlink.LinkSetMaster(tap, br); err != nil {
-		logger.Error("Master could not be set")
-		return nil, err
+		return err
 	}
 
-	macIndex := bridgeID*TapsPerBridge + currentNumTaps
-	macAddress := fmt.Sprintf("02:FC:00:00:%02X:%02X", macIndex/256, macIndex%256)
-
 	hwAddr, err := net.ParseMAC(macAddress)
 	if err != nil {
 		logger.Error("Could not parse MAC")
-		return nil, err
+		return err
 	}
 
 	if err := netlink.LinkSetHardwareAddr(tap, hwAddr); err != nil {
 		logger.Error("Could not set MAC address")
-		return nil, err
+		return err
+	}
+
+	if err := netlink.LinkSetMaster(tap, br); err != nil {
+		logger.Error("Master could not be set")
+		return err
 	}
 
 	if err := netlink.LinkSetUp(tap); err != nil {
 		logger.Error("Tap could not be enabled")
-		return nil, err
+		return err
 	}
 
-	return &NetworkInterface{
-		BridgeName:     bridgeName,
-		MacAddress:     macAddress,
-		PrimaryAddress: getPrimaryAddress(currentNumTaps, bridgeID),
-		HostDevName:    tapName,
-		Subnet:         Subnet,
-		GatewayAddress: getGatewayAddr(bridgeID),
-	}, nil
+	return nil
 }
 
 // RemoveTap Removes the tap
-func (tm *TapManager) RemoveTap(tapName string) error {
+func (netlinkBackend) RemoveTap(tapName string) error {
 	logger := log.WithFields(log.Fields{"tap": tapName})
 
-	logger.Debug("Removing tap")
-
 	tap, err := netlink.LinkByName(tapName)
 	if err != nil {
 		logger.Warn("Could not find tap")
@@ -371,22 +586,22 @@ func (tm *TapManager) RemoveTap(tapName string) error {
 	return nil
 }
 
-// RemoveBridges Removes the bridges created by the tap manager
-func (tm *TapManager) RemoveBridges() {
-	log.Info("Removing bridges")
-	for i := 0; i < tm.numBridges; i++ {
-		bridgeName := getBridgeName(i)
+// LinkExists Returns whether the network interface exists
+func (netlinkBackend) LinkExists(name string) bool {
+	_, err := netlink.LinkByName(name)
+	return err == nil
+}
 
-		logger := log.WithFields(log.Fields{"bridge": bridgeName})
+// RemoveBridges Removes the taps of the tap pool and the bridges created by the tap manager
+func (tm *TapManager) RemoveBridges() {
+	tm.removeTapPool()
 
-		br, err := netlink.LinkByName(bridgeName)
-		if err != nil {
-			logger.Warn("Could not find bridge")
-			continue
-		}
+	tm.Lock()
+	defer tm.Unlock()
 
-		if err := netlink.LinkDel(br); err != nil {
-			logger.WithFields(log.Fields{"bridge": bridgeName}).Panic("Bridge could not be deleted")
-		}
+	log.Info("Removing bridges")
+	for id := range tm.bridges {
+		tm.removeBridge(id)
+		delete(tm.bridges, id)
 	}
 }
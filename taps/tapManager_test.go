@@ -0,0 +1,359 @@
+// MIT License
+//
+// Copyright (c) 2021 Plamen Petrov, Amory Hoste and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package taps
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/stretchr/testify/require"
+)
+
+func newSimTapManager(opts ...TapManagerOption) (*TapManager, *SimBackend) {
+	sim := NewSimBackend()
+	opts = append([]TapManagerOption{WithBackend(sim), WithTapNamesFile("")}, opts...)
+
+	return NewTapManager(opts...), sim
+}
+
+func TestAddTapCreatesBridgeOnDemand(t *testing.T) {
+	tm, sim := newSimTapManager()
+	require.Empty(t, sim.Links(), "Bridges must not be created eagerly")
+
+	ni, err := tm.AddTap("pfrt0", "")
+	require.NoError(t, err, "Failed to add tap")
+	require.Equal(t, "190.128.0.2", ni.PrimaryAddress)
+	require.Equal(t, "190.128.0.1", ni.GatewayAddress)
+
+	br, ok := sim.Link("pfrbr0")
+	require.True(t, ok, "Bridge was not created")
+	require.Equal(t, []string{"190.128.0.1" + Subnet}, br.Addresses)
+
+	tap, ok := sim.Link("pfrt0")
+	require.True(t, ok, "Tap was not created")
+	require.Equal(t, "pfrbr0", tap.Master)
+	require.Equal(t, ni.MacAddress, tap.MacAddress)
+
+	require.Equal(t, []SimRule{
+		{Kind: SimRuleForward, Link: "pfrt0", HostIface: SimHostIface, Family: nftables.TableFamilyIPv4},
+	}, sim.Rules())
+}
+
+func TestReleaseTapReusesAddressAndRemovesEmptyBridge(t *testing.T) {
+	tm, sim := newSimTapManager()
+
+	_, err := tm.AddTap("pfrt0", "")
+	require.NoError(t, err, "Failed to add tap")
+	ni1, err := tm.AddTap("pfrt1", "")
+	require.NoError(t, err, "Failed to add tap")
+	require.Equal(t, "190.128.0.3", ni1.PrimaryAddress)
+
+	require.NoError(t, tm.RemoveTap("pfrt0"), "Failed to remove tap")
+	tm.ReleaseTap("pfrt0")
+
+	ni2, err := tm.AddTap("pfrt2", "")
+	require.NoError(t, err, "Failed to add tap")
+	require.Equal(t, "190.128.0.2", ni2.PrimaryAddress, "Freed address was not reused")
+
+	for _, tapName := range []string{"pfrt1", "pfrt2"} {
+		_, ok := sim.Link("pfrbr0")
+		require.True(t, ok, "Bridge was removed while it had taps")
+
+		require.NoError(t, tm.RemoveTap(tapName), "Failed to remove tap")
+		tm.ReleaseTap(tapName)
+	}
+
+	require.Empty(t, sim.Links(), "Empty bridge was not removed")
+}
+
+func TestRecreateTapKeepsNetworkInterface(t *testing.T) {
+	tm, sim := newSimTapManager()
+
+	ni, err := tm.AddTap("pfrt0", "")
+	require.NoError(t, err, "Failed to add tap")
+
+	require.NoError(t, tm.RemoveTap("pfrt0"), "Failed to remove tap")
+	_, ok := sim.Link("pfrt0")
+	require.False(t, ok, "Tap was not removed")
+
+	recreated, err := tm.AddTap("pfrt0", "")
+	require.NoError(t, err, "Failed to recreate tap")
+	require.Equal(t, ni, recreated)
+
+	tap, ok := sim.Link("pfrt0")
+	require.True(t, ok, "Tap was not recreated")
+	require.Equal(t, ni.MacAddress, tap.MacAddress)
+}
+
+// failingRulesBackend Simulates a host where nftables rules cannot be added
+type failingRulesBackend struct {
+	*SimBackend
+}
+
+func (failingRulesBackend) AddForwardRules(string, string, []nftables.TableFamily) error {
+	return errors.New("nftables is not available")
+}
+
+func TestAddTapReleasesTapWhenRulesFail(t *testing.T) {
+	sim := NewSimBackend()
+	tm := NewTapManager(WithBackend(failingRulesBackend{sim}), WithTapNamesFile(""))
+
+	_, err := tm.AddTap("pfrt0", "")
+	require.Error(t, err, "Tap was added without forwarding rules")
+	require.Empty(t, sim.Links(), "Tap and bridge were left behind")
+
+	tm.backend = sim
+	ni, err := tm.AddTap("pfrt1", "")
+	require.NoError(t, err, "Failed to add tap")
+	require.Equal(t, "190.128.0.2", ni.PrimaryAddress, "Address of the failed tap was not freed")
+}
+
+func TestNetNSIsolation(t *testing.T) {
+	tm, sim := newSimTapManager(WithNetNSIsolation(false))
+
+	ni, err := tm.AddTap("pfrt0", "eth0")
+	require.NoError(t, err, "Failed to add tap")
+	require.Equal(t, "/var/run/netns/puffer-pfrt0", ni.NetNSPath)
+
+	require.Equal(t, []string{"puffer-pfrt0"}, sim.NetNSs())
+	require.Equal(t, []SimLink{
+		{Kind: SimLinkVeth, Name: ni.HostVethName, Addresses: []string{ni.HostVethAddress + vethSubnet}},
+		{Kind: SimLinkTap, Name: "pfrt0", MacAddress: ni.MacAddress, NetNS: "puffer-pfrt0",
+			Addresses: []string{ni.GatewayAddress + Subnet}},
+	}, sim.Links(), "Isolated taps must not be on a bridge")
+
+	require.Equal(t, []SimRule{
+		{Kind: SimRuleForward, Link: ni.HostVethName, HostIface: "eth0", Family: nftables.TableFamilyIPv4},
+		{Kind: SimRuleIsolation, Link: ni.HostVethName, HostIface: "eth0", Family: nftables.TableFamilyIPv4},
+	}, sim.Rules())
+
+	require.NoError(t, tm.RemoveTap("pfrt0"), "Failed to remove tap")
+	require.Empty(t, sim.NetNSs(), "Network namespace was not removed")
+	require.Empty(t, sim.Links(), "Veth pair was not removed")
+	require.Empty(t, sim.Rules(), "Forwarding and isolation rules were not removed")
+}
+
+func TestDualStack(t *testing.T) {
+	tm, sim := newSimTapManager(WithDualStack())
+
+	ni, err := tm.AddTap("pfrt0", "")
+	require.NoError(t, err, "Failed to add tap")
+	require.Equal(t, "fd00:fc:0:0::2", ni.PrimaryAddressV6)
+
+	br, ok := sim.Link("pfrbr0")
+	require.True(t, ok, "Bridge was not created")
+	require.Equal(t, []string{"190.128.0.1" + Subnet, "fd00:fc:0:0::1" + SubnetV6}, br.Addresses)
+
+	require.Equal(t, []SimRule{
+		{Kind: SimRuleForward, Link: "pfrt0", HostIface: SimHostIface, Family: nftables.TableFamilyIPv4},
+		{Kind: SimRuleForward, Link: "pfrt0", HostIface: SimHostIface, Family: nftables.TableFamilyIPv6},
+		{Kind: SimRuleMasquerade, Link: "pfrt0", HostIface: SimHostIface, Family: nftables.TableFamilyIPv6},
+	}, sim.Rules(), "Forwarding rules must be added for both families and IPv6 guests masqueraded")
+
+	require.NoError(t, tm.RemoveTap("pfrt0"), "Failed to remove tap")
+	require.Empty(t, sim.Rules(), "Rules were not removed with the tap")
+}
+
+func TestPortMappings(t *testing.T) {
+	tm, sim := newSimTapManager()
+
+	_, err := tm.AddTap("pfrt0", "")
+	require.NoError(t, err, "Failed to add tap")
+	_, err = tm.AddTap("pfrt1", "")
+	require.NoError(t, err, "Failed to add tap")
+
+	m := PortMapping{Protocol: ProtocolTCP, HostPort: 8080, GuestPort: 80}
+	require.NoError(t, tm.AddPortMapping("pfrt0", m), "Failed to publish port")
+	require.Error(t, tm.AddPortMapping("pfrt1", m), "Host port was published twice")
+	require.Error(t, tm.AddPortMapping("pfrt1", PortMapping{Protocol: "sctp", HostPort: 9090, GuestPort: 90}),
+		"Unsupported protocol was published")
+
+	require.Contains(t, sim.Rules(), SimRule{
+		Kind:        SimRuleDNAT,
+		Link:        "pfrt0",
+		Family:      nftables.TableFamilyIPv4,
+		GuestIP:     "190.128.0.2",
+		PortMapping: m,
+	})
+	require.Equal(t, []PortMapping{m}, tm.GetPortMappings("pfrt0"))
+
+	require.NoError(t, tm.RemovePortMappings("pfrt0"), "Failed to remove published ports")
+	for _, rule := range sim.Rules() {
+		require.NotEqual(t, SimRuleDNAT, rule.Kind, "DNAT rule was not removed")
+	}
+	require.NoError(t, tm.AddPortMapping("pfrt1", m), "Failed to publish port after it was freed")
+}
+
+func TestClaimTapFromPool(t *testing.T) {
+	tm, sim := newSimTapManager(WithTapPool(1, 2, ""))
+	defer tm.RemoveBridges()
+
+	require.Eventually(t, func() bool { return tm.pool.size() == 2 }, time.Second, 10*time.Millisecond,
+		"Tap pool was not filled")
+
+	ni, fromPool, err := tm.ClaimTap("vm1", "")
+	require.NoError(t, err, "Failed to claim tap")
+	require.True(t, fromPool, "Tap was not claimed from the pool")
+
+	tapName, err := tm.GetTapName("vm1")
+	require.NoError(t, err, "Failed to get tap name")
+	require.Equal(t, ni.HostDevName, tapName)
+
+	vmID, ok := tm.GetVMID(tapName)
+	require.True(t, ok, "Claimed tap is not bound to the VM")
+	require.Equal(t, "vm1", vmID)
+
+	_, ok = sim.Link(tapName)
+	require.True(t, ok, "Claimed tap does not exist")
+
+	require.Eventually(t, func() bool { return tm.pool.size() == 2 }, time.Second, 10*time.Millisecond,
+		"Tap pool was not refilled")
+}
+
+func TestClaimTapKeepsUnpersistedTapInPool(t *testing.T) {
+	tm, _ := newSimTapManager(WithTapPool(1, 2, ""))
+	defer tm.RemoveBridges()
+
+	require.Eventually(t, func() bool { return tm.pool.size() == 2 }, time.Second, 10*time.Millisecond,
+		"Tap pool was not filled")
+
+	// The tap names cannot be persisted below a regular file
+	file := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(file, nil, 0644))
+	tm.tapNames.Lock()
+	tm.tapNames.path = filepath.Join(file, "taps.json")
+	tm.tapNames.Unlock()
+
+	_, _, err := tm.ClaimTap("vm1", "")
+	require.Error(t, err, "Tap was claimed without being persisted")
+	require.Equal(t, 2, tm.pool.size(), "Unpersisted tap was not pushed back to the pool")
+	require.False(t, tm.tapNames.has("vm1"), "Unpersisted binding was kept")
+
+	tm.tapNames.Lock()
+	tm.tapNames.path = ""
+	tm.tapNames.Unlock()
+
+	ni, fromPool, err := tm.ClaimTap("vm1", "")
+	require.NoError(t, err, "Failed to claim tap once the names can be persisted")
+	require.True(t, fromPool, "Tap was not claimed from the pool")
+
+	vmID, ok := tm.GetVMID(ni.HostDevName)
+	require.True(t, ok, "Claimed tap is not bound to the VM")
+	require.Equal(t, "vm1", vmID)
+}
+
+func TestRestoreTapRemapsIdentity(t *testing.T) {
+	tm, sim := newSimTapManager(WithIdentityRemapping())
+
+	snapshotNi, err := tm.AddTap("pfrt0", "")
+	require.NoError(t, err, "Failed to add tap")
+	require.Empty(t, snapshotNi.ExternalAddress)
+
+	// The snapshot's address is freed while the VM is offloaded and taken by another tap
+	require.NoError(t, tm.RemoveTap("pfrt0"), "Failed to remove tap")
+	tm.ReleaseTap("pfrt0")
+	other, err := tm.AddTap("pfrt1", "")
+	require.NoError(t, err, "Failed to add tap")
+	require.Equal(t, snapshotNi.PrimaryAddress, other.PrimaryAddress)
+
+	ni, err := tm.RestoreTap(snapshotNi, "")
+	require.NoError(t, err, "Failed to restore tap")
+	require.Equal(t, snapshotNi.HostDevName, ni.HostDevName)
+	require.Equal(t, snapshotNi.MacAddress, ni.MacAddress)
+	require.Equal(t, snapshotNi.PrimaryAddress, ni.PrimaryAddress)
+	require.Equal(t, "190.128.0.3", ni.ExternalAddress)
+	require.Equal(t, ni.ExternalAddress, ni.GetExternalAddress())
+
+	require.Contains(t, sim.Rules(), SimRule{
+		Kind:       SimRuleRemap,
+		Link:       nsVethName,
+		Family:     nftables.TableFamilyIPv4,
+		GuestIP:    snapshotNi.PrimaryAddress,
+		ExternalIP: ni.ExternalAddress,
+		NetNS:      "puffer-pfrt0",
+	})
+
+	_, err = tm.RestoreTap(snapshotNi, "")
+	require.Error(t, err, "Tap was restored twice")
+}
+
+func TestRestoreTapReleasesTapWhenRulesFail(t *testing.T) {
+	sim := NewSimBackend()
+	tm := NewTapManager(WithBackend(sim), WithTapNamesFile(""), WithIdentityRemapping())
+
+	snapshotNi, err := tm.AddTap("pfrt0", "")
+	require.NoError(t, err, "Failed to add tap")
+	require.NoError(t, tm.RemoveTap("pfrt0"), "Failed to remove tap")
+	tm.ReleaseTap("pfrt0")
+
+	tm.backend = failingRulesBackend{sim}
+	_, err = tm.RestoreTap(snapshotNi, "")
+	require.Error(t, err, "Tap was restored without forwarding rules")
+	require.Empty(t, sim.NetNSs(), "Network namespace was left behind")
+	require.Empty(t, sim.Links(), "Veth pair was left behind")
+	require.Empty(t, sim.Rules(), "Remap rules were left behind")
+
+	tm.backend = sim
+	ni, err := tm.RestoreTap(snapshotNi, "")
+	require.NoError(t, err, "Failed to restore tap after its address was freed")
+	require.Empty(t, ni.ExternalAddress, "Address of the failed restore was not freed")
+}
+
+func TestAdoptTapAfterRestart(t *testing.T) {
+	sim := NewSimBackend()
+	namesFile := filepath.Join(t.TempDir(), "taps.json")
+
+	tm := NewTapManager(WithBackend(sim), WithTapNamesFile(namesFile))
+	ni, _, err := tm.ClaimTap("1", "")
+	require.NoError(t, err, "Failed to claim tap")
+
+	// A restarted tap manager only has the persisted taps
+	tm = NewTapManager(WithBackend(sim), WithTapNamesFile(namesFile))
+	require.Equal(t, []string{"1"}, tm.ListTapVMs())
+
+	adopted, err := tm.AdoptTap("1")
+	require.NoError(t, err, "Failed to adopt tap")
+	require.Equal(t, ni, adopted)
+
+	_, err = tm.AdoptTap("1")
+	require.Error(t, err, "Tap was adopted twice")
+
+	ni2, _, err := tm.ClaimTap("2", "")
+	require.NoError(t, err, "Failed to claim tap")
+	require.NotEqual(t, ni.PrimaryAddress, ni2.PrimaryAddress, "Address of the adopted tap was reused")
+
+	require.NoError(t, sim.CreateTap("pfrtzz", "pfrbr0", "02:FC:00:00:FF:FF"))
+
+	removed, err := tm.RemoveUnknownTaps()
+	require.NoError(t, err, "Failed to remove unknown taps")
+	require.Equal(t, []string{"pfrtzz"}, removed)
+
+	for _, tapName := range []string{ni.HostDevName, ni2.HostDevName} {
+		_, ok := sim.Link(tapName)
+		require.True(t, ok, "Known tap %s was removed", tapName)
+	}
+}
@@ -0,0 +1,200 @@
+// MIT License
+//
+// Copyright (c) 2021 Plamen Petrov, Amory Hoste and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package taps
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// tapPool Ready taps with their addresses and forwarding rules configured, which
+// are refilled up to the high watermark once no more than the low watermark are left
+type tapPool struct {
+	sync.Mutex
+	low       int
+	high      int
+	hostIface string
+	ready     []*NetworkInterface
+	refill    chan struct{}
+	stop      chan struct{}
+	stopOnce  sync.Once
+	done      chan struct{}
+}
+
+// WithTapPool Keeps between low and high ready taps in a background pool that
+// allocation claims taps from, the taps are connected to hostIface
+func WithTapPool(low, high int, hostIface string) TapManagerOption {
+	return func(tm *TapManager) {
+		if high < low {
+			high = low
+		}
+
+		tm.pool = &tapPool{
+			low:       low,
+			high:      high,
+			hostIface: hostIface,
+			refill:    make(chan struct{}, 1),
+			stop:      make(chan struct{}),
+			done:      make(chan struct{}),
+		}
+	}
+}
+
+// signal Wakes up the refill loop without blocking
+func (p *tapPool) signal() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+// pop Takes a ready tap from the pool, returns nil if the pool is empty
+func (p *tapPool) pop() *NetworkInterface {
+	p.Lock()
+	defer p.Unlock()
+
+	if len(p.ready) == 0 {
+		return nil
+	}
+
+	ni := p.ready[len(p.ready)-1]
+	p.ready = p.ready[:len(p.ready)-1]
+
+	return ni
+}
+
+func (p *tapPool) push(ni *NetworkInterface) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.ready = append(p.ready, ni)
+}
+
+func (p *tapPool) size() int {
+	p.Lock()
+	defer p.Unlock()
+
+	return len(p.ready)
+}
+
+// runTapPool Refills the tap pool whenever it drops below the low watermark
+func (tm *TapManager) runTapPool() {
+	p := tm.pool
+	defer close(p.done)
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-p.refill:
+		}
+
+		if p.size() > p.low {
+			continue
+		}
+
+		for p.size() < p.high {
+			select {
+			case <-p.stop:
+				return
+			default:
+			}
+
+			ni, err := tm.addPoolTap()
+			if err != nil {
+				log.WithError(err).Warn("Failed to refill tap pool")
+				break
+			}
+
+			p.push(ni)
+		}
+	}
+}
+
+// addPoolTap Creates a tap that is not bound to a VM yet
+func (tm *TapManager) addPoolTap() (*NetworkInterface, error) {
+	tapName, err := tm.tapNames.reserve()
+	if err != nil {
+		return nil, err
+	}
+
+	ni, err := tm.AddTap(tapName, tm.pool.hostIface)
+	if err != nil {
+		_ = tm.RemoveTap(tapName)
+		tm.ReleaseTap(tapName)
+		tm.tapNames.unreserve(tapName)
+		return nil, err
+	}
+
+	return ni, nil
+}
+
+// ClaimTap Returns the network interface of a new tap for the VM, taking a ready
+// tap from the tap pool if possible. Returns whether the tap came from the pool
+func (tm *TapManager) ClaimTap(vmID, hostIface string) (*NetworkInterface, bool, error) {
+	if tm.pool != nil {
+		defer tm.pool.signal()
+
+		// A VM that already has a tap name has to get its tap back
+		if !tm.tapNames.has(vmID) {
+			if ni := tm.pool.pop(); ni != nil {
+				// An unpersisted tap would be lost to the adoption and collection after a restart
+				if err := tm.tapNames.bind(vmID, ni); err != nil {
+					log.WithError(err).Error("Failed to persist network interface")
+					tm.pool.push(ni)
+					return nil, false, err
+				}
+				return ni, true, nil
+			}
+		}
+	}
+
+	tapName, err := tm.GetTapName(vmID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	ni, err := tm.AddTap(tapName, hostIface)
+
+	return ni, false, err
+}
+
+// removeTapPool Stops refilling the tap pool and removes its taps
+func (tm *TapManager) removeTapPool() {
+	p := tm.pool
+	if p == nil {
+		return
+	}
+
+	p.stopOnce.Do(func() { close(p.stop) })
+	<-p.done
+
+	for ni := p.pop(); ni != nil; ni = p.pop() {
+		if err := tm.RemoveTap(ni.HostDevName); err != nil {
+			log.WithError(err).Warnf("Failed to remove pool tap %s", ni.HostDevName)
+		}
+		tm.ReleaseTap(ni.HostDevName)
+		tm.tapNames.unreserve(ni.HostDevName)
+	}
+}
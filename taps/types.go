@@ -23,24 +23,84 @@
 package taps
 
 import (
+	"errors"
 	"sync"
 )
 
 const (
 	// Subnet Number of bits in the subnet mask
 	Subnet = "/10"
+	// PrefixV6 IPv6 ULA prefix of the bridges, each bridge gets a /64 below it
+	PrefixV6 = "fd00:fc:0:"
+	// SubnetV6 Number of bits in the IPv6 subnet mask
+	SubnetV6 = "/64"
+	// GuestNetV6 IPv6 network holding the prefixes of all bridges, masqueraded on the host interface
+	GuestNetV6 = "fd00:fc::/48"
 	// TapsPerBridge Number of taps per bridge
 	TapsPerBridge = 1000
-	// NumBridges is the number of bridges for the TapManager
-	NumBridges = 2
+	// MaxBridges is the maximum number of bridges of the TapManager,
+	// bounded by the 19X.128.0.0/10 address scheme
+	MaxBridges = 10
 )
 
+// ErrCapacityExhausted No tap addresses or tap names are left
+var ErrCapacityExhausted = errors.New("tap capacity exhausted")
+
 // TapManager A Tap Manager
 type TapManager struct {
 	sync.Mutex
-	numBridges         int
-	TapCountsPerBridge []int64
-	createdTaps        map[string]*NetworkInterface
+	bridges      map[int]*bridge
+	tapSlots     map[string]tapSlot
+	createdTaps  map[string]*NetworkInterface
+	portMappings map[string][]PortMapping
+	tapNames     *tapNames
+	tapNamesFile string
+	pool         *tapPool
+	backend      Backend
+	// netNSIsolation Each tap lives in its own network namespace instead of on a bridge
+	netNSIsolation    bool
+	allowGuestToGuest bool
+	dualStack         bool
+	// identityRemapping Restored taps keep the network identity of their snapshot
+	// behind NAT to a fresh external address
+	identityRemapping bool
+}
+
+// TapManagerOption Options to pass to TapManager
+type TapManagerOption func(*TapManager)
+
+// WithNetNSIsolation Places every tap in its own network namespace, connected to the
+// host with a routed veth pair, guest-to-guest traffic is dropped unless allowed
+func WithNetNSIsolation(allowGuestToGuest bool) TapManagerOption {
+	return func(tm *TapManager) {
+		tm.netNSIsolation = true
+		tm.allowGuestToGuest = allowGuestToGuest
+	}
+}
+
+// WithTapNamesFile Sets the file persisting the mapping from VM IDs to taps,
+// an empty path keeps the mapping in memory only
+func WithTapNamesFile(path string) TapManagerOption {
+	return func(tm *TapManager) {
+		tm.tapNamesFile = path
+	}
+}
+
+// WithIdentityRemapping Restores taps onto fresh addresses, while the guest keeps the
+// tap name, MAC and address of its snapshot inside the network namespace of the tap
+// and NAT maps them to the fresh address. It implies network namespace isolation
+func WithIdentityRemapping() TapManagerOption {
+	return func(tm *TapManager) {
+		tm.identityRemapping = true
+		tm.netNSIsolation = true
+	}
+}
+
+// WithDualStack Assigns an IPv6 address next to the IPv4 address of every tap
+func WithDualStack() TapManagerOption {
+	return func(tm *TapManager) {
+		tm.dualStack = true
+	}
 }
 
 // NetworkInterface Network interface type, NI names are generated based on expected tap names
@@ -51,4 +111,30 @@ type NetworkInterface struct {
 	PrimaryAddress string
 	Subnet         string
 	GatewayAddress string
+	// NetNSPath Path of the network namespace holding the tap, empty for the root namespace
+	NetNSPath string
+	// HostVethName Host end of the veth pair connecting the namespace
+	HostVethName string
+	// HostVethAddress Address of the host end of the veth pair
+	HostVethAddress string
+	// NetNSVethAddress Address of the namespace end of the veth pair
+	NetNSVethAddress string
+	// IPv6 counterparts of the addresses above, empty unless dual-stack
+	PrimaryAddressV6   string
+	SubnetV6           string
+	GatewayAddressV6   string
+	HostVethAddressV6  string
+	NetNSVethAddressV6 string
+	// ExternalAddress Address the guest is reachable at when its PrimaryAddress is
+	// remapped with NAT in the network namespace, empty if it is not remapped
+	ExternalAddress string
+}
+
+// GetExternalAddress Returns the address the guest is reachable at from the host
+func (ni *NetworkInterface) GetExternalAddress() string {
+	if ni.ExternalAddress != "" {
+		return ni.ExternalAddress
+	}
+
+	return ni.PrimaryAddress
 }